@@ -3,6 +3,8 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/autarch/metagodoc/esmodels"
@@ -21,19 +23,52 @@ func New(l *logger.Logger, el *elastic.Client) *handlers {
 	return &handlers{l, el}
 }
 
+// The repository that the standard library is indexed from.
+const stdlibRepository = "github.com/golang/go"
+
+// isStdlibPath reports whether an import path could be in the standard
+// library, like "net/http". As the go tool does, we assume that any path
+// whose first element doesn't contain a dot is. Plenty of other things look
+// like that too, such as GOPATH import paths and the IDs of repositories
+// cloned from a path on disk, so this is only checked once we know there's
+// no repository with that ID.
+func isStdlibPath(p string) bool {
+	first := strings.SplitN(p, "/", 2)[0]
+	return first != "" && !strings.Contains(first, ".")
+}
+
+// getRepo finds a repository by its ID. If the repository is now stored
+// under another ID, because it was renamed or transferred or because the ID
+// we were given has different case, this returns the repository with a 301
+// status so that the caller can redirect to its ID. A repository that has
+// gone away upstream gets a 410 status. If we can't find a repository at
+// all, and the ID looks like a standard library import path, we return the
+// repository that the standard library is indexed from.
 func (h *handlers) getRepo(repo string) (*esmodels.Repository, int) {
 	result, err := h.el.Get().
 		Index("metagodoc-repository").
 		Type("repository").
 		Id(repo).
 		Do(context.Background())
-	if err != nil {
+	if err != nil && !elastic.IsNotFound(err) {
 		h.l.Errorf("Elastic get failed: %s", err)
 		return nil, 500
 	}
 
-	if !result.Found {
-		return nil, 404
+	if err != nil || !result.Found {
+		esr, status := h.getRepoByOtherID(repo)
+		if status != 404 {
+			return esr, status
+		}
+		status = h.tombstoneStatus(repo)
+		if status != 0 {
+			return nil, status
+		}
+		esr, status = h.getRepoByImportPath(repo)
+		if status == 404 && repo != stdlibRepository && isStdlibPath(repo) {
+			return h.getRepo(stdlibRepository)
+		}
+		return esr, status
 	}
 
 	esr := &esmodels.Repository{}
@@ -43,13 +78,95 @@ func (h *handlers) getRepo(repo string) (*esmodels.Repository, int) {
 		return nil, 500
 	}
 
-	return esr, nil
+	return esr, 0
+}
+
+// getRepoByOtherID finds a repository by its ID in any case or by one of
+// the IDs it had before it was renamed or transferred. The status is 301 if
+// the repository is found.
+func (h *handlers) getRepoByOtherID(repo string) (*esmodels.Repository, int) {
+	lower := strings.ToLower(repo)
+	result, err := h.el.Search().
+		Index("metagodoc-repository").
+		Type("repository").
+		Query(elastic.NewBoolQuery().Should(
+			elastic.NewTermQuery("lower_id", lower),
+			elastic.NewTermQuery("aliases", lower),
+		)).
+		Size(1).
+		Do(context.Background())
+	if err != nil {
+		h.l.Errorf("Elastic search failed: %s", err)
+		return nil, 500
+	}
+
+	if result.Hits == nil || len(result.Hits.Hits) == 0 {
+		return nil, 404
+	}
+
+	esr := &esmodels.Repository{}
+	err = json.Unmarshal(*result.Hits.Hits[0].Source, esr)
+	if err != nil {
+		h.l.Errorf("Unmarshal: %s", err)
+		return nil, 500
+	}
+
+	return esr, 301
+}
+
+// tombstoneStatus returns 410 if the repository has gone away upstream.
+// Otherwise it returns 0.
+func (h *handlers) tombstoneStatus(repo string) int {
+	exists, err := h.el.Exists().
+		Index("metagodoc-tombstone").
+		Type("tombstone").
+		Id(strings.ToLower(repo)).
+		Do(context.Background())
+	if err != nil {
+		h.l.Errorf("Elastic exists failed: %s", err)
+		return 500
+	}
+	if exists {
+		return 410
+	}
+	return 0
+}
+
+// getRepoByImportPath finds a repository by one of its canonical import
+// paths. This lets a repository be found using either the path it is hosted
+// at, like "github.com/go-yaml/yaml", or its vanity import path, like
+// "gopkg.in/yaml.v2".
+func (h *handlers) getRepoByImportPath(importPath string) (*esmodels.Repository, int) {
+	result, err := h.el.Search().
+		Index("metagodoc-repository").
+		Type("repository").
+		Query(elastic.NewTermQuery("canonical_import_paths", importPath)).
+		Size(1).
+		Do(context.Background())
+	if err != nil {
+		h.l.Errorf("Elastic search failed: %s", err)
+		return nil, 500
+	}
+
+	if result.Hits == nil || len(result.Hits.Hits) == 0 {
+		return nil, 404
+	}
+
+	esr := &esmodels.Repository{}
+	err = json.Unmarshal(*result.Hits.Hits[0].Source, esr)
+	if err != nil {
+		h.l.Errorf("Unmarshal: %s", err)
+		return nil, 500
+	}
+
+	return esr, 0
 }
 
 func (h *handlers) getRef(repo, ref string) (*esmodels.Repository, *esmodels.Ref, int) {
 	esr, status := h.getRepo(repo)
 	if status != 0 {
-		return nil, nil, status
+		// The caller needs the repository to redirect to it.
+		return esr, nil, status
 	}
 
 	var esref *esmodels.Ref
@@ -60,32 +177,87 @@ func (h *handlers) getRef(repo, ref string) (*esmodels.Repository, *esmodels.Ref
 		}
 	}
 
-	if ref == nil {
+	if esref == nil {
 		return nil, nil, 404
 	}
 
 	return esr, esref, 0
 }
 
+// packagesQuery matches the packages stored by the crawl that built the ref.
+func packagesQuery(esr *esmodels.Repository, esref *esmodels.Ref) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("repository", esr.ID),
+		elastic.NewTermQuery("ref", esref.Name),
+		elastic.NewTermQuery("generation", esref.Generation),
+	)
+}
+
+// getPackage finds a package in a ref by its full import path, like
+// "math/rand" or "github.com/stretchr/testify/assert".
 func (h *handlers) getPackage(repo, ref, pkg string) (*esmodels.Repository, *esmodels.Ref, *esmodels.Package, int) {
 	esr, esref, status := h.getRef(repo, ref)
 	if status != 0 {
-		return nil, nil, nil, status
+		return esr, nil, nil, status
 	}
 
-	var esp *esmodels.Package
-	for _, p := range esref.Packages {
-		if p.Name == pkg {
-			esp = pkg
-			break
-		}
+	result, err := h.el.Search().
+		Index("metagodoc-package").
+		Type("package").
+		Query(packagesQuery(esr, esref).Filter(elastic.NewTermQuery("package.import_path", pkg))).
+		Size(1).
+		Do(context.Background())
+	if err != nil {
+		h.l.Errorf("Elastic search failed: %s", err)
+		return nil, nil, nil, 500
 	}
 
-	if esp == nil {
+	if result.Hits == nil || len(result.Hits.Hits) == 0 {
 		return nil, nil, nil, 404
 	}
 
-	return esr, esref, esp, 0
+	esp := &esmodels.ESPackage{}
+	err = json.Unmarshal(*result.Hits.Hits[0].Source, esp)
+	if err != nil {
+		h.l.Errorf("Unmarshal: %s", err)
+		return nil, nil, nil, 500
+	}
+
+	return esr, esref, esp.Package, 0
+}
+
+// getPackages returns every package in a ref. A ref can have thousands of
+// packages so we scroll through them rather than asking for them all at
+// once.
+func (h *handlers) getPackages(esr *esmodels.Repository, esref *esmodels.Ref) ([]*esmodels.Package, int) {
+	scroll := h.el.Scroll("metagodoc-package").
+		Type("package").
+		Query(packagesQuery(esr, esref)).
+		Sort("dir", true).
+		Size(500)
+	defer scroll.Clear(context.Background())
+
+	var pkgs []*esmodels.Package
+	for {
+		result, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			return pkgs, 0
+		}
+		if err != nil {
+			h.l.Errorf("Elastic scroll failed: %s", err)
+			return nil, 500
+		}
+
+		for _, hit := range result.Hits.Hits {
+			esp := &esmodels.ESPackage{}
+			err = json.Unmarshal(*hit.Source, esp)
+			if err != nil {
+				h.l.Errorf("Unmarshal: %s", err)
+				return nil, 500
+			}
+			pkgs = append(pkgs, esp.Package)
+		}
+	}
 }
 
 func (h *handlers) dt(val string) (*strfmt.DateTime, error) {
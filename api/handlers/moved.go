@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/runtime/middleware"
+)
+
+// movedResponder redirects to the same URL with a repository's current ID
+// in place of the ID it was requested with.
+type movedResponder struct {
+	location string
+}
+
+func moved(r *http.Request, from, to string) middleware.Responder {
+	path := r.URL.EscapedPath()
+	for _, f := range []string{url.PathEscape(from), from} {
+		if strings.Contains(path, "/repository/"+f) {
+			path = strings.Replace(path, "/repository/"+f, "/repository/"+url.PathEscape(to), 1)
+			break
+		}
+	}
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	return &movedResponder{location: path}
+}
+
+func (m *movedResponder) WriteResponse(rw http.ResponseWriter, p runtime.Producer) {
+	rw.Header().Set("Location", m.location)
+	rw.WriteHeader(http.StatusMovedPermanently)
+}
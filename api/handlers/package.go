@@ -9,7 +9,10 @@ import (
 func (h *handlers) GetRepositoryRefPackage(
 	params operations.GetRepositoryRepositoryRefRefPackagePackageParams,
 ) middleware.Responder {
-	esr, ref, status := h.getRef(params.Repository, params.Ref, params.Package)
+	esr, _, pkg, status := h.getPackage(params.Repository, params.Ref, params.Package)
+	if status == 301 {
+		return moved(params.HTTPRequest, params.Repository, esr.ID)
+	}
 	if status != 0 {
 		return operations.NewGetRepositoryRepositoryRefRefPackagePackageDefault(status)
 	}
@@ -10,14 +10,17 @@ import (
 
 func (h *handlers) GetRepositoryRef(params operations.GetRepositoryRepositoryRefRefParams) middleware.Responder {
 	esr, ref, status := h.getRef(params.Repository, params.Ref)
+	if status == 301 {
+		return moved(params.HTTPRequest, params.Repository, esr.ID)
+	}
 	if status != 0 {
 		return operations.NewGetRepositoryRepositoryRefRefDefault(status)
 	}
 
-	return h.maybeRefOkResponse(ref)
+	return h.maybeRefOkResponse(esr, ref)
 }
 
-func (h *handlers) maybeRefOkResponse(ref *esmodels.Ref) middleware.Responder {
+func (h *handlers) maybeRefOkResponse(esr *esmodels.Repository, ref *esmodels.Ref) middleware.Responder {
 	lsc, err := h.dt(ref.LastSeenCommit)
 	if err != nil {
 		return operations.NewGetRepositoryRepositoryRefRefDefault(500)
@@ -28,13 +31,18 @@ func (h *handlers) maybeRefOkResponse(ref *esmodels.Ref) middleware.Responder {
 		return operations.NewGetRepositoryRepositoryRefRefDefault(500)
 	}
 
+	pkgs, status := h.getPackages(esr, ref)
+	if status != 0 {
+		return operations.NewGetRepositoryRepositoryRefRefDefault(status)
+	}
+
 	return operations.NewGetRepositoryRepositoryRefRefOK().WithPayload(
 		&models.Ref{
 			IsDefaultBranch: ref.IsDefaultBranch,
 			LastSeenCommit:  *lsc,
 			LastUpdated:     *lu,
 			Name:            ref.Name,
-			Packages:        packages(ref.Packages),
+			Packages:        packages(pkgs),
 			RefType:         ref.RefType,
 		},
 	)
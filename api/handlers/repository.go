@@ -11,6 +11,9 @@ import (
 
 func (h *handlers) GetRepository(params operations.GetRepositoryRepositoryParams) middleware.Responder {
 	esr, status := h.getRepo(params.Repository)
+	if status == 301 {
+		return moved(params.HTTPRequest, params.Repository, esr.ID)
+	}
 	if status != 0 {
 		return operations.NewGetRepositoryRepositoryDefault(status)
 	}
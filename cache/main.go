@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/autarch/metagodoc/env"
+	"github.com/autarch/metagodoc/indexer/clonecache"
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/logger"
+)
+
+func main() {
+	prune := flag.Bool("prune", false, "remove the least recently used clones and parse cache entries until the caches are within their limits")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-prune]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Reports how much space each clone under METAGODOC_ROOT uses, from the")
+		fmt.Fprintln(os.Stderr, "least to the most recently used. The limits come from the")
+		fmt.Fprintln(os.Stderr, "METAGODOC_CLONE_CACHE_MAX_BYTES and METAGODOC_CLONE_CACHE_MAX_REPOS")
+		fmt.Fprintln(os.Stderr, "environment variables. Pruning also removes the parse cache entries")
+		fmt.Fprintln(os.Stderr, "made by older versions of the indexer and, if")
+		fmt.Fprintln(os.Stderr, "METAGODOC_PARSE_CACHE_MAX_BYTES is set, the least recently used entries.")
+		fmt.Fprintln(os.Stderr, "")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	l, err := logger.New(logger.NewParams{IsProd: env.IsProd()})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Sync()
+
+	limits := clonecache.Limits{
+		MaxBytes: env.CloneCacheMaxBytes(),
+		MaxRepos: env.CloneCacheMaxRepos(),
+	}
+	c := clonecache.New(l, env.Root(), clonecache.FullClone, limits, env.GitTimeout())
+
+	if *prune {
+		if limits.MaxBytes <= 0 && limits.MaxRepos <= 0 {
+			fmt.Println("The clone cache has no limits, so no clones were removed")
+		} else {
+			removed, err := c.Prune()
+			if err != nil {
+				log.Fatalf("Error pruning the clone cache: %s", err)
+			}
+			var freed int64
+			for _, r := range removed {
+				freed += r.Bytes
+			}
+			fmt.Printf("Removed %d clones and freed %s\n", len(removed), humanBytes(freed))
+		}
+
+		pc, err := parsecache.New(l, env.Root(), env.ParseCacheMaxBytes())
+		if err != nil {
+			log.Fatalf("Error opening the parse cache: %s", err)
+		}
+		pruned, err := pc.Prune()
+		if err != nil {
+			log.Fatalf("Error pruning the parse cache: %s", err)
+		}
+		fmt.Printf("Removed %d parse cache entries and %d old builders and freed %s\n\n", pruned.Entries, pruned.Builders, humanBytes(pruned.Bytes))
+	}
+
+	clones, err := c.List()
+	if err != nil {
+		log.Fatalf("Error listing the clone cache: %s", err)
+	}
+
+	var total int64
+	for _, cl := range clones {
+		total += cl.Bytes
+		fmt.Printf("%10s\tlast used %s\t%s\n", humanBytes(cl.Bytes), cl.LastUsed.Format("2006-01-02 15:04:05"), cl.ID)
+	}
+	fmt.Printf("%10s\ttotal for %d clones\n", humanBytes(total), len(clones))
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
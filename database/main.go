@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/autarch/metagodoc/esmodels"
-	"github.com/autarch/metagodoc/indexer/repository"
 	"github.com/olivere/elastic"
 )
 
@@ -38,8 +37,13 @@ func New(trace bool) database {
 
 func (d database) makeIndices() {
 	mappings := []*esmodels.Mapping{
-		esmodels.MappingForType(repository.ESRepository{}),
+		esmodels.MappingForType(esmodels.Repository{}),
+		esmodels.MappingForType(esmodels.ESPackage{}),
 		esmodels.MappingForType(esmodels.Author{}),
+		esmodels.MappingForType(esmodels.CrawlState{}),
+		esmodels.MappingForType(esmodels.CrawlError{}),
+		esmodels.MappingForType(esmodels.DeadLetter{}),
+		esmodels.MappingForType(esmodels.Tombstone{}),
 	}
 	for _, m := range mappings {
 		idx := d.makeIndex(m.Name)
@@ -376,6 +376,11 @@ type Package struct {
 	// The import path for this package.
 	ImportPath string
 
+	// The import path from the package's import comment, if it has one.
+	// This is always the same as ImportPath, since NewPackage returns an
+	// error when they differ.
+	ImportComment string
+
 	// Errors found when fetching or parsing this package.
 	Errors []string
 
@@ -423,6 +428,12 @@ type Package struct {
 	XTestImports []string
 }
 
+// BuilderVersion must be incremented whenever a change to this package
+// changes what NewPackage returns for the same files. It is part of the key
+// for cached packages, so incrementing it means that every package is parsed
+// again.
+const BuilderVersion = 2
+
 var goEnvs = []struct{ GOOS, GOARCH string }{
 	{"linux", "amd64"},
 	{"darwin", "amd64"},
@@ -454,6 +465,24 @@ func SetDefaultGOOS(goos string) {
 	goEnvs[0], goEnvs[i] = goEnvs[i], goEnvs[0]
 }
 
+// Environment describes everything outside of a package's files that affects
+// the package NewPackage builds. That's each GOOS/GOARCH pair we try and the
+// release tags of the Go we were built with.
+func Environment() string {
+	var envs []string
+	for _, env := range goEnvs {
+		envs = append(envs, env.GOOS+"/"+env.GOARCH)
+	}
+	return strings.Join(envs, ",") + " " + strings.Join(build.Default.ReleaseTags, ",")
+}
+
+// ImportPathMatters reports whether NewPackage treats the package at this
+// import path specially. Other than this, the only thing the import path
+// affects is the ImportPath field and whether the import comment matches.
+func ImportPathMatters(importPath string) bool {
+	return importPath == "builtin" || windowsOnlyPackages[importPath]
+}
+
 var windowsOnlyPackages = map[string]bool{
 	"internal/syscall/windows":                     true,
 	"internal/syscall/windows/registry":            true,
@@ -586,6 +615,7 @@ func NewPackage(dir *directory.Directory) (*Package, error) {
 
 	pkg.Examples = b.getExamples("")
 	pkg.IsCmd = bpkg.IsCommand()
+	pkg.ImportComment = bpkg.ImportComment
 	pkg.GOOS = ctxt.GOOS
 	pkg.GOARCH = ctxt.GOARCH
 
@@ -1,11 +1,209 @@
 package env
 
-import "os"
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func GitHubToken() string {
 	return os.Getenv("METAGODOC_GITHUB_TOKEN")
 }
 
+// GitHubSearch returns which GitHub searches to run, separated by commas.
+// "created" goes through every Go repository in the order they were created
+// and "pushed" looks for the ones that were pushed to recently. If it is not
+// set we run both.
+func GitHubSearch() string {
+	return os.Getenv("METAGODOC_GITHUB_SEARCH")
+}
+
+// WebhookAddr returns the address to listen on for GitHub webhooks, like
+// ":8081". If it is not set we don't listen for webhooks.
+func WebhookAddr() string {
+	return os.Getenv("METAGODOC_WEBHOOK_ADDR")
+}
+
+// WebhookSecret returns the secret that GitHub webhooks are signed with.
+// This must be set if WebhookAddr is.
+func WebhookSecret() string {
+	return os.Getenv("METAGODOC_WEBHOOK_SECRET")
+}
+
+// GitRemotes returns the clone URLs of the plain git repositories that the
+// git crawler should index, separated by whitespace.
+func GitRemotes() []string {
+	return strings.Fields(os.Getenv("METAGODOC_GIT_REMOTES"))
+}
+
+// GoProxy returns the URL of the module proxy to crawl, like
+// https://proxy.golang.org. It can be any proxy that speaks the GOPROXY
+// protocol, including a file:// URL. If this is not set, or is "off", the
+// proxy crawler is disabled.
+func GoProxy() string {
+	p := os.Getenv("METAGODOC_GOPROXY")
+	if p == "off" {
+		return ""
+	}
+	return p
+}
+
+// GoProxyIndex returns the URL of the index feed that lists new module
+// versions, like https://index.golang.org/index. The proxy crawler reads the
+// feed from its beginning the first time it runs, which for
+// index.golang.org is every public module. If this is not set the proxy
+// crawler indexes every module in a file:// proxy, and for any other proxy
+// it only indexes the modules it's asked to.
+func GoProxyIndex() string {
+	return os.Getenv("METAGODOC_GOPROXY_INDEX")
+}
+
+// GoPaths returns the GOPATH trees that the local crawler should index. This
+// uses the same list separator as GOPATH. If this is not set then the local
+// crawler is disabled.
+func GoPaths() []string {
+	gp := os.Getenv("METAGODOC_GOPATH")
+	if gp == "" {
+		return nil
+	}
+	return filepath.SplitList(gp)
+}
+
+// IndexWorkers returns the number of repositories to index at once. This
+// defaults to 4.
+func IndexWorkers() int {
+	return intFromEnv("METAGODOC_INDEX_WORKERS", 4)
+}
+
+// ClonesPerHost returns the number of repositories from a single host, like
+// github.com, to clone and index at once. This defaults to 2.
+func ClonesPerHost() int {
+	return intFromEnv("METAGODOC_CLONES_PER_HOST", 2)
+}
+
+// IndexQueueSize returns the number of repositories that can be waiting for
+// an index worker before the crawlers have to wait. This defaults to 100.
+func IndexQueueSize() int {
+	return intFromEnv("METAGODOC_INDEX_QUEUE_SIZE", 100)
+}
+
+// IndexRetries returns the number of times to retry a repository that fails
+// to index before giving up on it. This defaults to 5. Setting it to 0 turns
+// retries off, so a repository goes straight to the dead letter index the
+// first time it fails.
+func IndexRetries() int {
+	n, err := strconv.Atoi(os.Getenv("METAGODOC_INDEX_RETRIES"))
+	if err != nil || n < 0 {
+		return 5
+	}
+	return n
+}
+
+// SkipListFile returns the path to the file listing repositories that should
+// never be indexed. If this is empty the indexer uses a built-in list.
+func SkipListFile() string {
+	return os.Getenv("METAGODOC_SKIP_LIST")
+}
+
+// TagRetention returns the policy that decides which version tags are
+// indexed. This is one of "all", "latest-patch", or "latest-minor". If it is
+// not set we index every tag.
+func TagRetention() string {
+	return os.Getenv("METAGODOC_TAG_RETENTION")
+}
+
+// CloneMode returns how the indexer clones a repository it hasn't seen
+// before. This is one of "full", "shallow", or "blobless". If it is not set
+// we make full clones.
+func CloneMode() string {
+	return os.Getenv("METAGODOC_CLONE_MODE")
+}
+
+// CloneCacheMaxBytes returns the most disk space that the clones under
+// Root() may use. This can have a K, M, G, or T suffix, like "50G". If it is
+// not set there is no limit.
+func CloneCacheMaxBytes() int64 {
+	return bytesFromEnv("METAGODOC_CLONE_CACHE_MAX_BYTES")
+}
+
+// GitTimeout returns how long a single clone or fetch may run before we give
+// up on it, like "90m". This defaults to an hour. A big repository like
+// aws/aws-sdk-go can take several minutes to clone.
+func GitTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("METAGODOC_GIT_TIMEOUT"))
+	if err != nil || d <= 0 {
+		return time.Hour
+	}
+	return d
+}
+
+// ParseCacheMaxBytes returns the most disk space that the parse cache under
+// Root() may use, like "10G". If it is not set there is no limit, but the
+// entries from older versions of the indexer are still removed.
+func ParseCacheMaxBytes() int64 {
+	return bytesFromEnv("METAGODOC_PARSE_CACHE_MAX_BYTES")
+}
+
+// CloneCacheMaxRepos returns the most clones to keep under Root(). If it is
+// not set there is no limit.
+func CloneCacheMaxRepos() int {
+	return intFromEnv("METAGODOC_CLONE_CACHE_MAX_REPOS", 0)
+}
+
+// SeedFile returns the path to a file listing repositories to index. This
+// can be a plain list of URLs or import paths, a go.mod file, a Gopkg.lock
+// file, or a markdown list of links like awesome-go. If it is "-" the list
+// is read from stdin. If it is not set the seed crawler is disabled.
+func SeedFile() string {
+	return os.Getenv("METAGODOC_SEED_FILE")
+}
+
+// SpiderDepth returns how many levels of imports the dependency spider
+// follows from the repositories found by the other crawlers. If it is not set
+// the spider is disabled.
+func SpiderDepth() int {
+	return intFromEnv("METAGODOC_SPIDER_DEPTH", 0)
+}
+
+// SpiderAllow returns the import path prefixes that the dependency spider
+// may follow, like "github.com" or "go.example.com/ourteam", separated by
+// whitespace. If it is not set the spider follows every import.
+func SpiderAllow() []string {
+	return strings.Fields(os.Getenv("METAGODOC_SPIDER_ALLOW"))
+}
+
+// bytesFromEnv returns 0 if the variable is not set or is not a positive
+// size.
+func bytesFromEnv(name string) int64 {
+	v := strings.ToUpper(strings.TrimSpace(os.Getenv(name)))
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(v, suffix) {
+			v = strings.TrimSuffix(v, suffix)
+			mult = int64(1) << (10 * uint(i+1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n * mult
+}
+
+// intFromEnv returns the default if the variable is not set or is not a
+// positive integer.
+func intFromEnv(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
+
 func Root() string {
 	root := os.Getenv("METAGODOC_ROOT")
 	if root != "" {
@@ -0,0 +1,13 @@
+package esmodels
+
+// CrawlError records a repository that could not be indexed. The Ref is empty
+// if the failure wasn't specific to a ref. The Stage says what the indexer
+// was doing, like "clone", "checkout", or "parse".
+type CrawlError struct {
+	Repository string `json:"repository" esType:"keyword"`
+	Crawler    string `json:"crawler" esType:"keyword"`
+	Ref        string `json:"ref,omitempty" esType:"keyword"`
+	Stage      string `json:"stage" esType:"keyword"`
+	Error      string `json:"error" esType:"text"`
+	Timestamp  string `json:"timestamp" esType:"date"`
+}
@@ -0,0 +1,21 @@
+package esmodels
+
+// CrawlState is what the indexer saves so that it can pick up where it left
+// off after a restart. There are two kinds of documents. A "crawler" document
+// holds a crawler's cursor and when it should next wake up. A "repository"
+// document records the last time a repository was successfully crawled.
+type CrawlState struct {
+	Kind        CrawlStateKind `json:"kind" esType:"keyword"`
+	Crawler     string         `json:"crawler" esType:"keyword"`
+	Repository  string         `json:"repository,omitempty" esType:"keyword"`
+	Cursor      string         `json:"cursor,omitempty" esType:"keyword"`
+	SleepUntil  string         `json:"sleep_until,omitempty" esType:"date"`
+	LastCrawled string         `json:"last_crawled,omitempty" esType:"date"`
+}
+
+type CrawlStateKind string
+
+const (
+	CrawlerState    CrawlStateKind = "crawler"
+	RepositoryState CrawlStateKind = "repository"
+)
@@ -0,0 +1,16 @@
+package esmodels
+
+// DeadLetter is a repository that failed to index every time we retried it.
+// We stop retrying it until an operator requeues it. The ID of the document
+// is the repository ID. The URL is what we crawl when it is requeued.
+// Dead letters saved before we recorded it don't have one.
+type DeadLetter struct {
+	Repository  string `json:"repository" esType:"keyword"`
+	URL         string `json:"url" esType:"keyword"`
+	Crawler     string `json:"crawler" esType:"keyword"`
+	Attempts    int    `json:"attempts" esType:"long"`
+	Stage       string `json:"stage" esType:"keyword"`
+	Error       string `json:"error" esType:"text"`
+	FirstFailed string `json:"first_failed" esType:"date"`
+	LastFailed  string `json:"last_failed" esType:"date"`
+}
@@ -6,12 +6,11 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestMappings(t *testing.T) {
-	mappings := Mappings()
-
+func TestMappingForType(t *testing.T) {
 	repository := &Mapping{
 		"repository",
 		Properties{
+			"id":        Field{ESType: "keyword"},
 			"name":      Field{ESType: "keyword"},
 			"full_name": Field{ESType: "keyword"},
 			"description": Field{
@@ -21,7 +20,7 @@ func TestMappings(t *testing.T) {
 			"vcs":         Field{ESType: "keyword"},
 			"primary_url": Field{ESType: "keyword"},
 			"issues": Field{
-				ESType: "nested",
+				ESType: "object",
 				Properties: Properties{
 					"url":    Field{ESType: "keyword"},
 					"open":   Field{ESType: "long"},
@@ -29,7 +28,7 @@ func TestMappings(t *testing.T) {
 				},
 			},
 			"pull_requests": Field{
-				ESType: "nested",
+				ESType: "object",
 				Properties: Properties{
 					"url":    Field{ESType: "keyword"},
 					"open":   Field{ESType: "long"},
@@ -45,7 +44,7 @@ func TestMappings(t *testing.T) {
 			"is_fork":      Field{ESType: "boolean"},
 			"status":       Field{ESType: "keyword"},
 			"about": Field{
-				ESType: "nested",
+				ESType: "object",
 				Properties: Properties{
 					"content": Field{
 						ESType:   "text",
@@ -53,38 +52,73 @@ func TestMappings(t *testing.T) {
 					},
 					"content_type": Field{ESType: "keyword"}},
 			},
+			"canonical_import_paths": Field{ESType: "keyword"},
+			"lower_id":               Field{ESType: "keyword"},
+			"forge_id":               Field{ESType: "keyword"},
+			"aliases":                Field{ESType: "keyword"},
 			"refs": Field{
 				ESType: "nested",
 				Properties: Properties{
-					"name":              Field{ESType: "keyword"},
-					"is_default_branch": Field{ESType: "boolean"},
-					"ref_type":          Field{ESType: "keyword"},
-					"last_seen_commit":  Field{ESType: "keyword"},
-					"last_updated":      Field{ESType: "date"},
-					"packages": Field{
+					"name":                  Field{ESType: "keyword"},
+					"is_default_branch":     Field{ESType: "boolean"},
+					"ref_type":              Field{ESType: "keyword"},
+					"last_seen_commit":      Field{ESType: "keyword"},
+					"last_updated":          Field{ESType: "date"},
+					"canonical_import_path": Field{ESType: "keyword"},
+					"modules": Field{
 						ESType: "nested",
 						Properties: Properties{
-							"name":        Field{ESType: "keyword"},
-							"import_path": Field{ESType: "keyword"},
-							"synopsis": Field{
+							"path":       Field{ESType: "keyword"},
+							"dir":        Field{ESType: "keyword"},
+							"go_version": Field{ESType: "keyword"},
+							"deprecated": Field{
 								ESType:   "text",
 								Analyzer: "english",
 							},
-							"errors":         Field{ESType: "keyword"},
-							"is_command":     Field{ESType: "boolean"},
-							"files":          Field{ESType: "keyword"},
-							"test_files":     Field{ESType: "keyword"},
-							"x_test_files":   Field{ESType: "keyword"},
-							"imports":        Field{ESType: "keyword"},
-							"test_imports":   Field{ESType: "keyword"},
-							"x_test_imports": Field{ESType: "keyword"},
+							"requires": Field{
+								ESType: "nested",
+								Properties: Properties{
+									"path":     Field{ESType: "keyword"},
+									"version":  Field{ESType: "keyword"},
+									"indirect": Field{ESType: "boolean"},
+								},
+							},
+							"replaces": Field{
+								ESType: "nested",
+								Properties: Properties{
+									"old_path":    Field{ESType: "keyword"},
+									"old_version": Field{ESType: "keyword"},
+									"new_path":    Field{ESType: "keyword"},
+									"new_version": Field{ESType: "keyword"},
+								},
+							},
+							"excludes": Field{
+								ESType: "nested",
+								Properties: Properties{
+									"path":    Field{ESType: "keyword"},
+									"version": Field{ESType: "keyword"},
+								},
+							},
+							"retracts": Field{
+								ESType: "nested",
+								Properties: Properties{
+									"low":  Field{ESType: "keyword"},
+									"high": Field{ESType: "keyword"},
+									"rationale": Field{
+										ESType:   "text",
+										Analyzer: "english",
+									},
+								},
+							},
 						},
 					},
+					"package_count": Field{ESType: "long"},
+					"generation":    Field{ESType: "keyword"},
 				},
 			},
 		},
 	}
-	assert.Equal(t, repository, mappings[0], "repository mapping is correct")
+	assert.Equal(t, repository, MappingForType(Repository{}), "repository mapping is correct")
 
 	author := &Mapping{
 		"author",
@@ -96,5 +130,20 @@ func TestMappings(t *testing.T) {
 			"repositories": Field{ESType: "keyword"},
 		},
 	}
-	assert.Equal(t, author, mappings[1], "author mapping is correct")
+	assert.Equal(t, author, MappingForType(Author{}), "author mapping is correct")
+
+	deadLetter := &Mapping{
+		"dead_letter",
+		Properties{
+			"repository":   Field{ESType: "keyword"},
+			"url":          Field{ESType: "keyword"},
+			"crawler":      Field{ESType: "keyword"},
+			"attempts":     Field{ESType: "long"},
+			"stage":        Field{ESType: "keyword"},
+			"error":        Field{ESType: "text"},
+			"first_failed": Field{ESType: "date"},
+			"last_failed":  Field{ESType: "date"},
+		},
+	}
+	assert.Equal(t, deadLetter, MappingForType(DeadLetter{}), "dead letter mapping is correct")
 }
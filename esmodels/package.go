@@ -0,0 +1,24 @@
+package esmodels
+
+// ESPackage is one package at one ref of a repository. Packages are stored in
+// their own index rather than in the repository document, so a repository
+// with thousands of packages and refs never has to be held in memory or sent
+// to Elasticsearch all at once. The ID of the document comes from PackageID.
+type ESPackage struct {
+	Repository string `json:"repository" esType:"keyword"`
+	Ref        string `json:"ref" esType:"keyword"`
+	// The crawl that stored the package. This matches the Generation of the
+	// ref in the repository document. Packages from any other generation
+	// are left over from an earlier or failed crawl.
+	Generation string `json:"generation" esType:"keyword"`
+	// The directory containing the package, relative to the repository
+	// root. This is "." for the root.
+	Dir     string   `json:"dir" esType:"keyword"`
+	Package *Package `json:"package"`
+}
+
+// PackageID returns the document ID for the package in a directory at one
+// generation of a ref.
+func PackageID(repository, ref, generation, dir string) string {
+	return repository + "@" + ref + "@" + generation + "/" + dir
+}
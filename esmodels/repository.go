@@ -35,6 +35,9 @@ func (vt VCSType) String() string {
 }
 
 type Repository struct {
+	// The ID the document is stored under, like
+	// "github.com/stretchr/testify".
+	ID           string         `json:"id" esType:"keyword"`
 	Name         string         `json:"name" esType:"keyword"`
 	FullName     string         `json:"full_name" esType:"keyword"`
 	Description  string         `json:"description" esType:"text" esAnalyzer:"english"`
@@ -50,8 +53,22 @@ type Repository struct {
 	Forks        int            `json:"forks" esType:"long"`
 	IsFork       bool           `json:"is_fork" esType:"boolean"`
 	Status       ActivityStatus `json:"status" esType:"keyword"`
-	About        *About         `json:"about""`
+	About        *About         `json:"about"`
 	Refs         []*Ref         `json:"refs"`
+	// The vanity import paths for the repository root, like
+	// "gopkg.in/yaml.v2", if any of its refs have one.
+	CanonicalImportPaths []string `json:"canonical_import_paths" esType:"keyword"`
+	// The ID in lower case. GitHub ignores case, so we do too when looking
+	// a repository up.
+	LowerID string `json:"lower_id" esType:"keyword"`
+	// The forge's own ID for the repository, like "github:23096959". This
+	// stays the same when a repository is renamed or transferred. It is
+	// empty if the forge doesn't have one.
+	ForgeID string `json:"forge_id" esType:"keyword"`
+	// The IDs the repository used to have before it was renamed or
+	// transferred, in lower case. Looking up one of these redirects to the
+	// repository's current ID.
+	Aliases []string `json:"aliases" esType:"keyword"`
 }
 
 type Tickets struct {
@@ -72,6 +89,7 @@ type Package struct {
 	Synopsis     string                 `json:"synopsis" esType:"text" esAnalyzer:"english"`
 	Errors       []string               `json:"errors" esType:"keyword"`
 	IsCommand    bool                   `json:"is_command" esType:"boolean"`
+	IsInternal   bool                   `json:"is_internal" esType:"boolean"`
 	Files        []*doc.File            `json:"files"`
 	TestFiles    []*doc.File            `json:"test_files"`
 	Imports      []string               `json:"imports" esType:"keyword"`
@@ -86,10 +104,56 @@ type Package struct {
 }
 
 type Ref struct {
-	Name            string     `json:"name" esType:"keyword"`
-	IsDefaultBranch bool       `json:"is_head" esType:"boolean"`
-	RefType         string     `json:"ref_type" esType:"keyword"`
-	LastSeenCommit  string     `json:"last_seen_commit" esType:"keyword"`
-	LastUpdated     string     `json:"last_updated" esType:"date"`
-	Packages        []*Package `json:"packages"`
+	Name            string `json:"name" esType:"keyword"`
+	IsDefaultBranch bool   `json:"is_head" esType:"boolean"`
+	RefType         string `json:"ref_type" esType:"keyword"`
+	LastSeenCommit  string `json:"last_seen_commit" esType:"keyword"`
+	LastUpdated     string `json:"last_updated" esType:"date"`
+	// The vanity import path for the repository root at this ref, if it
+	// has one. Every package's import path starts with this.
+	CanonicalImportPath string    `json:"canonical_import_path" esType:"keyword"`
+	Modules             []*Module `json:"modules"`
+	// The packages are stored in their own index. See ESPackage.
+	PackageCount int `json:"package_count" esType:"long"`
+	// Identifies the crawl that stored this ref's packages.
+	Generation string `json:"generation" esType:"keyword"`
+}
+
+// Module is the metadata from a go.mod file. A ref can contain more than one
+// module if there are go.mod files in subdirectories.
+type Module struct {
+	Path string `json:"path" esType:"keyword"`
+	// The directory containing the go.mod file, relative to the repository
+	// root. This is empty for the root.
+	Dir        string           `json:"dir" esType:"keyword"`
+	GoVersion  string           `json:"go_version" esType:"keyword"`
+	Deprecated string           `json:"deprecated" esType:"text" esAnalyzer:"english"`
+	Requires   []*ModuleRequire `json:"requires"`
+	Replaces   []*ModuleReplace `json:"replaces"`
+	Excludes   []*ModuleVersion `json:"excludes"`
+	Retracts   []*ModuleRetract `json:"retracts"`
+}
+
+type ModuleVersion struct {
+	Path    string `json:"path" esType:"keyword"`
+	Version string `json:"version" esType:"keyword"`
+}
+
+type ModuleRequire struct {
+	Path     string `json:"path" esType:"keyword"`
+	Version  string `json:"version" esType:"keyword"`
+	Indirect bool   `json:"indirect" esType:"boolean"`
+}
+
+type ModuleReplace struct {
+	OldPath    string `json:"old_path" esType:"keyword"`
+	OldVersion string `json:"old_version" esType:"keyword"`
+	NewPath    string `json:"new_path" esType:"keyword"`
+	NewVersion string `json:"new_version" esType:"keyword"`
+}
+
+type ModuleRetract struct {
+	Low       string `json:"low" esType:"keyword"`
+	High      string `json:"high" esType:"keyword"`
+	Rationale string `json:"rationale" esType:"text" esAnalyzer:"english"`
 }
@@ -0,0 +1,11 @@
+package esmodels
+
+// Tombstone is left behind when a repository is deleted upstream, or can no
+// longer be cloned, so that looking it up says it is gone rather than that
+// we never heard of it. The repository's document and packages are deleted.
+// The ID of the document is the repository ID in lower case.
+type Tombstone struct {
+	Repository string `json:"repository" esType:"keyword"`
+	Reason     string `json:"reason" esType:"text"`
+	Removed    string `json:"removed" esType:"date"`
+}
@@ -0,0 +1,395 @@
+// Package clonecache manages the git clones that the indexer keeps under
+// <root>/repos. Each clone lives at <root>/repos/<repository ID>. We record
+// when each clone was last used, and when the clones go over the configured
+// limits we delete the ones that have gone unused the longest. A clone that
+// is being indexed is never deleted, even by another process, such as the
+// cache command. Each clone has a lock file under <root>/clone-locks that is
+// locked with flock(2). Using a clone takes a shared lock and deleting it
+// takes an exclusive lock.
+package clonecache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"code.gitea.io/git"
+	"github.com/hashicorp/errwrap"
+)
+
+// Mode is how we clone a repository the first time we see it. After that we
+// only ever fetch.
+type Mode string
+
+const (
+	// A normal clone with every commit and file.
+	FullClone Mode = "full"
+	// Only the commit at the tip of each branch. Tags are fetched with
+	// their commits later. This is the smallest clone, but the repository's
+	// creation date will be the date of the oldest commit we have.
+	ShallowClone Mode = "shallow"
+	// Every commit and tree, but files are only downloaded when we read
+	// them. This needs a git host that supports partial clones.
+	BloblessClone Mode = "blobless"
+)
+
+// ParseMode turns a string like "shallow" into a Mode. An empty string means
+// FullClone.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return FullClone, nil
+	case FullClone, ShallowClone, BloblessClone:
+		return m, nil
+	}
+	return "", fmt.Errorf("Unknown clone mode %q, expected one of %s, %s, or %s", s, FullClone, ShallowClone, BloblessClone)
+}
+
+// Limits for the whole cache. A zero value means there is no limit.
+type Limits struct {
+	MaxBytes int64
+	MaxRepos int
+}
+
+// Clone is a clone in the cache.
+type Clone struct {
+	ID       string
+	Dir      string
+	Bytes    int64
+	LastUsed time.Time
+	InUse    bool
+}
+
+// We touch this file in a clone's .git directory whenever we're done with
+// it.
+const lastUsedFile = "metagodoc-last-used"
+
+// How often we check whether the cache is over its limits. Working out how
+// much space the clones use means walking every file in them, so we don't
+// want to do this after every repository.
+const pruneInterval = 10 * time.Minute
+
+// The timeout New uses if it's given zero.
+const DefaultTimeout = time.Hour
+
+// The suffix of the directory that a repository is cloned into before it is
+// renamed into place.
+const tmpSuffix = ".tmp"
+
+// Cache is safe to use from multiple goroutines.
+type Cache struct {
+	l       *logger.Logger
+	root    string
+	locks   string
+	mode    Mode
+	limits  Limits
+	timeout time.Duration
+
+	pruning   bool
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// New returns a cache for the clones under <cacheRoot>/repos. The timeout is
+// how long a single clone may run. We can't leave this to the git package,
+// since its default of 60 seconds is far too short for big repositories.
+func New(l *logger.Logger, cacheRoot string, mode Mode, limits Limits, timeout time.Duration) *Cache {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &Cache{
+		l:       l,
+		root:    filepath.Join(cacheRoot, "repos"),
+		locks:   filepath.Join(cacheRoot, "clone-locks"),
+		mode:    mode,
+		limits:  limits,
+		timeout: timeout,
+		// We don't want to walk a big cache as soon as we start up.
+		lastPrune: time.Now(),
+	}
+}
+
+// Dir returns the directory for the clone of a repository. The directory may
+// not exist yet.
+func (c *Cache) Dir(id string) string {
+	return filepath.Join(c.root, filepath.FromSlash(id))
+}
+
+// Timeout returns how long a single git command that talks to a remote, like
+// a clone or fetch, may run.
+func (c *Cache) Timeout() time.Duration {
+	return c.timeout
+}
+
+// Clone clones a repository into its directory using the cache's mode.
+func (c *Cache) Clone(cloneURL, id string) error {
+	dir := c.Dir(id)
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+
+	// We clone to a temporary directory and then rename it so that a clone
+	// that fails or times out part way through doesn't leave a broken
+	// repository behind that we'd later try to fetch into.
+	tmp := dir + tmpSuffix
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+
+	cmd := git.NewCommand("clone", "--quiet")
+	switch c.mode {
+	case ShallowClone:
+		cmd.AddArguments("--depth", "1", "--no-single-branch")
+	case BloblessClone:
+		cmd.AddArguments("--filter=blob:none")
+	}
+	cmd.AddArguments(cloneURL, tmp)
+
+	_, err = cmd.RunTimeout(c.timeout)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return errwrap.Wrapf(fmt.Sprintf("Could not make a %s clone of %s: {{err}}", c.mode, cloneURL), err)
+	}
+
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return errwrap.Wrapf(fmt.Sprintf("Could not move the clone of %s into place: {{err}}", cloneURL), err)
+	}
+	return nil
+}
+
+// Acquire marks a clone as in use so that it won't be deleted. If the clone
+// is being deleted this waits until it's gone. Call the returned func when
+// you're done with it. That records the time the clone was last used and may
+// prune the cache.
+func (c *Cache) Acquire(id string) func() {
+	unlock, err := c.lock(id, syscall.LOCK_SH)
+	if err != nil {
+		c.l.Errorf("Could not lock the clone of %s, it may be pruned while it is in use: %s", id, err)
+		unlock = func() {}
+	}
+
+	return func() {
+		c.touch(id)
+		unlock()
+
+		go c.maybePrune()
+	}
+}
+
+// lock takes a flock on the clone's lock file and returns a func that
+// releases it. The lock files are never deleted. If we deleted one while
+// another process was waiting for it, that process would end up with a lock
+// that nobody else can see.
+func (c *Cache) lock(id string, how int) (func(), error) {
+	p := filepath.Join(c.locks, filepath.FromSlash(id)+".lock")
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
+
+func (c *Cache) touch(id string) {
+	gitDir := filepath.Join(c.Dir(id), ".git")
+	if _, err := os.Stat(gitDir); err != nil {
+		return
+	}
+
+	p := filepath.Join(gitDir, lastUsedFile)
+	now := time.Now()
+	err := os.Chtimes(p, now, now)
+	if os.IsNotExist(err) {
+		err = ioutil.WriteFile(p, nil, 0644)
+	}
+	if err != nil {
+		c.l.Infof("  could not record when %s was last used: %s", id, err)
+	}
+}
+
+// List returns every clone in the cache, from the least to the most recently
+// used.
+func (c *Cache) List() ([]*Clone, error) {
+	var clones []*Clone
+	err := filepath.Walk(c.root, func(p string, info os.FileInfo, err error) error {
+		// The root may not exist yet, and a clone may be removed while
+		// we're walking it.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// A clone that is still being made isn't in the cache yet.
+		if strings.HasSuffix(p, tmpSuffix) {
+			return filepath.SkipDir
+		}
+
+		gitDir := filepath.Join(p, ".git")
+		gi, err := os.Stat(gitDir)
+		if err != nil || !gi.IsDir() {
+			return nil
+		}
+
+		id, err := filepath.Rel(c.root, p)
+		if err != nil {
+			return err
+		}
+		clone := &Clone{ID: filepath.ToSlash(id), Dir: p, LastUsed: gi.ModTime()}
+		if lu, err := os.Stat(filepath.Join(gitDir, lastUsedFile)); err == nil {
+			clone.LastUsed = lu.ModTime()
+		}
+		clone.Bytes, err = dirSize(p)
+		if err != nil {
+			return err
+		}
+		clones = append(clones, clone)
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not list the clones in %s: {{err}}", c.root), err)
+	}
+
+	for _, clone := range clones {
+		unlock, err := c.lock(clone.ID, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			clone.InUse = true
+			continue
+		}
+		unlock()
+	}
+
+	sort.SliceStable(clones, func(i, j int) bool { return clones[i].LastUsed.Before(clones[j].LastUsed) })
+	return clones, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		// Git may remove temporary files while we walk the clone.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Prune deletes the least recently used clones until the cache is within
+// its limits. Clones that are in use are never deleted, so the cache can
+// still be over its limits afterwards. It returns the clones it deleted.
+func (c *Cache) Prune() ([]*Clone, error) {
+	clones, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, clone := range clones {
+		total += clone.Bytes
+	}
+	count := len(clones)
+
+	var removed []*Clone
+	for _, clone := range clones {
+		if !c.over(total, count) {
+			break
+		}
+		// We hold an exclusive lock on the clone while we delete it, so
+		// nothing can start using it until it's gone. If anything is using
+		// it we can't get the lock.
+		unlock, err := c.lock(clone.ID, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			continue
+		}
+		if err != nil {
+			return removed, errwrap.Wrapf(fmt.Sprintf("Could not lock the clone of %s: {{err}}", clone.ID), err)
+		}
+		c.l.Infof("Removing the clone of %s, which was last used %s and takes %d bytes", clone.ID, clone.LastUsed.Format("2006-01-02 15:04:05"), clone.Bytes)
+		err = os.RemoveAll(clone.Dir)
+		unlock()
+		if err != nil {
+			return removed, errwrap.Wrapf(fmt.Sprintf("Could not remove %s: {{err}}", clone.Dir), err)
+		}
+		total -= clone.Bytes
+		count--
+		removed = append(removed, clone)
+	}
+
+	if c.over(total, count) {
+		c.l.Infof("The clone cache is still over its limits with %d clones using %d bytes", count, total)
+	}
+	return removed, nil
+}
+
+func (c *Cache) over(total int64, count int) bool {
+	return (c.limits.MaxBytes > 0 && total > c.limits.MaxBytes) ||
+		(c.limits.MaxRepos > 0 && count > c.limits.MaxRepos)
+}
+
+// maybePrune prunes the cache if it has limits and we haven't pruned it
+// recently. Only one prune runs at a time.
+func (c *Cache) maybePrune() {
+	if c.limits.MaxBytes <= 0 && c.limits.MaxRepos <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	due := !c.pruning && time.Since(c.lastPrune) >= pruneInterval
+	if due {
+		c.pruning = true
+	}
+	c.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	_, err := c.Prune()
+	if err != nil {
+		c.l.Errorf("Error pruning the clone cache: %s", err)
+	}
+
+	c.mutex.Lock()
+	c.pruning = false
+	c.lastPrune = time.Now()
+	c.mutex.Unlock()
+}
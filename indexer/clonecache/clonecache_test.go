@@ -0,0 +1,145 @@
+package clonecache
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"code.gitea.io/git"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrune(t *testing.T) {
+	root, err := ioutil.TempDir("", "clonecache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(l, root, FullClone, Limits{MaxRepos: 2}, time.Minute)
+
+	// Each fake clone is 100 bytes, and the first one is the least recently
+	// used.
+	ids := []string{"example.com/a/old", "example.com/b/middle", "example.com/c/new"}
+	for i, id := range ids {
+		gitDir := filepath.Join(c.Dir(id), ".git")
+		err := os.MkdirAll(gitDir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(gitDir, "data"), make([]byte, 100), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.touch(id)
+		used := time.Now().Add(time.Duration(i-len(ids)) * time.Hour)
+		err = os.Chtimes(filepath.Join(gitDir, lastUsedFile), used, used)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clones, err := c.List()
+	assert.Nil(t, err, "no error listing clones")
+	if assert.Len(t, clones, 3, "three clones") {
+		assert.Equal(t, ids[0], clones[0].ID, "least recently used first")
+		assert.Equal(t, int64(100), clones[0].Bytes, "size of a clone")
+	}
+
+	// The oldest clone is in use by another process, like the indexer when
+	// the cache command prunes the cache, so the middle one goes instead.
+	other := New(l, root, FullClone, Limits{}, time.Minute)
+	release := other.Acquire(ids[0])
+	clones, err = c.List()
+	assert.Nil(t, err, "no error listing clones")
+	if assert.Len(t, clones, 3, "three clones") {
+		assert.True(t, clones[0].InUse, "the clone the other process is using is in use")
+		assert.False(t, clones[1].InUse, "the other clones are not")
+	}
+	removed, err := c.Prune()
+	assert.Nil(t, err, "no error pruning")
+	if assert.Len(t, removed, 1, "one clone removed") {
+		assert.Equal(t, ids[1], removed[0].ID, "the unused clone was removed")
+	}
+	release()
+
+	c.limits = Limits{MaxBytes: 150}
+	removed, err = c.Prune()
+	assert.Nil(t, err, "no error pruning by size")
+	if assert.Len(t, removed, 1, "one clone removed") {
+		assert.Equal(t, ids[2], removed[0].ID, "the clone we released is now the most recently used")
+	}
+
+	clones, err = c.List()
+	assert.Nil(t, err, "no error listing clones")
+	if assert.Len(t, clones, 1, "one clone left") {
+		assert.Equal(t, ids[0], clones[0].ID, "the clone we used is left")
+	}
+}
+
+func TestCloneTimeout(t *testing.T) {
+	root, err := ioutil.TempDir("", "clonecache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := filepath.Join(root, "remote.git")
+	run(t, "git", "init", "--quiet", "--bare", remote)
+	tree := run(t, "git", "--git-dir", remote, "hash-object", "-w", "-t", "tree", os.DevNull)
+	commit := run(t, "git", "--git-dir", remote, "-c", "user.name=a", "-c", "user.email=a@b", "commit-tree", "-m", "first", strings.TrimSpace(tree))
+	run(t, "git", "--git-dir", remote, "update-ref", "refs/heads/master", strings.TrimSpace(commit))
+
+	// git's ext transport lets us make a remote that takes two seconds
+	// before it sends anything.
+	oldAllow := os.Getenv("GIT_ALLOW_PROTOCOL")
+	os.Setenv("GIT_ALLOW_PROTOCOL", "ext")
+	defer os.Setenv("GIT_ALLOW_PROTOCOL", oldAllow)
+	slow := "ext::sh -c sleep% 2;% exec% %S% " + strings.Replace(remote, " ", "% ", -1)
+
+	// A clone that takes longer than the git package's default timeout
+	// must still succeed. We shrink the default rather than wait a minute.
+	oldDefault := git.DefaultCommandExecutionTimeout
+	git.DefaultCommandExecutionTimeout = time.Second
+	defer func() { git.DefaultCommandExecutionTimeout = oldDefault }()
+
+	c := New(l, root, FullClone, Limits{}, time.Minute)
+	err = c.Clone(slow, "example.com/slow/ok")
+	assert.Nil(t, err, "a clone that takes longer than the git package's default timeout succeeds")
+	assert.True(t, isDir(filepath.Join(c.Dir("example.com/slow/ok"), ".git")), "the clone is in place")
+	assert.False(t, isDir(c.Dir("example.com/slow/ok")+tmpSuffix), "the temporary directory is gone")
+
+	c = New(l, root, FullClone, Limits{}, time.Second)
+	err = c.Clone(slow, "example.com/slow/timeout")
+	assert.NotNil(t, err, "a clone that takes longer than our timeout fails")
+	assert.False(t, isDir(c.Dir("example.com/slow/timeout")), "a failed clone leaves nothing behind")
+	assert.False(t, isDir(c.Dir("example.com/slow/timeout")+tmpSuffix), "a failed clone leaves no temporary directory behind")
+}
+
+func run(t *testing.T, name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		t.Fatalf("%s %s: %s", name, strings.Join(args, " "), err)
+	}
+	return string(out)
+}
+
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
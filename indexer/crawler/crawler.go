@@ -11,12 +11,27 @@ type Result struct {
 	Crawler    Crawler
 	Repository repository.Repository
 	Exhausted  bool
-	Error      error
+	// If the Repository is also set then the repository was found but could
+	// not be indexed, and the indexer will retry it.
+	Error error
+	// For a Resumable crawler this is where the crawler should pick up from
+	// if we restart after handling this result.
+	Cursor string
 }
 
 type Crawler interface {
 	Name() string
 	SleepDuration() time.Duration
 	CrawlAll(ch chan *Result)
+	// CanCrawl reports whether CrawlOne knows how to handle the given URL.
+	CanCrawl(*url.URL) bool
 	CrawlOne(*url.URL) (repository.Repository, error)
 }
+
+// Resumable is implemented by crawlers that keep track of where they are in
+// some larger listing, like a page number or a timestamp. The indexer saves
+// the cursor from each result and passes the last one saved to Resume when
+// it starts up.
+type Resumable interface {
+	Resume(cursor string) error
+}
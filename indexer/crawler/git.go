@@ -0,0 +1,89 @@
+package crawler
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/clonecache"
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/vanity"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// gitCrawler indexes repositories from plain git remotes. This works with
+// anything git can clone, including self-hosted forges like Gitea, cgit,
+// bare ssh remotes, and file:// URLs for bare repos on local disk.
+type gitCrawler struct {
+	l         *logger.Logger
+	clones    *clonecache.Cache
+	remotes   []string
+	resolver  *vanity.Resolver
+	retention repository.Retention
+	cache     *parsecache.Cache
+	ctx       context.Context
+}
+
+func NewGitCrawler(l *logger.Logger, clones *clonecache.Cache, remotes []string, resolver *vanity.Resolver, retention repository.Retention, cache *parsecache.Cache, ctx context.Context) (Crawler, error) {
+	return &gitCrawler{
+		l:         l,
+		clones:    clones,
+		remotes:   remotes,
+		resolver:  resolver,
+		retention: retention,
+		cache:     cache,
+		ctx:       ctx,
+	}, nil
+}
+
+func (g *gitCrawler) Name() string {
+	return "Git"
+}
+
+func (g *gitCrawler) SleepDuration() time.Duration {
+	return time.Duration(1) * time.Hour
+}
+
+// CrawlAll indexes every configured remote once and then reports that the
+// crawler is exhausted so that it is put to sleep until the next pass.
+func (g *gitCrawler) CrawlAll(ch chan *Result) {
+	for _, r := range g.remotes {
+		repo, err := g.newRepository(r)
+		if repo != nil || err != nil {
+			ch <- g.newResult(repo, err, false)
+		}
+	}
+
+	ch <- g.newResult(nil, nil, true)
+}
+
+func (g *gitCrawler) newResult(r repository.Repository, err error, ex bool) *Result {
+	return &Result{Crawler: g, Repository: r, Error: err, Exhausted: ex}
+}
+
+var gitSchemes = map[string]bool{
+	"git":     true,
+	"git+ssh": true,
+	"ssh":     true,
+	"file":    true,
+	"http":    true,
+	"https":   true,
+}
+
+func (g *gitCrawler) CanCrawl(u *url.URL) bool {
+	return gitSchemes[u.Scheme]
+}
+
+func (g *gitCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	return g.newRepository(u.String())
+}
+
+func (g *gitCrawler) newRepository(cloneURL string) (repository.Repository, error) {
+	repo, err := repository.NewGitRepository(g.l, cloneURL, g.clones, g.resolver, g.retention, g.cache, g.ctx)
+	// See githubCrawler.newRepository for why this check is needed.
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
@@ -3,11 +3,17 @@ package crawler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/autarch/metagodoc/indexer/clonecache"
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
 	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/vanity"
 	"github.com/autarch/metagodoc/logger"
 	"github.com/google/go-github/github"
 	"github.com/hashicorp/errwrap"
@@ -15,27 +21,50 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// githubCrawler searches GitHub one date window at a time. Each pass goes
+// through the windows in order from the start of the pass until the time the
+// pass started. See GitHubMode for where a pass starts.
 type githubCrawler struct {
-	l             *logger.Logger
-	cacheRoot     string
-	github        *github.Client
-	currentResult *github.RepositoriesSearchResult
-	currentIdx    int
-	nextPage      int
-	ctx           context.Context
+	l      *logger.Logger
+	mode   GitHubMode
+	clones *clonecache.Cache
+	github *github.Client
+	// The window we're searching and the page of it we'll get next. The
+	// next page is 0 once we've seen the last page of the window.
+	window   searchWindow
+	nextPage int
+	// The end of the current pass. This is zero if we're between passes.
+	until time.Time
+	// The page to start from if we're restarted. This is the page whose
+	// results we're currently sending.
+	resumePage int
+	limiter    *ratelimit.Limiter
+	resolver   *vanity.Resolver
+	retention  repository.Retention
+	cache      *parsecache.Cache
+	ctx        context.Context
 }
 
-func NewGitHubCrawler(l *logger.Logger, cacheRoot string, token string, ctx context.Context) (Crawler, error) {
+// errOutOfSearches is returned by getNextPage when we've used up our search
+// API calls.
+var errOutOfSearches = errors.New("Out of GitHub search API calls")
+
+func NewGitHubCrawler(l *logger.Logger, mode GitHubMode, clones *clonecache.Cache, token string, limiter *ratelimit.Limiter, resolver *vanity.Resolver, retention repository.Retention, cache *parsecache.Cache, ctx context.Context) (Crawler, error) {
 	if token == "" {
 		return nil, errors.New("Cannot crawl GitHub without an access token")
 	}
 
 	return &githubCrawler{
-		l:         l,
-		cacheRoot: cacheRoot,
-		github:    githubClient(token),
-		nextPage:  1,
-		ctx:       ctx,
+		l:          l,
+		mode:       mode,
+		clones:     clones,
+		github:     githubClient(token),
+		resumePage: 1,
+		limiter:    limiter,
+		resolver:   resolver,
+		retention:  retention,
+		cache:      cache,
+		ctx:        ctx,
 	}, nil
 }
 
@@ -57,10 +86,21 @@ func (t *githubTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 }
 
 func (gh *githubCrawler) Name() string {
+	if gh.mode == GitHubPushed {
+		return "GitHub recently pushed"
+	}
 	return "GitHub"
 }
 
+// SleepDuration returns the time until we can search again if we ran out of
+// search API calls. Otherwise we finished a pass through the search windows
+// and there's no rush to start another.
 func (gh *githubCrawler) SleepDuration() time.Duration {
+	if wait := gh.limiter.Wait(ratelimit.Search); wait > 0 {
+		// Reset times only have a resolution of one second, so we add a
+		// second to make sure we don't wake up just before the reset.
+		return wait + time.Second
+	}
 	return time.Duration(15) * time.Minute
 }
 
@@ -74,15 +114,22 @@ func (gh *githubCrawler) CrawlAll(ch chan *Result) {
 }
 
 func (gh *githubCrawler) crawlNextPage(ch chan *Result) bool {
-	if gh.nextPage == 0 {
-		ch <- gh.newResult(nil, nil, true)
-		return false
+	if gh.until.IsZero() {
+		gh.startPass()
 	}
 
+	gh.resumePage = gh.nextPage
 	result, err := gh.getNextPage()
+	if err == errOutOfSearches {
+		gh.l.Infof("Out of GitHub search API calls, will resume at page %d of %s", gh.nextPage, gh.window.query(gh.mode))
+		return false
+	}
 	if err != nil {
+		if gh.limiter.HandleError(ratelimit.Search, err) {
+			return false
+		}
 		// This should end up putting the crawler to sleep.
-		ch <- gh.newResult(nil, err, false)
+		ch <- gh.newResult(nil, errwrap.Wrapf("GitHub search error: {{err}}", err), false)
 		return false
 	}
 
@@ -90,13 +137,7 @@ func (gh *githubCrawler) crawlNextPage(ch chan *Result) bool {
 		// If we just pass in &r then the reference will change inside the
 		// githubRepository object as we go through the loop.
 		copy := r
-		ghRepo, err := repository.NewGitHubRepository(
-			gh.l,
-			&copy,
-			gh.github,
-			gh.cacheRoot,
-			gh.ctx,
-		)
+		ghRepo, err := gh.newRepository(&copy)
 		// If the repo was not crawled but there is no error (for example
 		// because it was skipped intentionally) then there's no result to
 		// send.
@@ -105,35 +146,172 @@ func (gh *githubCrawler) crawlNextPage(ch chan *Result) bool {
 		}
 	}
 
-	return true
+	if gh.nextPage != 0 {
+		return true
+	}
+
+	gh.window = gh.window.next(result.GetTotal(), gh.until)
+	gh.nextPage = 1
+	if !gh.window.isEmpty() {
+		return true
+	}
+
+	gh.l.Infof("Finished searching GitHub for repositories %s up to %s", gh.mode, gh.until.Format(time.RFC3339))
+	gh.until = time.Time{}
+	gh.resumePage = 1
+	ch <- gh.newResult(nil, nil, true)
+	return false
+}
+
+// startPass starts a new pass through the windows, ending now. When looking
+// for every repository we start from the beginning of GitHub. When looking
+// for recently pushed repositories we start from the end of the last pass.
+func (gh *githubCrawler) startPass() {
+	gh.until = time.Now().UTC().Truncate(time.Second)
+
+	start := githubEpoch
+	if gh.mode == GitHubPushed {
+		start = gh.window.end
+		if start.IsZero() {
+			start = gh.until.Add(-initialPushedLookback)
+		}
+	}
+
+	gh.window = newSearchWindow(start, initialWindow, gh.until)
+	gh.nextPage = 1
 }
 
 func (gh *githubCrawler) newResult(r repository.Repository, err error, ex bool) *Result {
-	return &Result{Crawler: gh, Repository: r, Error: err, Exhausted: ex}
+	return &Result{
+		Crawler:    gh,
+		Repository: r,
+		Error:      err,
+		Exhausted:  ex,
+		Cursor:     formatSearchCursor(gh.window, gh.resumePage),
+	}
 }
 
-func (gh *githubCrawler) getNextPage() (*github.RepositoriesSearchResult, error) {
-	gh.l.Infof("Searching for repositories where language=go, page %d", gh.nextPage)
-	result, resp, err := gh.github.Search.Repositories(
-		gh.ctx,
-		"language=go",
-		&github.SearchOptions{ListOptions: github.ListOptions{Page: gh.nextPage}},
-	)
+// Resume takes a cursor with the window and page to start from. See
+// formatSearchCursor. We don't know when the pass we're resuming started, so
+// it now ends at the time we resume.
+func (gh *githubCrawler) Resume(cursor string) error {
+	w, page, err := parseSearchCursor(cursor)
 	if err != nil {
-		return nil, errwrap.Wrapf("GitHub search error: {{err}}", err)
+		return err
 	}
 
-	if result.GetTotal() == 0 {
-		gh.l.Infof("Did not find any GitHub repositories on page %d", gh.nextPage)
-		return nil, nil
+	gh.window = w
+	gh.nextPage = page
+	gh.resumePage = page
+	if !w.isEmpty() {
+		gh.until = time.Now().UTC().Truncate(time.Second)
 	}
+	return nil
+}
 
-	gh.l.Infof("Found %d repositories", result.GetTotal())
-	gh.nextPage = resp.NextPage
+// getNextPage gets the next page of results for the current window. If the
+// window has more results than GitHub will return then we keep halving it
+// until it doesn't.
+func (gh *githubCrawler) getNextPage() (*github.RepositoriesSearchResult, error) {
+	for {
+		if !gh.limiter.Allow(ratelimit.Search) {
+			return nil, errOutOfSearches
+		}
 
-	return result, nil
+		q := gh.window.query(gh.mode)
+		gh.l.Infof("Searching GitHub for %s, page %d", q, gh.nextPage)
+		result, resp, err := gh.github.Search.Repositories(
+			gh.ctx,
+			q,
+			&github.SearchOptions{ListOptions: github.ListOptions{Page: gh.nextPage, PerPage: 100}},
+		)
+		gh.limiter.Update(ratelimit.Search, resp)
+		if err != nil {
+			// We return the error unwrapped so that the caller can check
+			// whether it's a rate limit error.
+			return nil, err
+		}
+
+		if gh.nextPage == 1 && result.GetTotal() > githubSearchCap {
+			if gh.window.narrow() {
+				gh.l.Infof("Found %d repositories, which is more than GitHub will return, so trying a smaller window", result.GetTotal())
+				continue
+			}
+			gh.l.Infof("Found %d repositories in a %s window, we will only see the first %d", result.GetTotal(), minWindow, githubSearchCap)
+		}
+
+		gh.l.Infof("Found %d repositories", result.GetTotal())
+		gh.l.Infof("GitHub API budget: %s", gh.limiter.Status())
+		gh.nextPage = resp.NextPage
+
+		return result, nil
+	}
+}
+
+func (gh *githubCrawler) CanCrawl(u *url.URL) bool {
+	return u.Host == "github.com" || u.Host == "www.github.com"
+}
+
+func (gh *githubCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	if !gh.CanCrawl(u) {
+		return nil, fmt.Errorf("%s is not a GitHub URL", u)
+	}
+
+	// We only care about the first two path elements so that URLs like
+	// "https://github.com/owner/name/tree/master/sub" still work.
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("%s does not contain a GitHub owner and repository name", u)
+	}
+	owner := parts[0]
+	name := strings.TrimSuffix(parts[1], ".git")
+
+	if wait := gh.limiter.Wait(ratelimit.Metadata); wait > 0 {
+		return nil, fmt.Errorf("Out of GitHub API calls, cannot get %s/%s for another %s", owner, name, wait)
+	}
+
+	gh.l.Infof("Getting %s/%s from GitHub", owner, name)
+	ghr, resp, err := gh.github.Repositories.Get(gh.ctx, owner, name)
+	gh.limiter.Update(ratelimit.Metadata, resp)
+	if err != nil {
+		gh.limiter.HandleError(ratelimit.Metadata, err)
+		err = errwrap.Wrapf(fmt.Sprintf("Could not get %s/%s from GitHub: {{err}}", owner, name), err)
+		if resp != nil && resp.Response != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) {
+			return nil, &repository.Error{
+				Repository: fmt.Sprintf("github.com/%s/%s", owner, name),
+				Stage:      repository.MetadataStage,
+				Err:        &repository.GoneError{Err: err},
+			}
+		}
+		return nil, err
+	}
+
+	// GitHub redirects requests for a repository that was renamed or
+	// transferred. The indexer notices that it's the same repository
+	// because its forge ID hasn't changed.
+	if !strings.EqualFold(ghr.GetFullName(), owner+"/"+name) {
+		gh.l.Infof("%s/%s has moved to %s", owner, name, ghr.GetFullName())
+	}
+
+	return gh.newRepository(ghr)
 }
 
-func (gh *githubCrawler) CrawlOne(*url.URL) (repository.Repository, error) {
-	return nil, nil
+func (gh *githubCrawler) newRepository(ghr *github.Repository) (repository.Repository, error) {
+	ghRepo, err := repository.NewGitHubRepository(
+		gh.l,
+		ghr,
+		gh.github,
+		gh.limiter,
+		gh.clones,
+		gh.resolver,
+		gh.retention,
+		gh.cache,
+		gh.ctx,
+	)
+	// We need to check for nil explicitly here. Otherwise we'd return a
+	// non-nil interface that contains a nil *githubRepository.
+	if ghRepo == nil || err != nil {
+		return nil, err
+	}
+	return ghRepo, nil
 }
@@ -0,0 +1,157 @@
+package crawler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitHubMode decides which Go repositories the GitHub crawler searches for.
+// GitHub never returns more than 1,000 results for a search, so each mode
+// splits its search into date windows that are small enough to see every
+// repository in them.
+type GitHubMode string
+
+const (
+	// Walk through every Go repository on GitHub in order of when it was
+	// created, from the oldest to the newest, and then start again.
+	GitHubCreated GitHubMode = "created"
+	// Find the Go repositories that have been pushed to since the last
+	// time we looked.
+	GitHubPushed GitHubMode = "pushed"
+)
+
+// ParseGitHubModes turns a comma separated list like "created,pushed" into
+// modes. An empty string means every mode.
+func ParseGitHubModes(s string) ([]GitHubMode, error) {
+	if strings.TrimSpace(s) == "" {
+		return []GitHubMode{GitHubCreated, GitHubPushed}, nil
+	}
+
+	var modes []GitHubMode
+	for _, m := range strings.Split(s, ",") {
+		switch mode := GitHubMode(strings.TrimSpace(m)); mode {
+		case GitHubCreated, GitHubPushed:
+			modes = append(modes, mode)
+		default:
+			return nil, fmt.Errorf("Unknown GitHub search mode %q, expected %s or %s", m, GitHubCreated, GitHubPushed)
+		}
+	}
+	return modes, nil
+}
+
+// The most results GitHub will return for one search.
+const githubSearchCap = 1000
+
+// Nothing on GitHub was created before this.
+var githubEpoch = time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	// The first window of a pass covers this much time. After that each
+	// window is sized based on how many results the last one had.
+	initialWindow = 30 * 24 * time.Hour
+	// We never make a window bigger than this, so that a burst of new
+	// repositories only costs us a few searches to find a window that
+	// fits.
+	maxWindow = 365 * 24 * time.Hour
+	// We never make a window smaller than this. If a window this size has
+	// too many results we only see the first 1,000.
+	minWindow = time.Minute
+	// The first time the recently pushed search runs it looks back this
+	// far.
+	initialPushedLookback = 24 * time.Hour
+)
+
+// searchWindow is the range of times from start up to but not including end.
+type searchWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+func (w searchWindow) span() time.Duration {
+	return w.end.Sub(w.start)
+}
+
+func (w searchWindow) isEmpty() bool {
+	return !w.start.Before(w.end)
+}
+
+// query returns the search for Go repositories whose created or pushed time
+// is in the window. GitHub's ranges include both ends, so we stop a second
+// before the end.
+func (w searchWindow) query(mode GitHubMode) string {
+	return fmt.Sprintf(
+		"language:go %s:%s..%s",
+		mode,
+		w.start.UTC().Format(time.RFC3339),
+		w.end.Add(-time.Second).UTC().Format(time.RFC3339),
+	)
+}
+
+// narrow halves the window. It returns false if the window is already as
+// small as it can be.
+func (w *searchWindow) narrow() bool {
+	half := (w.span() / 2).Truncate(time.Second)
+	if half < minWindow {
+		return false
+	}
+	w.end = w.start.Add(half)
+	return true
+}
+
+// next returns the window after this one, ending no later than until. The
+// size depends on how many results this window had. If it had few we double
+// the size, if it was close to the cap we halve it, and otherwise we keep it.
+func (w searchWindow) next(total int, until time.Time) searchWindow {
+	span := w.span()
+	switch {
+	case total < githubSearchCap/4:
+		span *= 2
+	case total > githubSearchCap*3/4:
+		span /= 2
+	}
+	if span > maxWindow {
+		span = maxWindow
+	}
+	if span < minWindow {
+		span = minWindow
+	}
+	return newSearchWindow(w.end, span, until)
+}
+
+func newSearchWindow(start time.Time, span time.Duration, until time.Time) searchWindow {
+	end := start.Add(span)
+	if end.After(until) {
+		end = until
+	}
+	return searchWindow{start: start, end: end}
+}
+
+// formatSearchCursor turns the window and page we're on into a cursor like
+// "2015-01-01T00:00:00Z 2015-02-01T00:00:00Z 3".
+func formatSearchCursor(w searchWindow, page int) string {
+	return fmt.Sprintf("%s %s %d", w.start.UTC().Format(time.RFC3339), w.end.UTC().Format(time.RFC3339), page)
+}
+
+func parseSearchCursor(cursor string) (searchWindow, int, error) {
+	invalid := fmt.Errorf("Invalid GitHub search cursor: %s", cursor)
+
+	fields := strings.Fields(cursor)
+	if len(fields) != 3 {
+		return searchWindow{}, 0, invalid
+	}
+	start, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return searchWindow{}, 0, invalid
+	}
+	end, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil || end.Before(start) {
+		return searchWindow{}, 0, invalid
+	}
+	page, err := strconv.Atoi(fields[2])
+	if err != nil || page < 1 {
+		return searchWindow{}, 0, invalid
+	}
+	return searchWindow{start: start, end: end}, page, nil
+}
@@ -0,0 +1,370 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/goproxy"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// localCrawler indexes Go code that is already on local disk in one or more
+// GOPATH trees. It indexes every module version in the module cache under
+// pkg/mod and every repository under src. This never touches the network.
+type localCrawler struct {
+	l       *logger.Logger
+	gopaths []string
+	ctx     context.Context
+}
+
+func NewLocalCrawler(l *logger.Logger, gopaths []string, ctx context.Context) (Crawler, error) {
+	for _, gp := range gopaths {
+		info, err := os.Stat(gp)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("The GOPATH entry %s is not a directory", gp)
+		}
+	}
+
+	return &localCrawler{
+		l:       l,
+		gopaths: gopaths,
+		ctx:     ctx,
+	}, nil
+}
+
+func (lc *localCrawler) Name() string {
+	return "Local GOPATH"
+}
+
+func (lc *localCrawler) SleepDuration() time.Duration {
+	return time.Duration(1) * time.Hour
+}
+
+func (lc *localCrawler) CrawlAll(ch chan *Result) {
+	for _, gp := range lc.gopaths {
+		lc.crawlModuleCache(ch, modCacheRoot(gp))
+		lc.crawlSrc(ch, srcRoot(gp))
+	}
+
+	ch <- lc.newResult(nil, nil, true)
+}
+
+func modCacheRoot(gopath string) string {
+	return filepath.Join(gopath, "pkg", "mod")
+}
+
+func srcRoot(gopath string) string {
+	return filepath.Join(gopath, "src")
+}
+
+func (lc *localCrawler) crawlModuleCache(ch chan *Result, root string) {
+	if !isDir(root) {
+		return
+	}
+
+	lc.l.Infof("Looking for modules in %s", root)
+	modules, err := moduleCacheVersions(root)
+	if err != nil {
+		ch <- lc.newResult(nil, err, false)
+		return
+	}
+
+	var paths []string
+	for m := range modules {
+		paths = append(paths, m)
+	}
+	sort.Strings(paths)
+
+	for _, m := range paths {
+		repo, err := lc.newModuleRepository(root, m, modules[m])
+		if repo != nil || err != nil {
+			ch <- lc.newResult(repo, err, false)
+		}
+	}
+}
+
+// moduleCacheVersions finds every module@version directory in a module cache
+// and returns a map from the module path to all of its versions. The paths
+// and versions are unescaped.
+func moduleCacheVersions(root string) (map[string][]string, error) {
+	modules := make(map[string][]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// This is where the go command keeps downloaded zip files and
+		// other metadata.
+		if rel == "cache" {
+			return filepath.SkipDir
+		}
+
+		at := strings.Index(info.Name(), "@")
+		if at == -1 {
+			return nil
+		}
+
+		m, v, err := unescapeModuleVersion(rel)
+		if err != nil {
+			return err
+		}
+		modules[m] = append(modules[m], v)
+
+		return filepath.SkipDir
+	})
+
+	return modules, err
+}
+
+// unescapeModuleVersion splits a path like "github.com/!foo/bar@v1.0.0" into
+// the unescaped module path and version.
+func unescapeModuleVersion(escaped string) (string, string, error) {
+	at := strings.LastIndex(escaped, "@")
+	if at == -1 {
+		return "", "", fmt.Errorf("%s does not contain a version", escaped)
+	}
+
+	m, err := goproxy.UnescapePath(escaped[:at])
+	if err != nil {
+		return "", "", err
+	}
+	v, err := goproxy.UnescapePath(escaped[at+1:])
+	if err != nil {
+		return "", "", err
+	}
+
+	return m, v, nil
+}
+
+func (lc *localCrawler) crawlSrc(ch chan *Result, root string) {
+	if !isDir(root) {
+		return
+	}
+
+	lc.l.Infof("Looking for repositories in %s", root)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == root {
+			return nil
+		}
+		if skipSrcDir(info.Name()) {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if !isRepositoryRoot(path, filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		repo, err := lc.newDirectoryRepository(path, filepath.ToSlash(rel))
+		if repo != nil || err != nil {
+			ch <- lc.newResult(repo, err, false)
+		}
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		ch <- lc.newResult(nil, err, false)
+	}
+}
+
+func skipSrcDir(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		strings.HasPrefix(name, "_") ||
+		name == "testdata" ||
+		name == "vendor"
+}
+
+// Hosts where we know that every repository lives at host/owner/name.
+var knownHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+var vcsDirs = []string{".git", ".hg", ".svn", ".bzr"}
+
+// isRepositoryRoot decides whether a directory under a GOPATH's src is the
+// root of a repository. A directory is a root if it's a VCS checkout, if it
+// is at the host/owner/name level for a well known host, or if it contains Go
+// code. The last case catches code that was copied into the GOPATH without
+// any VCS metadata.
+func isRepositoryRoot(dir, importPath string) bool {
+	for _, v := range vcsDirs {
+		if isDir(filepath.Join(dir, v)) {
+			return true
+		}
+	}
+
+	parts := strings.Split(importPath, "/")
+	if knownHosts[parts[0]] {
+		return len(parts) == 3
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".go") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func (lc *localCrawler) newResult(r repository.Repository, err error, ex bool) *Result {
+	return &Result{Crawler: lc, Repository: r, Error: err, Exhausted: ex}
+}
+
+// CanCrawl returns true for any file:// URL inside one of our GOPATH trees.
+func (lc *localCrawler) CanCrawl(u *url.URL) bool {
+	if u.Scheme != "file" {
+		return false
+	}
+
+	_, _, err := lc.findRoot(filepath.FromSlash(u.Path))
+	return err == nil
+}
+
+func (lc *localCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	if u.Scheme != "file" {
+		return nil, fmt.Errorf("The local crawler can only crawl file URLs, not %s", u)
+	}
+
+	p := filepath.FromSlash(u.Path)
+	root, rel, err := lc.findRoot(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if root == "src" {
+		return lc.crawlOneDirectory(p, rel)
+	}
+	return lc.crawlOneModule(p, rel)
+}
+
+// findRoot figures out whether the path is in the module cache or src
+// directory of one of our GOPATHs. It returns "mod" or "src" and the path
+// relative to that directory.
+func (lc *localCrawler) findRoot(p string) (string, string, error) {
+	for _, gp := range lc.gopaths {
+		for kind, root := range map[string]string{"mod": modCacheRoot(gp), "src": srcRoot(gp)} {
+			rel, err := filepath.Rel(root, p)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			return kind, filepath.ToSlash(rel), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("%s is not inside any of the GOPATH directories", p)
+}
+
+// crawlOneDirectory finds the repository root containing the path and indexes
+// that.
+func (lc *localCrawler) crawlOneDirectory(p, rel string) (repository.Repository, error) {
+	parts := strings.Split(rel, "/")
+	src := strings.TrimSuffix(p, filepath.FromSlash(rel))
+	for i := 1; i <= len(parts); i++ {
+		importPath := strings.Join(parts[:i], "/")
+		dir := filepath.Join(src, filepath.FromSlash(importPath))
+		if i == len(parts) || isRepositoryRoot(dir, importPath) {
+			return lc.newDirectoryRepository(dir, importPath)
+		}
+	}
+
+	// We can never get here since the loop always returns on the last
+	// iteration.
+	return nil, nil
+}
+
+// crawlOneModule indexes every cached version of the module containing the
+// path.
+func (lc *localCrawler) crawlOneModule(p, rel string) (repository.Repository, error) {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		at := strings.Index(part, "@")
+		if at == -1 {
+			continue
+		}
+
+		escaped := strings.Join(parts[:i+1], "/")
+		root := strings.TrimSuffix(p, filepath.FromSlash(rel))
+		m, _, err := unescapeModuleVersion(escaped)
+		if err != nil {
+			return nil, err
+		}
+
+		// We want all the versions of the module, which are the siblings
+		// of this directory that have the same name before the "@".
+		parent := filepath.Join(root, filepath.FromSlash(strings.Join(parts[:i], "/")))
+		files, err := ioutil.ReadDir(parent)
+		if err != nil {
+			return nil, err
+		}
+		var versions []string
+		for _, f := range files {
+			if f.IsDir() && strings.HasPrefix(f.Name(), part[:at+1]) {
+				_, v, err := unescapeModuleVersion(f.Name())
+				if err != nil {
+					return nil, err
+				}
+				versions = append(versions, v)
+			}
+		}
+
+		return lc.newModuleRepository(filepath.Clean(root), m, versions)
+	}
+
+	return nil, fmt.Errorf("%s is not inside a module@version directory", p)
+}
+
+func (lc *localCrawler) newModuleRepository(root, module string, versions []string) (repository.Repository, error) {
+	repo, err := repository.NewModuleCacheRepository(lc.l, root, module, versions, lc.ctx)
+	// See githubCrawler.newRepository for why this check is needed.
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (lc *localCrawler) newDirectoryRepository(dir, importPath string) (repository.Repository, error) {
+	repo, err := repository.NewDirectoryRepository(lc.l, dir, importPath, lc.ctx)
+	// See githubCrawler.newRepository for why this check is needed.
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
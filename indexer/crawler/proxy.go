@@ -0,0 +1,190 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/goproxy"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// The maximum number of entries we ask the index feed for at once.
+const proxyIndexPageSize = 2000
+
+// proxyCrawler discovers modules through a GOPROXY server. If the crawler has
+// an index feed URL it reads new module versions from the feed. Otherwise,
+// if the proxy is a file:// directory, it indexes every module in that
+// directory.
+//
+// The ID of a module's document is the module path under the proxy's URL,
+// like "proxy.golang.org/golang.org/x/text", so it never replaces the
+// document for the repository the module comes from.
+type proxyCrawler struct {
+	l         *logger.Logger
+	cacheRoot string
+	proxy     *goproxy.Client
+	hasIndex  bool
+	// This is true for a file:// proxy.
+	local bool
+	since time.Time
+	// The timestamp to start from if we're restarted. This is the start of
+	// the index page whose results we're currently sending.
+	resumeSince time.Time
+	retention   repository.Retention
+	ctx         context.Context
+}
+
+func NewProxyCrawler(l *logger.Logger, cacheRoot, proxyURL, indexURL string, retention repository.Retention, ctx context.Context) (Crawler, error) {
+	p, err := goproxy.New(proxyURL, indexURL, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyCrawler{
+		l:         l,
+		cacheRoot: cacheRoot,
+		proxy:     p,
+		hasIndex:  indexURL != "",
+		local:     strings.HasPrefix(p.URL(), "file:"),
+		retention: retention,
+		ctx:       ctx,
+	}, nil
+}
+
+func (pc *proxyCrawler) Name() string {
+	return "Go module proxy"
+}
+
+func (pc *proxyCrawler) SleepDuration() time.Duration {
+	return time.Duration(10) * time.Minute
+}
+
+func (pc *proxyCrawler) CrawlAll(ch chan *Result) {
+	if !pc.hasIndex {
+		if pc.local {
+			pc.crawlAllModules(ch)
+			return
+		}
+		// Without an index there's no way to find the modules on a remote
+		// proxy, so we only index the ones we're asked to with CrawlOne.
+		ch <- pc.newResult(nil, nil, true)
+		return
+	}
+
+	for {
+		more := pc.crawlNextIndexPage(ch)
+		if !more {
+			break
+		}
+	}
+}
+
+// crawlAllModules is used for a file:// proxy that has no index feed.
+func (pc *proxyCrawler) crawlAllModules(ch chan *Result) {
+	modules, err := pc.proxy.Modules()
+	if err != nil {
+		ch <- pc.newResult(nil, err, false)
+		return
+	}
+
+	for _, m := range modules {
+		pc.sendModule(ch, m)
+	}
+
+	ch <- pc.newResult(nil, nil, true)
+}
+
+func (pc *proxyCrawler) crawlNextIndexPage(ch chan *Result) bool {
+	pc.resumeSince = pc.since
+	pc.l.Infof("Reading the module index since %s", pc.since.Format(time.RFC3339))
+	entries, err := pc.proxy.Index(pc.since, proxyIndexPageSize)
+	if err != nil {
+		// This should end up putting the crawler to sleep.
+		ch <- pc.newResult(nil, err, false)
+		return false
+	}
+
+	pc.l.Infof("Found %d new module versions", len(entries))
+
+	// Each repository we send indexes every version of a module, so we only
+	// need to send each module once per page, no matter how many of its
+	// versions are in the feed.
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !seen[e.Path] {
+			seen[e.Path] = true
+			pc.sendModule(ch, e.Path)
+		}
+		// The since parameter is inclusive so we move just past the last
+		// entry we've seen.
+		pc.since = e.Timestamp.Add(time.Nanosecond)
+	}
+
+	if len(entries) < proxyIndexPageSize {
+		pc.resumeSince = pc.since
+		ch <- pc.newResult(nil, nil, true)
+		return false
+	}
+
+	return true
+}
+
+func (pc *proxyCrawler) sendModule(ch chan *Result, module string) {
+	repo, err := pc.newRepository(module)
+	if repo != nil || err != nil {
+		ch <- pc.newResult(repo, err, false)
+	}
+}
+
+func (pc *proxyCrawler) newResult(r repository.Repository, err error, ex bool) *Result {
+	res := &Result{Crawler: pc, Repository: r, Error: err, Exhausted: ex}
+	// Without an index we go through every module on each pass so there's
+	// nothing to resume from.
+	if pc.hasIndex {
+		res.Cursor = pc.resumeSince.UTC().Format(time.RFC3339Nano)
+	}
+	return res
+}
+
+// Resume takes an index feed timestamp in RFC 3339 format.
+func (pc *proxyCrawler) Resume(cursor string) error {
+	since, err := time.Parse(time.RFC3339Nano, cursor)
+	if err != nil {
+		return fmt.Errorf("Invalid module index timestamp: %s", cursor)
+	}
+
+	pc.since = since
+	pc.resumeSince = since
+	return nil
+}
+
+// CanCrawl only accepts URLs under the proxy's own URL, like
+// https://proxy.golang.org/golang.org/x/text. We never ask the proxy about
+// anything else. Any other URL may be for a private repository that the
+// proxy shouldn't hear about, and the crawlers for forges and plain git
+// remotes are better at indexing repositories anyway.
+func (pc *proxyCrawler) CanCrawl(u *url.URL) bool {
+	_, ok := pc.proxy.ModuleFor(u)
+	return ok
+}
+
+func (pc *proxyCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	module, ok := pc.proxy.ModuleFor(u)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a module on the proxy at %s", u, pc.proxy.URL())
+	}
+	return pc.newRepository(module)
+}
+
+func (pc *proxyCrawler) newRepository(module string) (repository.Repository, error) {
+	repo, err := repository.NewModuleRepository(pc.l, pc.proxy, module, pc.cacheRoot, pc.retention, pc.ctx)
+	// See githubCrawler.newRepository for why this check is needed.
+	if repo == nil || err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
@@ -0,0 +1,283 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// seedCrawler indexes a curated list of repositories read from a file, or
+// from stdin if the path is "-". The file is read again every time the
+// crawler wakes up and any entries that weren't there before are indexed.
+// Stdin can only be read once, so in that case there's nothing new after the
+// first pass.
+//
+// Each entry is a repository URL or an import path. Like the spider, the
+// seed crawler doesn't crawl anything itself. Each entry is handed to the
+// first crawler that can crawl it, just like indexing a single URL does.
+// See parseSeeds for the formats we understand.
+type seedCrawler struct {
+	l    *logger.Logger
+	path string
+	// Returns the crawler for an entry along with the URL it should crawl.
+	lookup func(string) (Crawler, *url.URL, error)
+	ctx    context.Context
+	// Every entry we've already crawled. An entry that fails before it
+	// gets to the indexer isn't in here, so we'll try it again next time.
+	seen map[string]bool
+	// The contents of stdin, since we can only read it once.
+	stdin []byte
+}
+
+func NewSeedCrawler(l *logger.Logger, path string, lookup func(string) (Crawler, *url.URL, error), ctx context.Context) (Crawler, error) {
+	sc := &seedCrawler{
+		l:      l,
+		path:   path,
+		lookup: lookup,
+		ctx:    ctx,
+		seen:   make(map[string]bool),
+	}
+
+	if path == "-" {
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, errwrap.Wrapf("Could not read the seed list from stdin: {{err}}", err)
+		}
+		sc.stdin = stdin
+	} else if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+func (sc *seedCrawler) Name() string {
+	return "Seed file"
+}
+
+func (sc *seedCrawler) SleepDuration() time.Duration {
+	return time.Duration(1) * time.Hour
+}
+
+func (sc *seedCrawler) CrawlAll(ch chan *Result) {
+	seeds, err := sc.read()
+	if err != nil {
+		ch <- &Result{Crawler: sc, Error: err}
+		return
+	}
+
+	var added []string
+	for _, s := range seeds {
+		if !sc.seen[s] {
+			added = append(added, s)
+		}
+	}
+	sc.l.Infof("Found %d entries in %s, %d of them new", len(seeds), sc.source(), len(added))
+
+	for _, s := range added {
+		c, u, err := sc.lookup(s)
+		if err != nil {
+			ch <- &Result{Crawler: sc, Error: errwrap.Wrapf(fmt.Sprintf("Could not crawl %s: {{err}}", s), err)}
+			continue
+		}
+
+		sc.l.Infof("Crawling %s with the %s crawler", u, c.Name())
+		repo, err := c.CrawlOne(u)
+		if err == nil {
+			sc.seen[s] = true
+		}
+		if repo != nil || err != nil {
+			ch <- &Result{Crawler: c, Repository: repo, Error: err}
+		}
+	}
+
+	ch <- &Result{Crawler: sc, Exhausted: true}
+}
+
+func (sc *seedCrawler) read() ([]string, error) {
+	if sc.stdin != nil {
+		return parseSeeds(bytes.NewReader(sc.stdin))
+	}
+
+	f, err := os.Open(sc.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seeds, err := parseSeeds(f)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read the seed list in %s: {{err}}", sc.path), err)
+	}
+	return seeds, nil
+}
+
+func (sc *seedCrawler) source() string {
+	if sc.stdin != nil {
+		return "stdin"
+	}
+	return sc.path
+}
+
+// CanCrawl is always false because the seed crawler only finds repositories
+// for other crawlers.
+func (sc *seedCrawler) CanCrawl(u *url.URL) bool {
+	return false
+}
+
+func (sc *seedCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	return nil, fmt.Errorf("The seed crawler cannot crawl %s", u)
+}
+
+var (
+	goModModuleRE   = regexp.MustCompile(`(?m)^\s*module\s`)
+	gopkgProjectsRE = regexp.MustCompile(`(?m)^\s*\[\[projects\]\]`)
+	markdownLinkRE  = regexp.MustCompile(`\]\(\s*<?(https?://[^)\s>]+)`)
+	gopkgNameRE     = regexp.MustCompile(`^\s*name\s*=\s*"([^"]+)"`)
+)
+
+// These are the hosts we take markdown links to. Lists like awesome-go link
+// to plenty of things that aren't repositories, and these are the hosts
+// where we can tell that a link is to a repository.
+var forgeHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+// parseSeeds returns the entries in a seed list, without duplicates, in the
+// order they first appear. We look at the contents to decide what kind of
+// list it is, since stdin has no name:
+//
+// * A go.mod file, where the entries are the modules in its require
+// directives.
+//
+// * A Gopkg.lock file, where the entries are the names of its projects.
+//
+// * A markdown file like awesome-go, where the entries are the links to
+// repositories on GitHub, GitLab, and Bitbucket.
+//
+// * Anything else is a plain list with one URL or import path per line.
+// Anything after a "#" is a comment.
+func parseSeeds(r io.Reader) ([]string, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var seeds []string
+	switch {
+	case goModModuleRE.Match(content):
+		seeds = parseGoModSeeds(content)
+	case gopkgProjectsRE.Match(content):
+		seeds = parseGopkgLockSeeds(content)
+	case markdownLinkRE.Match(content):
+		seeds = parseMarkdownSeeds(content)
+	default:
+		seeds = parsePlainSeeds(content)
+	}
+
+	seen := make(map[string]bool)
+	var uniq []string
+	for _, s := range seeds {
+		if !seen[s] {
+			seen[s] = true
+			uniq = append(uniq, s)
+		}
+	}
+	return uniq, nil
+}
+
+func parseGoModSeeds(content []byte) []string {
+	var seeds []string
+	inRequire := false
+	for _, line := range seedLines(content, "//") {
+		fields := strings.Fields(line)
+		switch {
+		case inRequire && fields[0] == ")":
+			inRequire = false
+		case inRequire:
+			seeds = append(seeds, strings.Trim(fields[0], `"`))
+		case fields[0] == "require" && len(fields) > 1 && fields[1] == "(":
+			inRequire = true
+		case fields[0] == "require" && len(fields) > 1:
+			seeds = append(seeds, strings.Trim(fields[1], `"`))
+		}
+	}
+	return seeds
+}
+
+func parseGopkgLockSeeds(content []byte) []string {
+	var seeds []string
+	inProject := false
+	for _, line := range seedLines(content, "#") {
+		if strings.HasPrefix(line, "[") {
+			inProject = line == "[[projects]]"
+			continue
+		}
+		if !inProject {
+			continue
+		}
+		if m := gopkgNameRE.FindStringSubmatch(line); m != nil {
+			seeds = append(seeds, m[1])
+		}
+	}
+	return seeds
+}
+
+func parseMarkdownSeeds(content []byte) []string {
+	var seeds []string
+	for _, m := range markdownLinkRE.FindAllSubmatch(content, -1) {
+		u, err := url.Parse(string(m[1]))
+		if err != nil || !forgeHosts[strings.TrimPrefix(u.Host, "www.")] {
+			continue
+		}
+		// A link to a repository has an owner and a name. Anything after
+		// that, like "/tree/master/sub", is ignored when we crawl it.
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		seeds = append(seeds, fmt.Sprintf("https://%s/%s/%s", strings.TrimPrefix(u.Host, "www."), parts[0], parts[1]))
+	}
+	return seeds
+}
+
+func parsePlainSeeds(content []byte) []string {
+	var seeds []string
+	for _, line := range seedLines(content, "#") {
+		seeds = append(seeds, strings.Fields(line)[0])
+	}
+	return seeds
+}
+
+// seedLines returns the lines of the content that aren't blank once
+// comments starting with the given marker are removed.
+func seedLines(content []byte, comment string) []string {
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, comment); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
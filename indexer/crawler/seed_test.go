@@ -0,0 +1,82 @@
+package crawler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSeeds(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			"plain list",
+			`# Our services
+https://github.com/example/service
+golang.org/x/text  # the vanity path is resolved
+
+git@gitlab.example.com:team/tool.git
+https://github.com/example/service
+`,
+			[]string{"https://github.com/example/service", "golang.org/x/text", "git@gitlab.example.com:team/tool.git"},
+		},
+		{
+			"go.mod",
+			`module github.com/example/service
+
+go 1.12
+
+require github.com/pkg/errors v0.8.1
+
+require (
+	github.com/stretchr/testify v1.3.0
+	golang.org/x/text v0.3.0 // indirect
+)
+
+replace github.com/pkg/errors => ../errors
+`,
+			[]string{"github.com/pkg/errors", "github.com/stretchr/testify", "golang.org/x/text"},
+		},
+		{
+			"Gopkg.lock",
+			`# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+[[projects]]
+  name = "github.com/davecgh/go-spew"
+  packages = ["spew"]
+  revision = "346938d642f2ec3594ed81d874461961cd0faa76"
+
+[[projects]]
+  branch = "master"
+  name = "golang.org/x/net"
+  packages = ["context"]
+
+[solve-meta]
+  analyzer-name = "dep"
+`,
+			[]string{"github.com/davecgh/go-spew", "golang.org/x/net"},
+		},
+		{
+			"markdown",
+			`# Awesome Go
+
+* [testify](https://github.com/stretchr/testify) - Sane and simple Go testing.
+* [yaml](https://github.com/go-yaml/yaml/tree/v2) - YAML support.
+* [gitlab](https://www.gitlab.com/example/tool) - On GitLab.
+* [Go website](https://golang.org/doc/) - Not a repository.
+* [GitHub](https://github.com/example) - Not a repository either.
+`,
+			[]string{"https://github.com/stretchr/testify", "https://github.com/go-yaml/yaml", "https://gitlab.com/example/tool"},
+		},
+	}
+
+	for _, test := range tests {
+		seeds, err := parseSeeds(strings.NewReader(test.content))
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.expected, seeds, test.name)
+	}
+}
@@ -0,0 +1,296 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/vanity"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// We stop remembering new imports once this many are waiting to be looked
+// at. Anything we drop will be seen again the next time a repository that
+// imports it is indexed.
+const maxSpiderPending = 100000
+
+// spiderCrawler finds repositories to index by following the imports of the
+// packages we've just indexed. The indexer tells it about those imports with
+// Discover. A repository found by following the imports of a repository the
+// spider found is one level deeper, and the spider stops following imports
+// once it reaches its maximum depth.
+//
+// The spider doesn't know how to crawl anything itself. It hands each
+// repository it finds to the first crawler that can crawl it, just like
+// indexing a single URL does, and the results it sends are from that
+// crawler.
+type spiderCrawler struct {
+	l        *logger.Logger
+	resolver *vanity.Resolver
+	// Import path prefixes we're allowed to follow, like "github.com" or
+	// "github.com/example". If this is empty we follow everything.
+	allow    []string
+	maxDepth int
+	// Returns the crawler for a repository URL, or nil if there isn't one.
+	crawlerFor func(*url.URL) Crawler
+	// Reports whether we already have a document for the repository ID.
+	isIndexed func(string) bool
+	ctx       context.Context
+
+	pending []spiderImport
+	// The depth of every repository we've found or been told about, keyed
+	// on the repository ID.
+	depths map[string]int
+	// The import path prefixes of repositories we've already found. Any
+	// import under one of these doesn't need to be resolved again.
+	prefixes map[string]bool
+	mutex    sync.Mutex
+}
+
+type spiderImport struct {
+	path  string
+	depth int
+}
+
+// Spider is implemented by the crawler returned by NewSpiderCrawler.
+type Spider interface {
+	Crawler
+	// Discover is called with the imports of the packages in a repository
+	// that was just indexed. It is safe to call from multiple goroutines.
+	Discover(repoID string, imports []string)
+}
+
+func NewSpiderCrawler(
+	l *logger.Logger,
+	resolver *vanity.Resolver,
+	allow []string,
+	maxDepth int,
+	crawlerFor func(*url.URL) Crawler,
+	isIndexed func(string) bool,
+	ctx context.Context,
+) (Spider, error) {
+	if maxDepth < 1 {
+		return nil, fmt.Errorf("The spider's maximum depth must be at least 1, not %d", maxDepth)
+	}
+
+	var prefixes []string
+	for _, a := range allow {
+		prefixes = append(prefixes, strings.Trim(a, "/"))
+	}
+
+	return &spiderCrawler{
+		l:          l,
+		resolver:   resolver,
+		allow:      prefixes,
+		maxDepth:   maxDepth,
+		crawlerFor: crawlerFor,
+		isIndexed:  isIndexed,
+		ctx:        ctx,
+		depths:     make(map[string]int),
+		prefixes:   make(map[string]bool),
+	}, nil
+}
+
+func (s *spiderCrawler) Name() string {
+	return "Dependency spider"
+}
+
+// SleepDuration is short because the spider only has work to do when other
+// crawlers have indexed something.
+func (s *spiderCrawler) SleepDuration() time.Duration {
+	return time.Duration(1) * time.Minute
+}
+
+// Discover queues the imports of a repository unless the repository is
+// already at the maximum depth. A repository the spider didn't find itself
+// is at depth 0.
+func (s *spiderCrawler) Discover(repoID string, imports []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Imports of the repository's own packages don't need resolving.
+	s.prefixes[repoID] = true
+
+	depth := s.depths[repoID]
+	if depth >= s.maxDepth {
+		return
+	}
+
+	queued := 0
+	for _, i := range imports {
+		if !s.allowed(i) || s.knownLocked(i) {
+			continue
+		}
+		if len(s.pending) >= maxSpiderPending {
+			s.l.Infof("  the spider already has %d imports to look at, ignoring the rest of %s's imports", len(s.pending), repoID)
+			break
+		}
+		s.pending = append(s.pending, spiderImport{path: i, depth: depth + 1})
+		queued++
+	}
+
+	if queued > 0 {
+		s.l.Infof("  the spider will look at %d imports from %s", queued, repoID)
+	}
+}
+
+// allowed reports whether an import path is one we should follow. Standard
+// library packages never are. Their first path element has no dot in it.
+func (s *spiderCrawler) allowed(importPath string) bool {
+	first := strings.SplitN(importPath, "/", 2)[0]
+	if !strings.Contains(first, ".") {
+		return false
+	}
+	if len(s.allow) == 0 {
+		return true
+	}
+	for _, a := range s.allow {
+		if hasPathPrefix(importPath, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownLocked reports whether an import path is in a repository we've
+// already found. The mutex must be held.
+func (s *spiderCrawler) knownLocked(importPath string) bool {
+	for p := importPath; p != "."; p = parentPath(p) {
+		if s.prefixes[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func parentPath(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i == -1 {
+		return "."
+	}
+	return p[:i]
+}
+
+func hasPathPrefix(s, prefix string) bool {
+	return s == prefix || strings.HasPrefix(s, prefix+"/")
+}
+
+// CrawlAll looks at every import we've been told about since the last time
+// it ran and then reports that the crawler is exhausted.
+func (s *spiderCrawler) CrawlAll(ch chan *Result) {
+	for {
+		i, ok := s.next()
+		if !ok {
+			break
+		}
+
+		c, repo, err := s.crawlImport(i)
+		if repo != nil || err != nil {
+			ch <- &Result{Crawler: c, Repository: repo, Error: err}
+		}
+	}
+
+	ch <- &Result{Crawler: s, Exhausted: true}
+}
+
+func (s *spiderCrawler) next() (spiderImport, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.pending) > 0 {
+		i := s.pending[0]
+		s.pending = s.pending[1:]
+		// We may have found the repository for this import since it was
+		// queued.
+		if !s.knownLocked(i.path) {
+			return i, true
+		}
+	}
+	s.pending = nil
+	return spiderImport{}, false
+}
+
+// crawlImport finds the repository for an import and, if it hasn't been
+// indexed yet, returns it along with the crawler that should index it. It
+// returns a nil repository and error if there's nothing to index.
+func (s *spiderCrawler) crawlImport(i spiderImport) (Crawler, repository.Repository, error) {
+	prefix, u, err := s.repositoryFor(i.path)
+	if err != nil {
+		s.l.Infof("The spider could not find the repository for %s: %s", i.path, err)
+		return nil, nil, nil
+	}
+
+	id := u.Host + strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+
+	s.mutex.Lock()
+	s.prefixes[prefix] = true
+	_, seen := s.depths[id]
+	if !seen || i.depth < s.depths[id] {
+		s.depths[id] = i.depth
+	}
+	s.mutex.Unlock()
+
+	if seen || s.isIndexed(id) {
+		return nil, nil, nil
+	}
+
+	c := s.crawlerFor(u)
+	if c == nil {
+		s.l.Infof("The spider found %s for %s but none of the crawlers can crawl it", u, i.path)
+		return nil, nil, nil
+	}
+
+	s.l.Infof("The spider found %s at depth %d by following %s", u, i.depth, i.path)
+	repo, err := c.CrawlOne(u)
+	if repo != nil && repo.ID() != id {
+		// The crawler may know the repository by another name, for example
+		// if it was renamed on GitHub. Discover will be called with that
+		// name, so it needs to have the right depth too.
+		s.mutex.Lock()
+		s.depths[repo.ID()] = i.depth
+		s.mutex.Unlock()
+	}
+	return c, repo, err
+}
+
+// repositoryFor returns the import path of the root of the repository that
+// contains an import path, along with the URL to crawl it. GitHub import
+// paths map straight to repositories. Anything else has to be resolved with
+// its go-import meta tag.
+func (s *spiderCrawler) repositoryFor(importPath string) (string, *url.URL, error) {
+	parts := strings.Split(importPath, "/")
+	if parts[0] == "github.com" {
+		if len(parts) < 3 {
+			return "", nil, fmt.Errorf("%s is not a GitHub repository", importPath)
+		}
+		prefix := strings.Join(parts[:3], "/")
+		return prefix, &url.URL{Scheme: "https", Host: parts[0], Path: "/" + strings.Join(parts[1:3], "/")}, nil
+	}
+
+	m, err := s.resolver.Resolve(importPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.VCS != "git" {
+		return "", nil, fmt.Errorf("%s uses %s, not git", m.Prefix, m.VCS)
+	}
+	u, err := url.Parse(m.RepoURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("The repository URL for %s is not valid: %s", m.Prefix, err)
+	}
+	return m.Prefix, u, nil
+}
+
+// CanCrawl is always false because the spider only finds repositories for
+// other crawlers.
+func (s *spiderCrawler) CanCrawl(u *url.URL) bool {
+	return false
+}
+
+func (s *spiderCrawler) CrawlOne(u *url.URL) (repository.Repository, error) {
+	return nil, fmt.Errorf("The spider cannot crawl %s", u)
+}
@@ -0,0 +1,169 @@
+package directory
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// isIgnored reports whether a Go file's build constraints can never be
+// satisfied because they require the "ignore" tag, like "//go:build ignore".
+// The go tool never sets that tag, so files like this are usually programs
+// run with "go run" to generate code. Any other tag might be set in some
+// build, so we treat it as both true and false.
+//
+// The go/build package we're built with may be too old to know about
+// "//go:build" lines, which is why we check for these ourselves.
+func isIgnored(src []byte) bool {
+	var plusBuild []string
+	s := bufio.NewScanner(bytes.NewReader(src))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			// Constraints must come before the package clause.
+			break
+		}
+
+		if strings.HasPrefix(line, "//go:build ") {
+			// When there is a "//go:build" line it replaces any "+build"
+			// lines.
+			canBeTrue, _ := evalBuildExpr(strings.TrimPrefix(line, "//go:build "))
+			return !canBeTrue
+		}
+
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		if strings.HasPrefix(comment, "+build ") {
+			plusBuild = append(plusBuild, strings.TrimPrefix(comment, "+build "))
+		}
+	}
+
+	// Every "+build" line must be satisfied. Each one is a space separated
+	// list of alternatives, and each alternative is a comma separated list
+	// of terms that must all be true.
+	for _, line := range plusBuild {
+		satisfiable := false
+		for _, alt := range strings.Fields(line) {
+			if !containsTerm(strings.Split(alt, ","), "ignore") {
+				satisfiable = true
+				break
+			}
+		}
+		if !satisfiable {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTerm(terms []string, term string) bool {
+	for _, t := range terms {
+		if t == term {
+			return true
+		}
+	}
+	return false
+}
+
+// evalBuildExpr works out whether a "//go:build" expression can be true and
+// whether it can be false. An expression we can't parse can be either.
+func evalBuildExpr(expr string) (bool, bool) {
+	p := &exprParser{tokens: tokenize(expr)}
+	canBeTrue, canBeFalse, ok := p.or()
+	if !ok || p.pos != len(p.tokens) {
+		return true, true
+	}
+	return canBeTrue, canBeFalse
+}
+
+func tokenize(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t()!&|", expr[j]) == -1 {
+				j++
+			}
+			if j == i {
+				// A lone "&" or "|".
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// exprParser is a recursive descent parser for "//go:build" expressions.
+// Each method returns whether the part it parsed can be true, whether it can
+// be false, and whether it parsed at all.
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) or() (bool, bool, bool) {
+	t, f, ok := p.and()
+	for ok && p.peek() == "||" {
+		p.pos++
+		var t2, f2 bool
+		t2, f2, ok = p.and()
+		t, f = t || t2, f && f2
+	}
+	return t, f, ok
+}
+
+func (p *exprParser) and() (bool, bool, bool) {
+	t, f, ok := p.not()
+	for ok && p.peek() == "&&" {
+		p.pos++
+		var t2, f2 bool
+		t2, f2, ok = p.not()
+		t, f = t && t2, f || f2
+	}
+	return t, f, ok
+}
+
+func (p *exprParser) not() (bool, bool, bool) {
+	switch tok := p.peek(); tok {
+	case "!":
+		p.pos++
+		t, f, ok := p.not()
+		return f, t, ok
+	case "(":
+		p.pos++
+		t, f, ok := p.or()
+		if !ok || p.peek() != ")" {
+			return false, false, false
+		}
+		p.pos++
+		return t, f, true
+	case "", ")", "&&", "||":
+		return false, false, false
+	default:
+		p.pos++
+		if tok == "ignore" {
+			return false, true, true
+		}
+		return true, true, true
+	}
+}
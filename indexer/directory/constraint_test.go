@@ -0,0 +1,35 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsIgnored(t *testing.T) {
+	tests := []struct {
+		src     string
+		ignored bool
+	}{
+		{"package foo\n", false},
+		{"//go:build ignore\n\npackage main\n", true},
+		{"// +build ignore\n\npackage main\n", true},
+		{"// Copyright 2018\n\n//go:build ignore\n// +build ignore\n\npackage main\n", true},
+		{"//go:build linux && ignore\n\npackage foo\n", true},
+		{"//go:build (ignore || tools) && !windows\n\npackage foo\n", false},
+		{"//go:build !ignore\n\npackage foo\n", false},
+		{"//go:build linux\n\npackage foo\n", false},
+		{"// +build linux,ignore darwin\n\npackage foo\n", false},
+		{"// +build linux,ignore\n// +build darwin\n\npackage foo\n", true},
+		// The go:build line wins over +build lines.
+		{"//go:build linux\n// +build ignore\n\npackage foo\n", false},
+		// Constraints after the package clause don't count.
+		{"package foo\n\n//go:build ignore\n", false},
+		// Neither does a malformed expression.
+		{"//go:build ignore &&\n\npackage foo\n", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.ignored, isIgnored([]byte(test.src)), test.src)
+	}
+}
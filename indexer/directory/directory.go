@@ -8,12 +8,12 @@ import (
 	"go/build"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/autarch/metagodoc/indexer/tree"
 )
 
 // File represents a file.
@@ -34,38 +34,55 @@ type Directory struct {
 	Files      []*File
 }
 
-func New(dir string, importPath, rootURL string) *Directory {
+// New reads the Go files in a directory of the tree. The dir is relative to
+// the root of the tree. Files that the go tool would never build, because
+// their names start with "_" or "." or because of a "//go:build ignore"
+// constraint, are left out.
+func New(t tree.Tree, dir string, importPath, rootURL string) (*Directory, error) {
+	files, err := goFiles(t, dir, rootURL)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Directory{
 		Path:       dir,
 		ImportPath: importPath,
-		Files:      goFiles(dir, rootURL),
-	}
+		Files:      files,
+	}, nil
 }
 
-func goFiles(dir, rootURL string) []*File {
-	contents, err := ioutil.ReadDir(dir)
+func goFiles(t tree.Tree, dir, rootURL string) ([]*File, error) {
+	contents, err := t.ReadDir(dir)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	var files []*File
 	for _, f := range contents {
-		if !isDocFile(f.Name()) {
+		if f.IsDir || !IsGoFile(f.Name) {
 			continue
 		}
 
-		c, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		c, err := t.ReadFile(path.Join(dir, f.Name))
 		if err != nil {
-			log.Panic(err)
+			return nil, err
+		}
+		if isIgnored(c) {
+			continue
 		}
 
-		url := strings.Join([]string{rootURL, f.Name()}, "/")
-		files = append(files, &File{Name: f.Name(), Data: c, BrowseURL: url})
+		var url string
+		if rootURL != "" {
+			url = strings.Join([]string{rootURL, f.Name}, "/")
+		}
+		files = append(files, &File{Name: f.Name, Data: c, BrowseURL: url})
 	}
-	return files
+	return files, nil
 }
 
-func isDocFile(n string) bool {
+// IsGoFile reports whether the go tool would look at a file with this name
+// at all.
+func IsGoFile(n string) bool {
 	if strings.HasSuffix(n, ".go") && n[0] != '_' && n[0] != '.' {
 		return true
 	}
@@ -0,0 +1,324 @@
+// Package gomod parses go.mod files. It understands enough of the format to
+// extract the metadata we index: the module path, go directive, and the
+// require, replace, exclude, and retract directives, along with the
+// "Deprecated:" comment on the module directive. Directives it doesn't know
+// about, like toolchain, are ignored. See
+// https://golang.org/ref/mod#go-mod-file for the file format.
+package gomod
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// File is a parsed go.mod file.
+type File struct {
+	Module string
+	// The text after "Deprecated:" in the module's comments, if any.
+	Deprecated string
+	// The version from the go directive, like "1.12".
+	Go      string
+	Require []*Require
+	Replace []*Replace
+	Exclude []*Version
+	Retract []*Retract
+}
+
+type Version struct {
+	Path    string
+	Version string
+}
+
+type Require struct {
+	Path     string
+	Version  string
+	Indirect bool
+}
+
+// Replace is a replace directive. OldVersion is empty if the replacement
+// applies to all versions. NewVersion is empty if NewPath is a directory.
+type Replace struct {
+	OldPath    string
+	OldVersion string
+	NewPath    string
+	NewVersion string
+}
+
+// Retract is a retract directive. For a single version Low and High are the
+// same.
+type Retract struct {
+	Low       string
+	High      string
+	Rationale string
+}
+
+// parser holds the state while we go through the file line by line.
+type parser struct {
+	f    *File
+	line int
+
+	// The verb for the block we're in, like "require", or an empty string
+	// if we're not in a block.
+	block string
+	// The comments before the start of the current block.
+	blockComments []string
+}
+
+// Parse parses the content of a go.mod file.
+func Parse(data []byte) (*File, error) {
+	p := &parser{f: &File{}}
+
+	// Comments before a directive, with the leading "//" removed. These are
+	// reset by a blank line.
+	var comments []string
+	for i, l := range strings.Split(string(data), "\n") {
+		p.line = i + 1
+
+		tokens, comment, err := lex(l)
+		if err != nil {
+			return nil, p.errorf("%s", err)
+		}
+
+		if len(tokens) == 0 {
+			if comment != nil {
+				comments = append(comments, *comment)
+			} else {
+				comments = nil
+			}
+			continue
+		}
+
+		err = p.parseLine(tokens, comments, comment)
+		if err != nil {
+			return nil, err
+		}
+		comments = nil
+	}
+
+	if p.block != "" {
+		return nil, p.errorf("unterminated %s block", p.block)
+	}
+	if p.f.Module == "" {
+		return nil, fmt.Errorf("go.mod: no module directive found")
+	}
+
+	return p.f, nil
+}
+
+func (p *parser) parseLine(tokens []string, before []string, suffix *string) error {
+	if p.block != "" {
+		if len(tokens) == 1 && tokens[0] == ")" {
+			p.block = ""
+			p.blockComments = nil
+			return nil
+		}
+		return p.parseDirective(p.block, tokens, before, suffix)
+	}
+
+	verb, args := tokens[0], tokens[1:]
+	if len(args) > 0 && args[0] == "(" {
+		switch {
+		// This is something like "require ()".
+		case len(args) == 2 && args[1] == ")":
+			return nil
+		case len(args) == 1:
+			p.block = verb
+			p.blockComments = before
+			return nil
+		default:
+			return p.errorf("unexpected tokens after the start of a %s block", verb)
+		}
+	}
+
+	return p.parseDirective(verb, args, before, suffix)
+}
+
+func (p *parser) parseDirective(verb string, args []string, before []string, suffix *string) error {
+	switch verb {
+	case "module":
+		if len(args) != 1 {
+			return p.errorf("usage: module module/path")
+		}
+		p.f.Module = args[0]
+		p.f.Deprecated = deprecation(commentLines(before, suffix))
+	case "go":
+		if len(args) != 1 {
+			return p.errorf("usage: go 1.23")
+		}
+		p.f.Go = args[0]
+	case "require":
+		if len(args) != 2 {
+			return p.errorf("usage: require module/path v1.2.3")
+		}
+		p.f.Require = append(p.f.Require, &Require{
+			Path:     args[0],
+			Version:  args[1],
+			Indirect: isIndirect(suffix),
+		})
+	case "exclude":
+		if len(args) != 2 {
+			return p.errorf("usage: exclude module/path v1.2.3")
+		}
+		p.f.Exclude = append(p.f.Exclude, &Version{Path: args[0], Version: args[1]})
+	case "replace":
+		r, err := p.parseReplace(args)
+		if err != nil {
+			return err
+		}
+		p.f.Replace = append(p.f.Replace, r)
+	case "retract":
+		r, err := p.parseRetract(args)
+		if err != nil {
+			return err
+		}
+		r.Rationale = strings.Join(commentLines(before, suffix), "\n")
+		if r.Rationale == "" && p.block != "" {
+			r.Rationale = strings.Join(p.blockComments, "\n")
+		}
+		p.f.Retract = append(p.f.Retract, r)
+	}
+
+	return nil
+}
+
+// parseReplace handles all the forms of replace:
+//
+//	replace old => new v1.2.3
+//	replace old v1.0.0 => new v1.2.3
+//	replace old => ../local/dir
+//	replace old v1.0.0 => ../local/dir
+func (p *parser) parseReplace(args []string) (*Replace, error) {
+	arrow := -1
+	for i, a := range args {
+		if a == "=>" {
+			arrow = i
+			break
+		}
+	}
+	if arrow < 1 || arrow > 2 || len(args)-arrow < 2 || len(args)-arrow > 3 {
+		return nil, p.errorf("usage: replace module/path [v1.2.3] => other/module v1.4.5 or local/dir")
+	}
+
+	r := &Replace{OldPath: args[0], NewPath: args[arrow+1]}
+	if arrow == 2 {
+		r.OldVersion = args[1]
+	}
+	if len(args)-arrow == 3 {
+		r.NewVersion = args[arrow+2]
+	}
+	return r, nil
+}
+
+// parseRetract handles "retract v1.2.3" and "retract [v1.2.3, v1.3.0]".
+func (p *parser) parseRetract(args []string) (*Retract, error) {
+	if len(args) == 1 && args[0] != "[" {
+		return &Retract{Low: args[0], High: args[0]}, nil
+	}
+	if len(args) == 5 && args[0] == "[" && args[2] == "," && args[4] == "]" {
+		return &Retract{Low: args[1], High: args[3]}, nil
+	}
+	return nil, p.errorf("usage: retract v1.2.3 or retract [v1.2.3, v1.3.0]")
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("go.mod:%d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func commentLines(before []string, suffix *string) []string {
+	lines := append([]string{}, before...)
+	if suffix != nil {
+		lines = append(lines, *suffix)
+	}
+	return lines
+}
+
+// deprecation finds a paragraph starting with "Deprecated:" in a module's
+// comments and returns the rest of that paragraph.
+func deprecation(lines []string) string {
+	var para []string
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && lines[i] != "" {
+			para = append(para, lines[i])
+			continue
+		}
+
+		text := strings.Join(para, "\n")
+		if strings.HasPrefix(text, "Deprecated:") {
+			return strings.TrimSpace(strings.TrimPrefix(text, "Deprecated:"))
+		}
+		para = nil
+	}
+	return ""
+}
+
+// The go command writes "// indirect" but it also allows a further comment
+// after a semicolon, like "// indirect; used by tests".
+func isIndirect(suffix *string) bool {
+	if suffix == nil {
+		return false
+	}
+	return *suffix == "indirect" || strings.HasPrefix(*suffix, "indirect;")
+}
+
+// lex splits a line into tokens. It returns the text of any comment on the
+// line separately, without the leading "//". Quoted strings are unquoted.
+func lex(line string) ([]string, *string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(line[i:], "//"):
+			comment := strings.TrimSpace(line[i+2:])
+			return tokens, &comment, nil
+		case strings.HasPrefix(line[i:], "=>"):
+			tokens = append(tokens, "=>")
+			i += 2
+		case strings.IndexByte("()[],", c) != -1:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"' || c == '`':
+			end := quotedEnd(line, i)
+			if end == -1 {
+				return nil, nil, fmt.Errorf("unterminated quoted string")
+			}
+			s, err := strconv.Unquote(line[i:end])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid quoted string %s: %s", line[i:end], err)
+			}
+			tokens = append(tokens, s)
+			i = end
+		default:
+			start := i
+			for i < len(line) && !isTokenEnd(line, i) {
+				i++
+			}
+			tokens = append(tokens, line[start:i])
+		}
+	}
+
+	return tokens, nil, nil
+}
+
+// quotedEnd returns the index just past the closing quote for the quoted
+// string starting at i, or -1 if there is no closing quote.
+func quotedEnd(line string, i int) int {
+	q := line[i]
+	for j := i + 1; j < len(line); j++ {
+		switch {
+		case q == '"' && line[j] == '\\':
+			j++
+		case line[j] == q:
+			return j + 1
+		}
+	}
+	return -1
+}
+
+func isTokenEnd(line string, i int) bool {
+	return strings.IndexByte(" \t\r()[],\"`", line[i]) != -1 ||
+		strings.HasPrefix(line[i:], "//") ||
+		strings.HasPrefix(line[i:], "=>")
+}
@@ -0,0 +1,99 @@
+package gomod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const goMod = `// Deprecated: use example.com/new/v3 instead.
+//
+// This module is no longer maintained.
+module "example.com/old/v2"
+
+go 1.12
+
+toolchain go1.21.0
+
+require (
+	github.com/pkg/errors v0.8.1
+	golang.org/x/text v0.3.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect; used by tests
+)
+
+require github.com/stretchr/testify v1.3.0
+
+replace github.com/pkg/errors => ../errors
+
+replace (
+	golang.org/x/text v0.3.0 => github.com/golang/text v0.3.2
+	gopkg.in/yaml.v2 => gopkg.in/yaml.v2 v2.2.4
+)
+
+exclude github.com/stretchr/testify v1.2.0
+
+// Published too early.
+retract v2.0.0
+
+retract (
+	// Contains a data race.
+	[v2.1.0, v2.1.5]
+	v2.2.0 // Accidentally tagged.
+)
+`
+
+func TestParse(t *testing.T) {
+	f, err := Parse([]byte(goMod))
+	assert.Nil(t, err, "no error parsing go.mod")
+
+	assert.Equal(t, "example.com/old/v2", f.Module, "quoted module path")
+	assert.Equal(t, "use example.com/new/v3 instead.", f.Deprecated, "deprecation is the paragraph after Deprecated:")
+	assert.Equal(t, "1.12", f.Go, "go directive")
+
+	assert.Equal(t, []*Require{
+		{Path: "github.com/pkg/errors", Version: "v0.8.1"},
+		{Path: "golang.org/x/text", Version: "v0.3.0", Indirect: true},
+		{Path: "gopkg.in/yaml.v2", Version: "v2.2.2", Indirect: true},
+		{Path: "github.com/stretchr/testify", Version: "v1.3.0"},
+	}, f.Require, "require directives")
+
+	assert.Equal(t, []*Replace{
+		{OldPath: "github.com/pkg/errors", NewPath: "../errors"},
+		{OldPath: "golang.org/x/text", OldVersion: "v0.3.0", NewPath: "github.com/golang/text", NewVersion: "v0.3.2"},
+		{OldPath: "gopkg.in/yaml.v2", NewPath: "gopkg.in/yaml.v2", NewVersion: "v2.2.4"},
+	}, f.Replace, "replace directives")
+
+	assert.Equal(t, []*Version{
+		{Path: "github.com/stretchr/testify", Version: "v1.2.0"},
+	}, f.Exclude, "exclude directives")
+
+	assert.Equal(t, []*Retract{
+		{Low: "v2.0.0", High: "v2.0.0", Rationale: "Published too early."},
+		{Low: "v2.1.0", High: "v2.1.5", Rationale: "Contains a data race."},
+		{Low: "v2.2.0", High: "v2.2.0", Rationale: "Accidentally tagged."},
+	}, f.Retract, "retract directives")
+}
+
+func TestParseMinimal(t *testing.T) {
+	f, err := Parse([]byte("module github.com/foo/bar\n"))
+	assert.Nil(t, err, "no error parsing a go.mod with just a module directive")
+	assert.Equal(t, "github.com/foo/bar", f.Module, "module path")
+	assert.Equal(t, "", f.Deprecated, "not deprecated")
+	assert.Empty(t, f.Require, "no requires")
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := map[string]string{
+		"no module":        "go 1.12\n",
+		"unterminated":     "module foo\nrequire (\n\tbar v1.0.0\n",
+		"bad require":      "module foo\nrequire bar\n",
+		"bad replace":      "module foo\nreplace bar v1.0.0\n",
+		"bad retract":      "module foo\nretract [v1.0.0 v1.2.0]\n",
+		"unterminated str": "module \"foo\n",
+	}
+
+	for name, content := range bad {
+		_, err := Parse([]byte(content))
+		assert.NotNil(t, err, "error for %s", name)
+	}
+}
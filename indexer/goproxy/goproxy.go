@@ -0,0 +1,335 @@
+// Package goproxy is a client for the GOPROXY protocol described at
+// https://golang.org/cmd/go/#hdr-Module_proxy_protocol, along with the
+// index feed served by index.golang.org. The proxy can be any server that
+// speaks the protocol, such as proxy.golang.org or Athens, or a file:// URL
+// pointing at a directory laid out the same way.
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// ErrNotFound is returned when the proxy does not know about the requested
+// module or version.
+var ErrNotFound = errors.New("Not found on the module proxy")
+
+// Info is the JSON document returned for /@v/<version>.info.
+type Info struct {
+	Version string
+	Time    time.Time
+	Origin  *Origin `json:",omitempty"`
+}
+
+// Origin is included in the info for some versions by newer proxies. It tells
+// us where the module version came from.
+type Origin struct {
+	VCS  string
+	URL  string
+	Ref  string
+	Hash string
+}
+
+// IndexEntry is one line of the index feed.
+type IndexEntry struct {
+	Path      string
+	Version   string
+	Timestamp time.Time
+}
+
+type Client struct {
+	proxy *url.URL
+	index string
+	http  *http.Client
+	ctx   context.Context
+}
+
+// New returns a client for the given proxy URL. The index URL may be empty,
+// in which case Index will return an error. For a file:// proxy you can use
+// Modules instead to find all the modules the proxy contains.
+func New(proxy, index string, ctx context.Context) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(proxy, "/"))
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse the proxy URL %s: {{err}}", proxy), err)
+	}
+	if u.Scheme != "file" && u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("The proxy URL must be a file, http, or https URL, not %s", proxy)
+	}
+
+	return &Client{
+		proxy: u,
+		index: index,
+		http:  &http.Client{Timeout: time.Duration(5) * time.Minute},
+		ctx:   ctx,
+	}, nil
+}
+
+// URL returns the proxy's base URL.
+func (c *Client) URL() string {
+	return c.proxy.String()
+}
+
+// Namespace returns the proxy's URL without its scheme, like
+// "proxy.golang.org" or "/srv/goproxy" for a file:// proxy.
+func (c *Client) Namespace() string {
+	return c.proxy.Host + c.proxy.Path
+}
+
+// ModuleFor returns the module path for a URL under the proxy's URL. For
+// example, https://proxy.golang.org/golang.org/x/text is golang.org/x/text.
+// Anything after the module path, like "/@v/list", is ignored, and the path
+// may be escaped or not. It returns false if the URL isn't under the proxy's
+// URL. This never makes a request to the proxy.
+func (c *Client) ModuleFor(u *url.URL) (string, bool) {
+	if u.Scheme != c.proxy.Scheme || u.Host != c.proxy.Host {
+		return "", false
+	}
+	base := strings.TrimSuffix(c.proxy.Path, "/") + "/"
+	if !strings.HasPrefix(u.Path, base) {
+		return "", false
+	}
+
+	module := strings.TrimPrefix(u.Path, base)
+	if i := strings.Index(module, "/@"); i != -1 {
+		module = module[:i]
+	}
+	module = strings.Trim(module, "/")
+	if module == "" {
+		return "", false
+	}
+
+	if unescaped, err := UnescapePath(module); err == nil {
+		module = unescaped
+	}
+	return module, true
+}
+
+// List returns the tagged versions the proxy knows about for the module.
+// Pseudo-versions are never included.
+func (c *Client) List(module string) ([]string, error) {
+	b, err := c.get(module, "@v/list", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(b)), nil
+}
+
+// Info returns the version info for a single version of the module.
+func (c *Client) Info(module, version string) (*Info, error) {
+	b, err := c.get(module, "@v/"+version, ".info")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseInfo(module, b)
+}
+
+// Latest returns the version info for the latest version of the module. Not
+// all proxies implement this, so ErrNotFound may mean either that the module
+// is unknown or that the proxy doesn't support this endpoint.
+func (c *Client) Latest(module string) (*Info, error) {
+	b, err := c.get(module, "@latest", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseInfo(module, b)
+}
+
+func parseInfo(module string, b []byte) (*Info, error) {
+	i := &Info{}
+	err := json.Unmarshal(b, i)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse the version info for %s: {{err}}", module), err)
+	}
+	return i, nil
+}
+
+// Mod returns the go.mod file for a version of the module.
+func (c *Client) Mod(module, version string) ([]byte, error) {
+	return c.get(module, "@v/"+version, ".mod")
+}
+
+// Zip returns the zip file containing the source for a version of the
+// module.
+func (c *Client) Zip(module, version string) ([]byte, error) {
+	return c.get(module, "@v/"+version, ".zip")
+}
+
+// The version (if any) needs to be escaped just like the module path, so
+// the caller passes the part of the URL that needs escaping and the file
+// extension separately.
+func (c *Client) get(module, path, ext string) ([]byte, error) {
+	escaped, err := EscapePath(module)
+	if err != nil {
+		return nil, err
+	}
+	escapedPath, err := EscapePath(path)
+	if err != nil {
+		return nil, err
+	}
+	suffix := escapedPath + ext
+
+	if c.proxy.Scheme == "file" {
+		p := filepath.Join(filepath.FromSlash(c.proxy.Path), filepath.FromSlash(escaped), filepath.FromSlash(suffix))
+		b, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return b, err
+	}
+
+	return c.fetch(fmt.Sprintf("%s/%s/%s", c.proxy, escaped, suffix))
+}
+
+func (c *Client) fetch(u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Error fetching %s: {{err}}", u), err)
+	}
+	defer resp.Body.Close()
+
+	// The protocol says that both 404 and 410 mean that the proxy has
+	// nothing to serve for the request.
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching %s returned an unexpected status: %s", u, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Index returns up to limit entries from the index feed that were added at or
+// after since. The entries are returned in the order the feed gives us, which
+// is oldest first.
+func (c *Client) Index(since time.Time, limit int) ([]*IndexEntry, error) {
+	if c.index == "" {
+		return nil, errors.New("This client was not given an index URL")
+	}
+
+	u := fmt.Sprintf("%s?since=%s&limit=%d", c.index, since.UTC().Format(time.RFC3339Nano), limit)
+	b, err := c.fetch(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*IndexEntry
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		e := &IndexEntry{}
+		err := json.Unmarshal(line, e)
+		if err != nil {
+			return nil, errwrap.Wrapf("Could not parse an index entry: {{err}}", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, s.Err()
+}
+
+// Modules returns the path of every module in a file:// proxy. It does this
+// by looking for directories named "@v".
+func (c *Client) Modules() ([]string, error) {
+	if c.proxy.Scheme != "file" {
+		return nil, fmt.Errorf("Cannot list all the modules in %s, only for a file:// proxy", c.proxy)
+	}
+
+	root := filepath.FromSlash(c.proxy.Path)
+	var modules []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || info.Name() != "@v" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		m, err := UnescapePath(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		modules = append(modules, m)
+
+		return filepath.SkipDir
+	})
+
+	return modules, err
+}
+
+// EscapePath escapes a module path or version the way the go command does
+// for proxy URLs and the module cache. Every uppercase letter is replaced by
+// an exclamation mark followed by the letter's lowercase equivalent.
+func EscapePath(p string) (string, error) {
+	var buf bytes.Buffer
+	for _, r := range p {
+		if r == '!' || r >= utf8.RuneSelf {
+			return "", fmt.Errorf("Invalid character in module path %q", p)
+		}
+		if unicode.IsUpper(r) {
+			buf.WriteByte('!')
+			buf.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String(), nil
+}
+
+// UnescapePath reverses EscapePath.
+func UnescapePath(escaped string) (string, error) {
+	var buf bytes.Buffer
+	bang := false
+	for _, r := range escaped {
+		if r >= utf8.RuneSelf || unicode.IsUpper(r) {
+			return "", fmt.Errorf("Invalid character in escaped module path %q", escaped)
+		}
+		if bang {
+			if !unicode.IsLower(r) {
+				return "", fmt.Errorf("Invalid escape sequence in module path %q", escaped)
+			}
+			buf.WriteRune(unicode.ToUpper(r))
+			bang = false
+			continue
+		}
+		if r == '!' {
+			bang = true
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	if bang {
+		return "", fmt.Errorf("Module path %q ends with an unterminated escape", escaped)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,170 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapePath(t *testing.T) {
+	tests := map[string]string{
+		"golang.org/x/text":                 "golang.org/x/text",
+		"github.com/Azure/azure-sdk-for-go": "github.com/!azure/azure-sdk-for-go",
+		"github.com/BurntSushi/toml":        "github.com/!burnt!sushi/toml",
+		"v1.0.0-RC1":                        "v1.0.0-!r!c1",
+	}
+
+	for p, expect := range tests {
+		escaped, err := EscapePath(p)
+		assert.Nil(t, err, "no error escaping %s", p)
+		assert.Equal(t, expect, escaped, "escaped %s", p)
+
+		unescaped, err := UnescapePath(escaped)
+		assert.Nil(t, err, "no error unescaping %s", escaped)
+		assert.Equal(t, p, unescaped, "round trip for %s", p)
+	}
+
+	_, err := EscapePath("github.com/foo!/bar")
+	assert.NotNil(t, err, "a path containing ! cannot be escaped")
+
+	for _, bad := range []string{"github.com/Foo/bar", "github.com/!/bar", "github.com/foo!"} {
+		_, err := UnescapePath(bad)
+		assert.NotNil(t, err, "cannot unescape %s", bad)
+	}
+}
+
+func TestFileProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := filepath.Join(dir, "github.com", "!foo", "bar", "@v")
+	err = os.MkdirAll(v, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(v, "list"), "v1.0.0\nv1.1.0\n")
+	write(t, filepath.Join(v, "v1.1.0.info"), `{"Version":"v1.1.0","Time":"2018-06-01T12:00:00Z"}`)
+	write(t, filepath.Join(v, "v1.1.0.mod"), "module github.com/Foo/bar\n")
+
+	c, err := New("file://"+dir, "", context.Background())
+	assert.Nil(t, err, "no error from New")
+
+	versions, err := c.List("github.com/Foo/bar")
+	assert.Nil(t, err, "no error from List")
+	assert.Equal(t, []string{"v1.0.0", "v1.1.0"}, versions, "List")
+
+	info, err := c.Info("github.com/Foo/bar", "v1.1.0")
+	assert.Nil(t, err, "no error from Info")
+	assert.Equal(t, "v1.1.0", info.Version, "Info.Version")
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), info.Time.UTC(), "Info.Time")
+
+	mod, err := c.Mod("github.com/Foo/bar", "v1.1.0")
+	assert.Nil(t, err, "no error from Mod")
+	assert.Equal(t, "module github.com/Foo/bar\n", string(mod), "Mod")
+
+	_, err = c.Info("github.com/Foo/bar", "v2.0.0")
+	assert.Equal(t, ErrNotFound, err, "Info for an unknown version")
+
+	modules, err := c.Modules()
+	assert.Nil(t, err, "no error from Modules")
+	assert.Equal(t, []string{"github.com/Foo/bar"}, modules, "Modules")
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var sinces []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/proxy/golang.org/x/text/@v/list":
+			fmt.Fprint(w, "v0.3.0\n")
+		case "/proxy/golang.org/x/text/@latest":
+			fmt.Fprint(w, `{"Version":"v0.3.0","Time":"2018-06-01T12:00:00Z","Origin":{"VCS":"git","Hash":"abc"}}`)
+		case "/index":
+			sinces = append(sinces, r.URL.Query().Get("since"))
+			fmt.Fprintln(w, `{"Path":"golang.org/x/text","Version":"v0.3.0","Timestamp":"2019-04-10T19:08:52.997264Z"}`)
+			fmt.Fprintln(w, `{"Path":"golang.org/x/net","Version":"v0.1.0","Timestamp":"2019-04-10T19:09:00Z"}`)
+		case "/proxy/gone.example.com/mod/@v/list":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c, err := New(s.URL+"/proxy/", s.URL+"/index", context.Background())
+	assert.Nil(t, err, "no error from New")
+
+	versions, err := c.List("golang.org/x/text")
+	assert.Nil(t, err, "no error from List")
+	assert.Equal(t, []string{"v0.3.0"}, versions, "List")
+
+	latest, err := c.Latest("golang.org/x/text")
+	assert.Nil(t, err, "no error from Latest")
+	assert.Equal(t, "abc", latest.Origin.Hash, "Latest includes the origin")
+
+	_, err = c.List("gone.example.com/mod")
+	assert.Equal(t, ErrNotFound, err, "410 is treated as not found")
+
+	_, err = c.List("nope.example.com/mod")
+	assert.Equal(t, ErrNotFound, err, "404 is treated as not found")
+
+	since := time.Date(2019, 4, 10, 0, 0, 0, 0, time.UTC)
+	entries, err := c.Index(since, 10)
+	assert.Nil(t, err, "no error from Index")
+	assert.Equal(t, []string{"2019-04-10T00:00:00Z"}, sinces, "since was passed to the index")
+	assert.Len(t, entries, 2, "got two index entries")
+	assert.Equal(t, "golang.org/x/net", entries[1].Path, "second entry path")
+
+	_, err = c.Modules()
+	assert.NotNil(t, err, "cannot list all the modules for an http proxy")
+}
+
+func TestModuleFor(t *testing.T) {
+	c, err := New("https://proxy.example.com/go/", "", context.Background())
+	assert.Nil(t, err, "no error from New")
+	assert.Equal(t, "proxy.example.com/go", c.Namespace(), "Namespace")
+
+	tests := map[string]string{
+		"https://proxy.example.com/go/golang.org/x/text":             "golang.org/x/text",
+		"https://proxy.example.com/go/golang.org/x/text/":            "golang.org/x/text",
+		"https://proxy.example.com/go/github.com/!foo/bar/@v/list":   "github.com/Foo/bar",
+		"https://proxy.example.com/go/github.com/Foo/bar/@v/v1.0.0":  "github.com/Foo/bar",
+		"https://proxy.example.com/go/github.com/foo/bar/v2/@latest": "github.com/foo/bar/v2",
+	}
+	for raw, expect := range tests {
+		u, _ := url.Parse(raw)
+		module, ok := c.ModuleFor(u)
+		assert.True(t, ok, "%s is under the proxy", raw)
+		assert.Equal(t, expect, module, "module for %s", raw)
+	}
+
+	for _, raw := range []string{
+		"https://github.com/golang/text",
+		"http://proxy.example.com/go/golang.org/x/text",
+		"https://proxy.example.com/golang.org/x/text",
+		"https://proxy.example.com/go/",
+		"https://git.internal/team/repo",
+	} {
+		u, _ := url.Parse(raw)
+		_, ok := c.ModuleFor(u)
+		assert.False(t, ok, "%s is not under the proxy", raw)
+	}
+}
+
+func write(t *testing.T, path, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
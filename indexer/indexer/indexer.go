@@ -2,15 +2,25 @@ package indexer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/autarch/metagodoc/elc"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/clonecache"
 	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
 	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/skiplist"
+	"github.com/autarch/metagodoc/indexer/vanity"
 	"github.com/autarch/metagodoc/logger"
 
 	"github.com/hako/durafmt"
@@ -19,15 +29,64 @@ import (
 )
 
 type NewParams struct {
-	Logger       *logger.Logger
-	GitHubToken  string
+	Logger      *logger.Logger
+	GitHubToken string
+	// Which GitHub searches to run, like "created,pushed". If this is empty
+	// we run all of them.
+	GitHubSearch string
+	GitRemotes   []string
+	GoProxy      string
+	GoProxyIndex string
+	GoPaths      []string
 	CacheRoot    string
 	TraceElastic bool
+	// The number of repositories to index at once.
+	Workers int
+	// The number of repositories from a single host to index at once.
+	ClonesPerHost int
+	// The number of repositories that can be waiting for a worker before
+	// the crawlers are made to wait.
+	QueueSize int
+	// The number of times to retry a repository that fails to index before
+	// moving it to the dead letter index.
+	MaxRetries int
+	// The path to the skip list file. If this is empty we use
+	// skiplist.Default.
+	SkipList string
+	// Which version tags to index, like "latest-patch". If this is empty
+	// we index every tag.
+	TagRetention string
+	// How to clone a repository we haven't seen before: "full", "shallow",
+	// or "blobless". If this is empty we make full clones.
+	CloneMode string
+	// The limits for the clone cache. Zero means no limit.
+	CloneCacheMaxBytes int64
+	CloneCacheMaxRepos int
+	// How long a single clone or fetch may run.
+	GitTimeout time.Duration
+	// The limit for the parse cache. Zero means no limit.
+	ParseCacheMaxBytes int64
+	// A file listing repositories to index, or "-" to read the list from
+	// stdin. See crawler.NewSeedCrawler.
+	SeedFile string
+	// How many levels of imports the dependency spider follows from the
+	// repositories found by other crawlers. Zero disables the spider.
+	SpiderDepth int
+	// The import path prefixes the spider may follow, like "github.com" or
+	// "github.com/example". If this is empty it follows every import.
+	SpiderAllow []string
 }
 
 type crawlers struct {
+	// Every crawler, whatever state it is in.
+	all       []crawler.Crawler
 	available []crawler.Crawler
 	sleeping  map[crawler.Crawler]time.Time
+	// The last cursor we saw from each Resumable crawler.
+	cursors map[crawler.Crawler]string
+	// This gets a value whenever a crawler is put to sleep.
+	slept chan struct{}
+	mutex sync.Mutex
 }
 
 type Indexer struct {
@@ -35,7 +94,26 @@ type Indexer struct {
 	elastic     *elastic.Client
 	cacheRoot   string
 	githubToken string
+	githubModes []crawler.GitHubMode
+	seedFile    string
+	spiderDepth int
+	spiderAllow []string
+	spider      crawler.Spider
+	gitRemotes  []string
+	goProxy     string
+	goProxyIdx  string
+	goPaths     []string
+	resolver    *vanity.Resolver
+	limiter     *ratelimit.Limiter
+	skipList    *skiplist.List
+	retention   repository.Retention
+	parseCache  *parsecache.Cache
+	clones      *clonecache.Cache
 	crawlers    crawlers
+	queue       *workQueue
+	workers     int
+	retries     retries
+	crawled     crawlTimes
 	ctx         context.Context
 	err         error
 }
@@ -61,27 +139,145 @@ func New(p NewParams) *Indexer {
 		return &Indexer{err: fmt.Errorf("The root that was passed, %s, is not a directory", p.CacheRoot)}
 	}
 
+	skip, err := skiplist.New(p.Logger, p.SkipList)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	retention, err := repository.ParseRetention(p.TagRetention)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	mode, err := clonecache.ParseMode(p.CloneMode)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	githubModes, err := crawler.ParseGitHubModes(p.GitHubSearch)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
+	pc, err := parsecache.New(p.Logger, p.CacheRoot, p.ParseCacheMaxBytes)
+	if err != nil {
+		return &Indexer{err: err}
+	}
+
 	c := context.Background()
 	idx := &Indexer{
 		l:           p.Logger,
 		elastic:     el,
 		cacheRoot:   p.CacheRoot,
 		githubToken: p.GitHubToken,
-		ctx:         c,
+		githubModes: githubModes,
+		seedFile:    p.SeedFile,
+		spiderDepth: p.SpiderDepth,
+		spiderAllow: p.SpiderAllow,
+		gitRemotes:  p.GitRemotes,
+		goProxy:     p.GoProxy,
+		goProxyIdx:  p.GoProxyIndex,
+		goPaths:     p.GoPaths,
+		resolver:    vanity.NewResolver(false, c),
+		limiter:     ratelimit.New(p.Logger),
+		skipList:    skip,
+		retention:   retention,
+		parseCache:  pc,
+		clones: clonecache.New(p.Logger, p.CacheRoot, mode, clonecache.Limits{
+			MaxBytes: p.CloneCacheMaxBytes,
+			MaxRepos: p.CloneCacheMaxRepos,
+		}, p.GitTimeout),
+		crawlers: crawlers{
+			sleeping: make(map[crawler.Crawler]time.Time),
+			cursors:  make(map[crawler.Crawler]string),
+			slept:    make(chan struct{}, 1),
+		},
+		queue:   newWorkQueue(p.Logger, atLeastOne(p.QueueSize), atLeastOne(p.ClonesPerHost)),
+		workers: atLeastOne(p.Workers),
+		retries: newRetries(p.MaxRetries),
+		crawled: crawlTimes{times: make(map[string]time.Time)},
+		ctx:     c,
 	}
 
 	idx.setCrawlers()
+	if idx.err != nil {
+		return idx
+	}
+
+	idx.err = idx.loadState()
 
 	return idx
 }
 
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// The order of the crawlers matters when we index a single URL. The first
+// crawler that can crawl the URL wins, so the generic git crawler needs to
+// come after anything more specific.
 func (idx *Indexer) setCrawlers() {
-	gh, err := crawler.NewGitHubCrawler(idx.l, idx.cacheRoot, idx.githubToken, idx.ctx)
+	if idx.githubToken != "" {
+		for _, m := range idx.githubModes {
+			gh, err := crawler.NewGitHubCrawler(idx.l, m, idx.clones, idx.githubToken, idx.limiter, idx.resolver, idx.retention, idx.parseCache, idx.ctx)
+			if err != nil {
+				idx.err = err
+				return
+			}
+			idx.crawlers.available = append(idx.crawlers.available, gh)
+		}
+	} else {
+		idx.l.Info("No GitHub token was provided so the GitHub crawler is disabled")
+	}
+
+	if idx.goProxy != "" {
+		p, err := crawler.NewProxyCrawler(idx.l, idx.cacheRoot, idx.goProxy, idx.goProxyIdx, idx.retention, idx.ctx)
+		if err != nil {
+			idx.err = err
+			return
+		}
+		idx.crawlers.available = append(idx.crawlers.available, p)
+	}
+
+	if len(idx.goPaths) > 0 {
+		lc, err := crawler.NewLocalCrawler(idx.l, idx.goPaths, idx.ctx)
+		if err != nil {
+			idx.err = err
+			return
+		}
+		idx.crawlers.available = append(idx.crawlers.available, lc)
+	}
+
+	g, err := crawler.NewGitCrawler(idx.l, idx.clones, idx.gitRemotes, idx.resolver, idx.retention, idx.parseCache, idx.ctx)
 	if err != nil {
 		idx.err = err
 		return
 	}
-	idx.crawlers.available = append(idx.crawlers.available, gh)
+	idx.crawlers.available = append(idx.crawlers.available, g)
+
+	if idx.seedFile != "" {
+		s, err := crawler.NewSeedCrawler(idx.l, idx.seedFile, idx.lookupURL, idx.ctx)
+		if err != nil {
+			idx.err = err
+			return
+		}
+		idx.crawlers.available = append(idx.crawlers.available, s)
+	}
+
+	if idx.spiderDepth > 0 {
+		s, err := crawler.NewSpiderCrawler(idx.l, idx.resolver, idx.spiderAllow, idx.spiderDepth, idx.crawlerFor, idx.isIndexed, idx.ctx)
+		if err != nil {
+			idx.err = err
+			return
+		}
+		idx.spider = s
+		idx.crawlers.available = append(idx.crawlers.available, s)
+	}
+
+	idx.crawlers.all = idx.crawlers.available
 }
 
 func (idx *Indexer) IndexAll() error {
@@ -91,6 +287,8 @@ func (idx *Indexer) IndexAll() error {
 
 	ch := make(chan *crawler.Result)
 	defer close(ch)
+	idx.startWorkers(ch)
+	go idx.handleResults(ch)
 	for true {
 		idx.loop(ch)
 	}
@@ -98,44 +296,298 @@ func (idx *Indexer) IndexAll() error {
 	return nil
 }
 
+// IndexURLs indexes each of the given repositories exactly once and then
+// returns. Each URL is handed to the first crawler that knows how to crawl
+// it. A URL without a scheme, like "github.com/owner/name", is treated as an
+// https URL, except for git's scp-like "user@host:path" syntax, which is
+// treated as an ssh URL. An error is returned if any of the repositories
+// could not be indexed, but we always try to index all of them. A repository
+// that is skipped, for example because it is on the skip list or its crawler
+// decided not to index it, is reported but is not an error.
+func (idx *Indexer) IndexURLs(urls []string) error {
+	if idx.err != nil {
+		return idx.err
+	}
+
+	failed, skipped := 0, 0
+	for _, raw := range urls {
+		indexed, err := idx.indexURL(raw)
+		if err != nil {
+			idx.l.Errorf("Could not index %s: %s", raw, err)
+			failed++
+			continue
+		}
+		if !indexed {
+			skipped++
+		}
+	}
+
+	if skipped > 0 {
+		idx.l.Infof("Skipped %d of %d repositories", skipped, len(urls))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories could not be indexed", failed, len(urls))
+	}
+
+	if idx.spider != nil {
+		failed = idx.indexSpiderResults()
+		if failed > 0 {
+			return fmt.Errorf("%d of the dependencies of %d repositories could not be indexed", failed, len(urls))
+		}
+	}
+
+	return nil
+}
+
+// indexSpiderResults indexes the dependencies that the spider found while we
+// indexed the URLs we were given, then their dependencies, and so on until
+// the spider doesn't find anything new. It returns the number of
+// dependencies that could not be indexed.
+func (idx *Indexer) indexSpiderResults() int {
+	failed := 0
+	for {
+		ch := make(chan *crawler.Result)
+		go func() {
+			idx.spider.CrawlAll(ch)
+			close(ch)
+		}()
+
+		found := 0
+		for r := range ch {
+			if r.Exhausted {
+				continue
+			}
+			found++
+			err := r.Error
+			if err == nil {
+				err = idx.indexRepo(r.Crawler, r.Repository)
+			}
+			if err != nil {
+				idx.l.Errorf("Could not index a dependency: %s", err)
+				failed++
+			}
+		}
+
+		if found == 0 {
+			return failed
+		}
+	}
+}
+
+// indexURL returns false if the repository was skipped rather than indexed.
+func (idx *Indexer) indexURL(raw string) (bool, error) {
+	c, u, err := idx.lookupURL(raw)
+	if err != nil {
+		return false, err
+	}
+
+	idx.l.Infof("Crawling %s with the %s crawler", u, c.Name())
+	repo, err := idx.crawlOne(c, u)
+	if err != nil {
+		return false, err
+	}
+	// We get nil for a repository that is gone or that the crawler decided
+	// not to index.
+	if repo == nil {
+		idx.l.Infof("Skipped %s, the %s crawler did not return a repository to index", raw, c.Name())
+		return false, nil
+	}
+	if reason, ok := idx.skipList.Match(repo.ID()); ok {
+		idx.l.Infof("Skipped %s, %s is on the skip list: %s", raw, repo.ID(), reason)
+		return false, nil
+	}
+
+	return true, idx.indexRepo(c, repo)
+}
+
+// lookupURL turns a repository URL or import path into the URL to crawl and
+// finds the crawler for it.
+func (idx *Indexer) lookupURL(raw string) (crawler.Crawler, *url.URL, error) {
+	u, err := parseRepoURL(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	u = idx.resolveVanityURL(u)
+
+	c := idx.crawlerFor(u)
+	if c == nil {
+		return nil, nil, fmt.Errorf("None of the available crawlers can crawl %s", u)
+	}
+	return c, u, nil
+}
+
+var scpLikeURLRE = regexp.MustCompile(`^([^@/]+@[^:/]+):(.+)$`)
+
+func parseRepoURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		// git accepts "user@host:path" as a shorthand for an ssh URL.
+		if m := scpLikeURLRE.FindStringSubmatch(raw); m != nil {
+			raw = fmt.Sprintf("ssh://%s/%s", m[1], m[2])
+		} else if strings.HasPrefix(raw, "/") {
+			// So does a path to a repository on local disk.
+			raw = "file://" + raw
+		} else {
+			raw = "https://" + raw
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse %s as a URL: {{err}}", raw), err)
+	}
+
+	return u, nil
+}
+
+// resolveVanityURL checks whether an http or https URL is a vanity import
+// path like "golang.org/x/text". If it is, we return the URL of the
+// repository it points to. Otherwise we return the URL unchanged.
+func (idx *Indexer) resolveVanityURL(u *url.URL) *url.URL {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return u
+	}
+
+	importPath := u.Host + strings.TrimSuffix(u.Path, "/")
+	m, err := idx.resolver.Resolve(importPath)
+	if err != nil || m.Prefix != importPath || m.VCS != "git" {
+		return u
+	}
+
+	repoURL, err := url.Parse(m.RepoURL)
+	if err != nil || repoURL.Host+strings.TrimSuffix(repoURL.Path, ".git") == importPath {
+		return u
+	}
+
+	idx.l.Infof("%s is a vanity import path for %s", importPath, repoURL)
+	return repoURL
+}
+
+func (idx *Indexer) crawlerFor(u *url.URL) crawler.Crawler {
+	for _, c := range idx.crawlers.all {
+		if c.CanCrawl(u) {
+			return c
+		}
+	}
+	return nil
+}
+
 func (idx *Indexer) loop(ch chan *crawler.Result) {
 	idx.maybeWakeCrawlers()
 
-	if len(idx.crawlers.available) == 0 {
+	available := idx.takeAvailableCrawlers()
+	if len(available) == 0 {
 		until := idx.untilNextWake()
 		idx.l.Infof("Sleeping for %s", durafmt.Parse(until))
-		time.Sleep(until)
+		idx.logStatus()
+		// A crawler that finishes while we sleep may need to wake up before
+		// the time we calculated, so we recalculate whenever that happens.
+		select {
+		case <-time.After(until):
+		case <-idx.crawlers.slept:
+		}
+		return
 	}
 
-	available := idx.crawlers.available
-	idx.crawlers.available = []crawler.Crawler{}
 	idx.l.Info("Starting all available crawlers")
 	for _, c := range available {
 		idx.l.Infof("Starting %s crawler", c.Name())
-		go c.CrawlAll(ch)
+		go func(c crawler.Crawler) {
+			c.CrawlAll(ch)
+			idx.putCrawlerToSleep(c)
+		}(c)
 	}
+}
 
-	// We want result handling in its own goroutine so we can wake up sleeping
-	// crawlers on time without waiting for a result from the channel.
-	go func() {
-		for r := range ch {
-			idx.l.Infof("Got a result from the %s crawler", r.Crawler.Name())
-			if r.Error != nil {
-				if r.Exhausted {
-					idx.putCrawlerToSleep(r.Crawler)
-				} else {
-					idx.l.Infof("%s crawler returned an error: %s", r.Crawler.Name(), r.Error)
-					idx.putCrawlerToSleep(r.Crawler)
+// handleResults reads results from every crawler and queues the repositories
+// for the index workers. This runs in its own goroutine for as long as the
+// indexer runs so that the main loop can wake up sleeping crawlers on time
+// without waiting for a result from the channel.
+func (idx *Indexer) handleResults(ch chan *crawler.Result) {
+	for r := range ch {
+		idx.l.Infof("Got a result from the %s crawler", r.Crawler.Name())
+		if r.Cursor != "" && r.Cursor != idx.crawlerCursor(r.Crawler) {
+			idx.setCrawlerCursor(r.Crawler, r.Cursor)
+			idx.saveCrawlerState(r.Crawler)
+		}
+
+		if r.Error != nil {
+			// A result with a repository and an error comes from an index
+			// worker that failed to index the repository.
+			if r.Repository != nil {
+				idx.retry(r)
+				continue
+			}
+			if gone := repository.IsGone(r.Error); gone != nil {
+				err := idx.buryCrawled(r.Error, gone)
+				if err != nil {
+					idx.l.Errorf("%s", err)
 				}
 				continue
 			}
+			idx.l.Infof("%s crawler returned an error: %s", r.Crawler.Name(), r.Error)
+			continue
+		}
+		// The crawler is put to sleep when CrawlAll returns, so there's
+		// nothing else to do for this.
+		if r.Exhausted {
+			continue
+		}
+		if idx.crawledRecently(r.Crawler, r.Repository) {
+			continue
+		}
+
+		idx.queue.enqueue(&job{crawler: r.Crawler, repo: r.Repository})
+	}
+}
+
+func (idx *Indexer) startWorkers(ch chan *crawler.Result) {
+	idx.l.Infof("Starting %d index workers", idx.workers)
+	for i := 0; i < idx.workers; i++ {
+		go idx.work(ch)
+	}
+}
 
-			go idx.indexRepo(r.Repository)
+// work indexes repositories from the queue for as long as the indexer runs. A
+// failure is sent back to handleResults as a result with an error so that it
+// can be retried.
+func (idx *Indexer) work(ch chan *crawler.Result) {
+	for {
+		j := idx.queue.next()
+		if j.repo == nil {
+			err := idx.crawlJob(j)
+			if err != nil {
+				idx.l.Errorf("Could not crawl %s: %s", j.url, err)
+			}
+			if j.repo == nil {
+				idx.queue.done(j)
+				continue
+			}
 		}
-	}()
+
+		err := idx.indexRepo(j.crawler, j.repo)
+		idx.queue.done(j)
+
+		if err == nil {
+			idx.succeeded(j.repo)
+			continue
+		}
+
+		idx.l.Errorf("Error indexing %s: %s", j.repo.ID(), err)
+		// handleResults may be blocked waiting to add a job to the queue,
+		// so we can't wait for it to read this.
+		go func(r *crawler.Result) { ch <- r }(&crawler.Result{
+			Crawler:    j.crawler,
+			Repository: j.repo,
+			Error:      err,
+		})
+	}
 }
 
 func (idx *Indexer) maybeWakeCrawlers() {
+	idx.crawlers.mutex.Lock()
+	defer idx.crawlers.mutex.Unlock()
+
 	now := time.Now()
 	for c, t := range idx.crawlers.sleeping {
 		if t.After(now) {
@@ -147,7 +599,22 @@ func (idx *Indexer) maybeWakeCrawlers() {
 	}
 }
 
+// takeAvailableCrawlers empties the list of available crawlers and returns
+// what was in it. A crawler that has been taken is running until it is put
+// to sleep.
+func (idx *Indexer) takeAvailableCrawlers() []crawler.Crawler {
+	idx.crawlers.mutex.Lock()
+	defer idx.crawlers.mutex.Unlock()
+
+	available := idx.crawlers.available
+	idx.crawlers.available = nil
+	return available
+}
+
 func (idx *Indexer) untilNextWake() time.Duration {
+	idx.crawlers.mutex.Lock()
+	defer idx.crawlers.mutex.Unlock()
+
 	var durs []time.Duration
 	now := time.Now()
 	for _, t := range idx.crawlers.sleeping {
@@ -155,7 +622,7 @@ func (idx *Indexer) untilNextWake() time.Duration {
 	}
 
 	// If there are no crawlers sleeping that means all crawlers are currently
-	// available. We will sleep for a minute and then try again.
+	// running. We will sleep for a minute and then try again.
 	if len(durs) == 0 {
 		return time.Duration(1) * time.Minute
 	}
@@ -173,51 +640,193 @@ func (idx *Indexer) putCrawlerToSleep(c crawler.Crawler) {
 		wake.Format("2006-01-02 15:04:05"),
 	)
 
-	var available []crawler.Crawler
-	for _, a := range idx.crawlers.available {
-		if c == a {
-			idx.crawlers.sleeping[a] = wake
-			continue
-		}
-		available = append(available, a)
+	idx.crawlers.mutex.Lock()
+	idx.crawlers.sleeping[c] = wake
+	idx.crawlers.mutex.Unlock()
+
+	// Let the main loop know that it may need to recalculate how long to
+	// sleep. If there's already a notification pending that's good enough.
+	select {
+	case idx.crawlers.slept <- struct{}{}:
+	default:
 	}
 
-	idx.crawlers.available = available
+	idx.saveCrawlerState(c)
+}
+
+func (idx *Indexer) crawlerCursor(c crawler.Crawler) string {
+	idx.crawlers.mutex.Lock()
+	defer idx.crawlers.mutex.Unlock()
+	return idx.crawlers.cursors[c]
+}
+
+func (idx *Indexer) setCrawlerCursor(c crawler.Crawler, cursor string) {
+	idx.crawlers.mutex.Lock()
+	defer idx.crawlers.mutex.Unlock()
+	idx.crawlers.cursors[c] = cursor
 }
 
-func (idx *Indexer) indexRepo(repo repository.Repository) {
+func (idx *Indexer) indexRepo(c crawler.Crawler, repo repository.Repository) error {
 	// Repo is being intentionally skipped.
 	if repo == nil {
-		return
+		return nil
+	}
+	if reason, ok := idx.skipList.Match(repo.ID()); ok {
+		idx.l.Infof("  %s is on the skip list: %s", repo.ID(), reason)
+		return nil
 	}
 
-	exists, err := idx.elastic.
-		Exists().
-		Index("metagodoc-repository").
-		Type("repository").
-		Id(repo.ID()).
-		Do(idx.ctx)
+	previous, err := idx.previousModel(repo)
 	if err != nil {
-		idx.l.Panicf("Exists: %s", err)
+		return idx.recordFailure(c, repo, loadStage, err)
 	}
 
 	elURI := fmt.Sprintf("http://localhost:9200/metagodoc-repository/repository/%s", url.PathEscape(repo.ID()))
-	if exists {
+	if previous != nil {
 		idx.l.Infof("  already exists at %s?pretty", elURI)
 	} else {
 		idx.l.Infof("  did not find any repo where the ID is %s", repo.ID())
 	}
 
+	pw := idx.newPackageWriter(repo)
+	model, err := buildModel(repo, previous, pw)
+	if err == repository.ErrOptedOut {
+		return idx.removeRepository(repo, previous != nil)
+	}
+	if gone := repository.IsGone(err); gone != nil {
+		return idx.buryRepository(repo.ID(), previous != nil, gone)
+	}
+	if err != nil {
+		return idx.recordFailure(c, repo, unknownStage, err)
+	}
+	err = pw.finish(model)
+	if err != nil {
+		return idx.recordFailure(c, repo, storeStage, err)
+	}
+
+	moved, err := idx.findMovedRepositories(model, previous)
+	if err != nil {
+		return idx.recordFailure(c, repo, storeStage, err)
+	}
+
 	_, err = idx.elastic.
 		Index().
 		Index("metagodoc-repository").
 		Type("repository").
 		Id(repo.ID()).
-		BodyJson(repo.ESModel()).
+		BodyJson(model).
 		Do(idx.ctx)
 	if err != nil {
-		idx.l.Panicf("Index: %s", err)
+		return idx.recordFailure(c, repo, storeStage, errwrap.Wrapf("Index: {{err}}", err))
 	}
 
 	idx.l.Infof("  made new repository record at %s?pretty", elURI)
+
+	idx.deleteMovedRepositories(model, moved)
+	if previous == nil {
+		idx.removeTombstone(repo.ID())
+	}
+
+	err = idx.deleteStalePackages(repo, model)
+	if err != nil {
+		// The new document doesn't refer to any of these, so they're just
+		// wasting space until the next crawl deletes them.
+		idx.l.Errorf("%s", err)
+	}
+	idx.recordCrawl(c, repo)
+
+	if idx.spider != nil {
+		idx.spider.Discover(repo.ID(), pw.dependencies())
+	}
+
+	return nil
+}
+
+// isIndexed reports whether we have a document for the repository. If we
+// can't tell we say no, since indexing a repository twice does no harm.
+func (idx *Indexer) isIndexed(id string) bool {
+	exists, err := idx.elastic.
+		Exists().
+		Index("metagodoc-repository").
+		Type("repository").
+		Id(id).
+		Do(idx.ctx)
+	if err != nil {
+		idx.l.Errorf("Could not check whether %s is indexed: %s", id, err)
+		return false
+	}
+	return exists
+}
+
+// removeRepository deletes the document for a repository whose owners have
+// opted out of indexing.
+func (idx *Indexer) removeRepository(repo repository.Repository, exists bool) error {
+	if !exists {
+		idx.l.Infof("  %s has opted out of indexing and was never indexed", repo.ID())
+		return nil
+	}
+
+	err := idx.deleteRepository(repo.ID())
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not delete %s after it opted out of indexing: {{err}}", repo.ID()), err)
+	}
+
+	idx.l.Infof("  %s has opted out of indexing, deleted its document", repo.ID())
+	return nil
+}
+
+// deleteRepository deletes the document and packages for a repository. It
+// is not an error if there's nothing to delete.
+func (idx *Indexer) deleteRepository(id string) error {
+	_, err := idx.elastic.
+		Delete().
+		Index("metagodoc-repository").
+		Type("repository").
+		Id(id).
+		Do(idx.ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errwrap.Wrapf("Delete: {{err}}", err)
+	}
+	return idx.deleteAllPackages(id)
+}
+
+// buildModel turns a panic into an error. We don't panic on errors ourselves
+// but the doc package and the libraries it uses might on unexpected input.
+// One bad repository shouldn't stop the indexer.
+func buildModel(repo repository.Repository, previous *esmodels.Repository, sink repository.PackageSink) (model *esmodels.Repository, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while indexing %s: %v", repo.ID(), r)
+		}
+	}()
+	return repo.ESModel(previous, sink)
+}
+
+// previousModel returns the document we stored the last time we indexed the
+// repository, or nil if we've never indexed it. The repository uses this to
+// skip refs that haven't changed.
+func (idx *Indexer) previousModel(repo repository.Repository) (*esmodels.Repository, error) {
+	result, err := idx.elastic.
+		Get().
+		Index("metagodoc-repository").
+		Type("repository").
+		Id(repo.ID()).
+		Do(idx.ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errwrap.Wrapf("Get: {{err}}", err)
+	}
+	if !result.Found || result.Source == nil {
+		return nil, nil
+	}
+
+	previous := &esmodels.Repository{}
+	err = json.Unmarshal(*result.Source, previous)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not unmarshal the stored document for %s: {{err}}", repo.ID()), err)
+	}
+
+	return previous, nil
 }
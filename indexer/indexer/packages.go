@@ -0,0 +1,222 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/repository"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// Every package is stored as its own document in this index. See
+// esmodels.ESPackage.
+const (
+	packageIndex = "metagodoc-package"
+	packageType  = "package"
+)
+
+// We send the packages we've buffered to Elasticsearch once we have this many
+// of them or they add up to this many bytes of JSON, whichever comes first.
+// Whoever is putting packages waits while we do that, which is what keeps the
+// memory we use for a repository bounded no matter how big it is.
+const (
+	maxBulkActions = 500
+	maxBulkBytes   = 5 * 1024 * 1024
+)
+
+// packageWriter is the repository.PackageSink that the indexer gives to
+// ESModel. It stores packages in bulk requests, tagging each one with the
+// generation of the crawl. It is safe to use from multiple goroutines.
+type packageWriter struct {
+	idx        *Indexer
+	repo       string
+	generation string
+
+	bulk    *elastic.BulkService
+	bytes   int
+	written int
+	// The import paths of the packages we've put and of everything they
+	// import. These are only collected when the dependency spider is on.
+	own     map[string]bool
+	imports map[string]bool
+	mutex   sync.Mutex
+}
+
+func (idx *Indexer) newPackageWriter(repo repository.Repository) *packageWriter {
+	pw := &packageWriter{
+		idx:        idx,
+		repo:       repo.ID(),
+		generation: strconv.FormatInt(time.Now().UnixNano(), 10),
+		bulk:       idx.elastic.Bulk().Index(packageIndex).Type(packageType),
+	}
+	if idx.spider != nil {
+		pw.own = make(map[string]bool)
+		pw.imports = make(map[string]bool)
+	}
+	return pw
+}
+
+// Put implements repository.PackageSink.
+func (pw *packageWriter) Put(ref, dir string, p *esmodels.Package) error {
+	doc, err := json.Marshal(&esmodels.ESPackage{
+		Repository: pw.repo,
+		Ref:        ref,
+		Generation: pw.generation,
+		Dir:        dir,
+		Package:    p,
+	})
+	if err != nil {
+		return pw.error(ref, errwrap.Wrapf(fmt.Sprintf("Could not marshal the package in %s: {{err}}", dir), err))
+	}
+
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if pw.imports != nil {
+		pw.own[p.ImportPath] = true
+		for _, imports := range [][]string{p.Imports, p.TestImports, p.XTestImports} {
+			for _, i := range imports {
+				pw.imports[i] = true
+			}
+		}
+	}
+
+	pw.bulk.Add(
+		elastic.NewBulkIndexRequest().
+			Id(esmodels.PackageID(pw.repo, ref, pw.generation, dir)).
+			Doc(json.RawMessage(doc)),
+	)
+	pw.bytes += len(doc)
+
+	if pw.bulk.NumberOfActions() < maxBulkActions && pw.bytes < maxBulkBytes {
+		return nil
+	}
+	return pw.error(ref, pw.flushLocked())
+}
+
+// flush sends any packages that are still buffered.
+func (pw *packageWriter) flush() error {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	return pw.flushLocked()
+}
+
+func (pw *packageWriter) flushLocked() error {
+	n := pw.bulk.NumberOfActions()
+	if n == 0 {
+		return nil
+	}
+
+	resp, err := pw.bulk.Do(pw.idx.ctx)
+	if err != nil {
+		return errwrap.Wrapf("Bulk: {{err}}", err)
+	}
+	if failed := resp.Failed(); len(failed) > 0 {
+		reason := "unknown error"
+		if failed[0].Error != nil {
+			reason = failed[0].Error.Reason
+		}
+		return fmt.Errorf("Could not store %d of %d packages, the first one because: %s", len(failed), n, reason)
+	}
+
+	pw.written += n
+	pw.bytes = 0
+	return nil
+}
+
+func (pw *packageWriter) error(ref string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &repository.Error{
+		Repository: pw.repo,
+		Ref:        ref,
+		Stage:      storeStage,
+		Err:        err,
+	}
+}
+
+// finish flushes the remaining packages and gives every ref we just built
+// this crawl's generation. Refs that were reused from the previous document
+// keep the generation they already had, since their packages weren't put
+// again.
+func (pw *packageWriter) finish(model *esmodels.Repository) error {
+	err := pw.flush()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range model.Refs {
+		if r.Generation == "" {
+			r.Generation = pw.generation
+		}
+	}
+
+	pw.idx.l.Infof("  stored %d packages in %s", pw.written, packageIndex)
+	return nil
+}
+
+// dependencies returns the import paths that the packages we've put import
+// from outside the repository.
+func (pw *packageWriter) dependencies() []string {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	var deps []string
+	for i := range pw.imports {
+		if !pw.own[i] {
+			deps = append(deps, i)
+		}
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// deleteStalePackages removes every package of the repository that doesn't
+// belong to the current generation of one of its refs. That covers refs
+// that have gone away, refs that were rebuilt, and anything left behind by a
+// crawl that failed part way through. This is only done once the new
+// repository document is stored, so there is never a time when the document
+// refers to packages that don't exist.
+func (idx *Indexer) deleteStalePackages(repo repository.Repository, model *esmodels.Repository) error {
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("repository", repo.ID()))
+	for _, r := range model.Refs {
+		q.MustNot(
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("ref", r.Name),
+				elastic.NewTermQuery("generation", r.Generation),
+			),
+		)
+	}
+	return idx.deletePackages(repo.ID(), q)
+}
+
+// deleteAllPackages removes every package of the repository with the given
+// ID.
+func (idx *Indexer) deleteAllPackages(id string) error {
+	return idx.deletePackages(id, elastic.NewTermQuery("repository", id))
+}
+
+func (idx *Indexer) deletePackages(id string, q elastic.Query) error {
+	resp, err := idx.elastic.
+		DeleteByQuery(packageIndex).
+		Type(packageType).
+		Query(q).
+		ProceedOnVersionConflict().
+		Do(idx.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not delete old packages for %s: {{err}}", id), err)
+	}
+
+	if resp.Deleted > 0 {
+		idx.l.Infof("  deleted %d old packages", resp.Deleted)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package indexer
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+)
+
+// A job is a repository waiting to be indexed, along with the crawler that
+// found it.
+type job struct {
+	crawler crawler.Crawler
+	repo    repository.Repository
+	// A job from a webhook only has the URL of the repository until a
+	// worker crawls it. See Indexer.crawlJob.
+	url string
+	// The refs that changed. If this is empty every ref is rebuilt.
+	refs []string
+}
+
+// id returns the repository ID. For a job that hasn't been crawled yet this
+// is the host and path of its URL, which is what the GitHub and git
+// crawlers use. We keep using that once the job is crawled so that the queue
+// always knows the job by the same ID.
+func (j *job) id() string {
+	if j.url == "" {
+		return j.repo.ID()
+	}
+	id := j.url
+	if i := strings.Index(id, "://"); i != -1 {
+		id = id[i+len("://"):]
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(id, "/"), ".git")
+}
+
+// addRefs adds the refs from another job for the same repository. If either
+// job rebuilds every ref then so does this one.
+func (j *job) addRefs(other *job) {
+	if len(j.refs) == 0 || len(other.refs) == 0 {
+		j.refs = nil
+		return
+	}
+	for _, r := range other.refs {
+		if !hasString(j.refs, r) {
+			j.refs = append(j.refs, r)
+		}
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// workQueue feeds repositories from the crawlers to a fixed number of index
+// workers. The queue is bounded so when the workers fall behind enqueue
+// blocks. That blocks the goroutine reading crawler results, which in turn
+// blocks the crawlers, since they send their results on an unbuffered
+// channel.
+type workQueue struct {
+	l    *logger.Logger
+	size int
+	// Jobs waiting for a worker, oldest first.
+	jobs []*job
+	// Jobs in here are taken before anything in jobs. These are
+	// repositories that we know have just changed.
+	urgent []*job
+
+	// The IDs of every repository that is queued or being indexed. We use
+	// this to make sure we never index the same repository twice at once.
+	inFlight map[string]bool
+	// Urgent jobs for repositories that were in flight when they were
+	// queued. Each one is queued again once its repository is done, since
+	// the change may have happened after we started indexing it.
+	again map[string]*job
+
+	// The number of repositories from each host that are being indexed.
+	// Indexing a repository is what clones or fetches it, so perHost is
+	// also a limit on concurrent clones from a host.
+	busy    map[string]int
+	perHost int
+
+	mutex sync.Mutex
+	// This is broadcast whenever a job is added or taken and whenever a
+	// job is done, since any of those can let a waiting goroutine go on.
+	changed *sync.Cond
+}
+
+func newWorkQueue(l *logger.Logger, size, perHost int) *workQueue {
+	q := &workQueue{
+		l:        l,
+		size:     size,
+		inFlight: make(map[string]bool),
+		again:    make(map[string]*job),
+		busy:     make(map[string]int),
+		perHost:  perHost,
+	}
+	q.changed = sync.NewCond(&q.mutex)
+	return q
+}
+
+// enqueue adds a job to the queue unless the same repository is already
+// queued or being indexed, in which case it returns false. This blocks while
+// the queue is full.
+func (q *workQueue) enqueue(j *job) bool {
+	id := j.id()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.inFlight[id] {
+		q.l.Infof("%s is already queued for indexing, skipping it", id)
+		return false
+	}
+	q.inFlight[id] = true
+
+	if len(q.jobs) >= q.size {
+		q.l.Infof("The index queue is full, waiting for a worker to take a job before adding %s", id)
+	}
+	for len(q.jobs) >= q.size {
+		q.changed.Wait()
+	}
+	q.jobs = append(q.jobs, j)
+	q.changed.Broadcast()
+	return true
+}
+
+// enqueueUrgent adds a job that will be taken before any job added with
+// enqueue. If the same repository is already waiting in the urgent queue the
+// job's refs are added to that job. If it is being indexed or waiting in the
+// normal queue this returns false and the job is queued again once that is
+// done. This never blocks, since it's called while GitHub waits for us to
+// respond to a webhook. If the queue of urgent jobs is full the job is
+// dropped and this returns false. One of the crawlers will get to the
+// repository eventually.
+func (q *workQueue) enqueueUrgent(j *job) bool {
+	id := j.id()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.inFlight[id] {
+		for _, u := range q.urgent {
+			if u.id() == id {
+				u.addRefs(j)
+				q.l.Infof("%s is already waiting to be indexed", id)
+				return false
+			}
+		}
+		if again, ok := q.again[id]; ok {
+			again.addRefs(j)
+		} else {
+			q.again[id] = j
+		}
+		q.l.Infof("%s is already queued for indexing, it will be indexed again once that is done", id)
+		return false
+	}
+	if len(q.urgent) >= q.size {
+		q.l.Infof("There are already %d urgent jobs in the index queue, dropping %s", len(q.urgent), id)
+		return false
+	}
+	q.inFlight[id] = true
+
+	q.urgent = append(q.urgent, j)
+	q.changed.Broadcast()
+	return true
+}
+
+// next returns the next job whose host has room for another repository,
+// preferring urgent jobs. A job for a host that is at its limit stays where
+// it is, so a run of jobs for one host doesn't keep the workers from
+// indexing repositories from other hosts. This blocks until there is a job
+// we can take. The caller must call done with the job once it has been
+// indexed.
+func (q *workQueue) next() *job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		if j := q.takeLocked(&q.urgent); j != nil {
+			return j
+		}
+		if j := q.takeLocked(&q.jobs); j != nil {
+			return j
+		}
+		q.changed.Wait()
+	}
+}
+
+// takeLocked removes and returns the first job in the list whose host has
+// room, or nil if there isn't one. The mutex must be held.
+func (q *workQueue) takeLocked(jobs *[]*job) *job {
+	for i, j := range *jobs {
+		host := repositoryHost(j.id())
+		if q.busy[host] >= q.perHost {
+			continue
+		}
+
+		q.busy[host]++
+		*jobs = append((*jobs)[:i], (*jobs)[i+1:]...)
+		q.changed.Broadcast()
+		return j
+	}
+	return nil
+}
+
+// done releases the job's host and marks its repository as no longer in
+// flight, unless an urgent job for it came in while it was, in which case
+// that job is queued.
+func (q *workQueue) done(j *job) {
+	id := j.id()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.busy[repositoryHost(id)]--
+	delete(q.inFlight, id)
+	if again, ok := q.again[id]; ok {
+		delete(q.again, id)
+		q.inFlight[id] = true
+		q.urgent = append(q.urgent, again)
+	}
+	q.changed.Broadcast()
+}
+
+// queued returns the number of jobs waiting for a worker and the number of
+// repositories that are queued or being indexed.
+func (q *workQueue) queued() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.jobs) + len(q.urgent), len(q.inFlight)
+}
+
+// repositoryHost returns the host part of a repository ID, for example
+// "github.com" for "github.com/stretchr/testify".
+func repositoryHost(id string) string {
+	return strings.SplitN(id, "/", 2)[0]
+}
@@ -0,0 +1,124 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRepo struct {
+	id string
+}
+
+func (r *fakeRepo) ESModel(*esmodels.Repository, repository.PackageSink) (*esmodels.Repository, error) {
+	return nil, nil
+}
+func (r *fakeRepo) ID() string { return r.id }
+
+func (r *fakeRepo) CrawlURL() string { return "https://" + r.id }
+
+func TestWorkQueue(t *testing.T) {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newWorkQueue(l, 2, 1)
+
+	a := &job{repo: &fakeRepo{"github.com/a/a"}}
+	assert.True(t, q.enqueue(a), "first job is queued")
+	assert.False(t, q.enqueue(&job{repo: &fakeRepo{"github.com/a/a"}}), "same repo is not queued twice")
+	assert.True(t, q.enqueue(&job{repo: &fakeRepo{"github.com/b/b"}}), "another repo is queued")
+
+	queued := make(chan bool)
+	go func() {
+		queued <- q.enqueue(&job{repo: &fakeRepo{"github.com/c/c"}})
+	}()
+	select {
+	case <-queued:
+		t.Fatal("enqueue did not block when the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, a, q.next(), "jobs come out in order")
+	assert.True(t, <-queued, "enqueue finished once there was room")
+
+	assert.False(t, q.enqueue(&job{repo: &fakeRepo{"github.com/a/a"}}), "a repo being indexed is not queued again")
+	q.done(a)
+	q.next()
+	assert.True(t, q.enqueue(&job{repo: &fakeRepo{"github.com/a/a"}}), "a repo can be queued again once it is done")
+}
+
+func TestWorkQueueHostLimit(t *testing.T) {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newWorkQueue(l, 10, 2)
+
+	a := &job{repo: &fakeRepo{"github.com/a/a"}}
+	b := &job{repo: &fakeRepo{"github.com/b/b"}}
+	c := &job{repo: &fakeRepo{"github.com/c/c"}}
+	d := &job{repo: &fakeRepo{"github.com/d/d"}}
+	other := &job{repo: &fakeRepo{"gitlab.com/e/e"}}
+	for _, j := range []*job{a, b, c, d, other} {
+		q.enqueue(j)
+	}
+
+	assert.Equal(t, a, q.next(), "first github.com job")
+	assert.Equal(t, b, q.next(), "second github.com job")
+	assert.Equal(t, other, q.next(), "github.com is saturated so the gitlab.com job is taken next")
+
+	taken := make(chan *job)
+	go func() { taken <- q.next() }()
+	select {
+	case <-taken:
+		t.Fatal("took a job for a host that was at its limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.done(a)
+	assert.Equal(t, c, <-taken, "took the next github.com job once the host had room")
+	q.done(b)
+	assert.Equal(t, d, q.next(), "and the one after that")
+
+	assert.Equal(t, "github.com", repositoryHost("github.com/stretchr/testify"), "host of a repository ID")
+}
+
+func TestWorkQueueUrgent(t *testing.T) {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newWorkQueue(l, 10, 2)
+
+	a := &job{repo: &fakeRepo{"github.com/a/a"}}
+	b := &job{repo: &fakeRepo{"github.com/b/b"}}
+	assert.True(t, q.enqueue(a), "normal job is queued")
+	assert.True(t, q.enqueueUrgent(b), "urgent job is queued")
+
+	assert.Equal(t, b, q.next(), "urgent jobs come out first")
+	assert.Equal(t, a, q.next(), "then normal jobs")
+
+	again := &job{repo: &fakeRepo{"github.com/a/a"}}
+	assert.False(t, q.enqueueUrgent(again), "a repo being indexed is not queued right away")
+	q.done(a)
+	assert.Equal(t, again, q.next(), "but it is queued once the repo is done")
+	q.done(again)
+	q.done(b)
+	assert.Empty(t, q.inFlight, "nothing is in flight")
+
+	w := &job{url: "https://github.com/c/c", refs: []string{"master"}}
+	assert.Equal(t, "github.com/c/c", w.id(), "a job from a webhook is known by its URL")
+	assert.True(t, q.enqueueUrgent(w), "job from a webhook is queued")
+	assert.False(t, q.enqueueUrgent(&job{url: "https://github.com/c/c", refs: []string{"v1.0.0"}}), "a second event for the same repo is not queued")
+	assert.False(t, q.enqueueUrgent(&job{url: "https://github.com/c/c", refs: []string{"master"}}), "nor is a third")
+	assert.Equal(t, w, q.next(), "the first job is taken")
+	assert.Equal(t, []string{"master", "v1.0.0"}, w.refs, "with the refs from every event")
+	q.done(w)
+	assert.Empty(t, q.again, "nothing is queued again")
+}
@@ -0,0 +1,279 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/repository"
+
+	"github.com/hako/durafmt"
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// Repositories that keep failing are moved to this index. See
+// esmodels.DeadLetter.
+const (
+	deadLetterIndex = "metagodoc-dead_letter"
+	deadLetterType  = "dead_letter"
+)
+
+// The delay before the first retry. This doubles with each retry up to
+// retryMaxDelay.
+const (
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// failure tracks a repository that has failed to index at least once since
+// it last succeeded.
+type failure struct {
+	attempts int
+	first    time.Time
+}
+
+// retries holds every repository that is waiting to be retried.
+type retries struct {
+	// The most times we retry a repository before moving it to the dead
+	// letter index.
+	max      int
+	failures map[string]*failure
+	rand     *rand.Rand
+	mutex    sync.Mutex
+}
+
+func newRetries(max int) retries {
+	return retries{
+		max:      max,
+		failures: make(map[string]*failure),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// retryDelay returns how long to wait before retrying a repository that has
+// failed the given number of times. We pick a random delay between half and
+// all of the backoff so that a batch of repositories that failed together,
+// for example because Elasticsearch was down, aren't all retried at the same
+// moment.
+func retryDelay(attempts int, r *rand.Rand) time.Duration {
+	backoff := retryBaseDelay
+	for i := 1; i < attempts && backoff < retryMaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+
+	half := backoff / 2
+	return half + time.Duration(r.Int63n(int64(half)+1))
+}
+
+// retry is called by handleResults for every result that has both a
+// repository and an error. If the repository has been retried too many
+// times we move it to the dead letter index. Otherwise we queue it again
+// after a delay.
+func (idx *Indexer) retry(r *crawler.Result) {
+	id := r.Repository.ID()
+
+	idx.retries.mutex.Lock()
+	f := idx.retries.failures[id]
+	if f == nil {
+		f = &failure{first: time.Now()}
+		idx.retries.failures[id] = f
+	}
+	f.attempts++
+	attempts := f.attempts
+	first := f.first
+	dead := attempts > idx.retries.max
+	var delay time.Duration
+	if dead {
+		delete(idx.retries.failures, id)
+	} else {
+		delay = retryDelay(attempts, idx.retries.rand)
+	}
+	idx.retries.mutex.Unlock()
+
+	if dead {
+		idx.l.Errorf("%s failed %d times, moving it to the dead letter index: %s", id, attempts, r.Error)
+		idx.saveDeadLetter(r, attempts, first)
+		return
+	}
+
+	idx.l.Infof("%s failed (attempt %d of %d), retrying in %s: %s", id, attempts, idx.retries.max+1, durafmt.Parse(delay), r.Error)
+	j := &job{crawler: r.Crawler, repo: r.Repository}
+	// enqueue can block, so this needs its own goroutine, which AfterFunc
+	// gives us.
+	time.AfterFunc(delay, func() { idx.queue.enqueue(j) })
+}
+
+// succeeded forgets any earlier failures for the repository.
+func (idx *Indexer) succeeded(repo repository.Repository) {
+	idx.retries.mutex.Lock()
+	delete(idx.retries.failures, repo.ID())
+	idx.retries.mutex.Unlock()
+}
+
+func (idx *Indexer) saveDeadLetter(r *crawler.Result, attempts int, first time.Time) {
+	dl := &esmodels.DeadLetter{
+		Repository:  r.Repository.ID(),
+		URL:         r.Repository.CrawlURL(),
+		Crawler:     r.Crawler.Name(),
+		Attempts:    attempts,
+		Stage:       string(unknownStage),
+		Error:       r.Error.Error(),
+		FirstFailed: first.UTC().Format(esmodels.DateTimeFormat),
+		LastFailed:  time.Now().UTC().Format(esmodels.DateTimeFormat),
+	}
+	if re, ok := r.Error.(*repository.Error); ok {
+		dl.Stage = string(re.Stage)
+	}
+
+	_, err := idx.elastic.
+		Index().
+		Index(deadLetterIndex).
+		Type(deadLetterType).
+		Id(dl.Repository).
+		BodyJson(dl).
+		Do(idx.ctx)
+	if err != nil {
+		idx.l.Errorf("Could not save the dead letter for %s: %s", dl.Repository, err)
+	}
+}
+
+// DeadLetters returns every repository in the dead letter index, most
+// recently failed first.
+func (idx *Indexer) DeadLetters() ([]*esmodels.DeadLetter, error) {
+	if idx.err != nil {
+		return nil, idx.err
+	}
+
+	var dls []*esmodels.DeadLetter
+	scroll := idx.elastic.
+		Scroll(deadLetterIndex).
+		Type(deadLetterType).
+		Sort("last_failed", false).
+		Size(100)
+	defer scroll.Clear(idx.ctx)
+	for {
+		result, err := scroll.Do(idx.ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if elastic.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, errwrap.Wrapf("Could not get the dead letters: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			dl := &esmodels.DeadLetter{}
+			err := json.Unmarshal(*hit.Source, dl)
+			if err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("Could not unmarshal the dead letter for %s: {{err}}", hit.Id), err)
+			}
+			dls = append(dls, dl)
+		}
+	}
+
+	return dls, nil
+}
+
+// Requeue indexes the dead letter repositories with the given IDs, or every
+// dead letter repository if no IDs are given. Each repository is crawled
+// again from the URL it was crawled from, preferring the crawler that found
+// it originally. A repository that indexes successfully is removed from the
+// dead letter index. An error is returned if any of the repositories could
+// not be indexed, but we always try to index all of them.
+func (idx *Indexer) Requeue(ids []string) error {
+	dls, err := idx.DeadLetters()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	tried, failed := 0, 0
+	for _, dl := range dls {
+		if len(wanted) > 0 && !wanted[dl.Repository] {
+			continue
+		}
+		delete(wanted, dl.Repository)
+
+		tried++
+		err := idx.requeue(dl)
+		if err != nil {
+			idx.l.Errorf("Could not index %s: %s", dl.Repository, err)
+			failed++
+		}
+	}
+
+	for id := range wanted {
+		idx.l.Errorf("%s is not in the dead letter index", id)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories could not be requeued", failed, tried+len(wanted))
+	}
+	return nil
+}
+
+func (idx *Indexer) requeue(dl *esmodels.DeadLetter) error {
+	raw := dl.URL
+	if raw == "" {
+		raw = dl.Repository
+	}
+	u, err := parseRepoURL(raw)
+	if err != nil {
+		return err
+	}
+
+	c := idx.crawlerNamed(dl.Crawler, u)
+	if c == nil {
+		return fmt.Errorf("None of the available crawlers can crawl %s", u)
+	}
+
+	idx.l.Infof("Requeueing %s with the %s crawler", dl.Repository, c.Name())
+	repo, err := idx.crawlOne(c, u)
+	if err != nil {
+		return err
+	}
+
+	err = idx.indexRepo(c, repo)
+	if err != nil {
+		return err
+	}
+
+	_, err = idx.elastic.
+		Delete().
+		Index(deadLetterIndex).
+		Type(deadLetterType).
+		Id(dl.Repository).
+		Do(idx.ctx)
+	if err != nil {
+		return errwrap.Wrapf("Indexed the repository but could not remove its dead letter: {{err}}", err)
+	}
+	return nil
+}
+
+// crawlerNamed returns the crawler with the given name if it can crawl the
+// URL. Otherwise it returns whichever crawler would be used for the URL.
+func (idx *Indexer) crawlerNamed(name string, u *url.URL) crawler.Crawler {
+	for _, c := range idx.crawlers.all {
+		if c.Name() == name && c.CanCrawl(u) {
+			return c
+		}
+	}
+	return idx.crawlerFor(u)
+}
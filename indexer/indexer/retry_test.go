@@ -0,0 +1,24 @@
+package indexer
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDelay(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20; i++ {
+		d := retryDelay(1, r)
+		assert.True(t, d >= 15*time.Second && d <= 30*time.Second, "first retry is between half and all of the base delay, got %s", d)
+
+		d = retryDelay(3, r)
+		assert.True(t, d >= time.Minute && d <= 2*time.Minute, "third retry backs off to 4 times the base delay, got %s", d)
+
+		d = retryDelay(50, r)
+		assert.True(t, d >= 30*time.Minute && d <= time.Hour, "delay is capped at the max delay, got %s", d)
+	}
+}
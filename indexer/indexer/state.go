@@ -0,0 +1,255 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/repository"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// The crawl state lives in its own index so that it survives restarts and
+// deploys. See esmodels.CrawlState for what it contains.
+const (
+	stateIndex = "metagodoc-crawl_state"
+	stateType  = "crawl_state"
+)
+
+// Every failure to index a repository is saved in this index. See
+// esmodels.CrawlError.
+const (
+	errorIndex = "metagodoc-crawl_error"
+	errorType  = "crawl_error"
+)
+
+// These are the stages of indexing that happen in the indexer rather than
+// in the repository.
+const (
+	// Getting the document we stored last time.
+	loadStage repository.Stage = "load"
+	// Storing the new document.
+	storeStage repository.Stage = "store"
+	// Used for errors that don't say where they happened.
+	unknownStage repository.Stage = "unknown"
+)
+
+// crawlTimes holds the last time each repository was successfully crawled,
+// keyed by repository ID. It starts out with what loadState finds in the
+// state index.
+type crawlTimes struct {
+	times map[string]time.Time
+	mutex sync.Mutex
+}
+
+func crawlerStateID(c crawler.Crawler) string {
+	return "crawler:" + c.Name()
+}
+
+func repositoryStateID(repo repository.Repository) string {
+	return "repository:" + repo.ID()
+}
+
+// loadState restores each crawler's cursor and puts any crawler that was
+// asleep when we stopped back to sleep until its original wake time. It also
+// loads the last time each repository was crawled. If there is no saved
+// state, for example because the state index does not exist yet, every
+// crawler starts from the beginning.
+func (idx *Indexer) loadState() error {
+	result, err := idx.elastic.
+		Search().
+		Index(stateIndex).
+		Type(stateType).
+		Query(elastic.NewTermQuery("kind", string(esmodels.CrawlerState))).
+		Size(len(idx.crawlers.available)).
+		Do(idx.ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			idx.l.Infof("The %s index does not exist so there is no crawl state to restore", stateIndex)
+			return nil
+		}
+		return errwrap.Wrapf("Could not load the crawl state: {{err}}", err)
+	}
+	if result.Hits == nil {
+		return nil
+	}
+
+	states := make(map[string]*esmodels.CrawlState)
+	for _, hit := range result.Hits.Hits {
+		s := &esmodels.CrawlState{}
+		err := json.Unmarshal(*hit.Source, s)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("Could not unmarshal the crawl state in %s: {{err}}", hit.Id), err)
+		}
+		states[s.Crawler] = s
+	}
+
+	var available []crawler.Crawler
+	for _, c := range idx.crawlers.available {
+		s := states[c.Name()]
+		if s == nil {
+			available = append(available, c)
+			continue
+		}
+
+		if r, ok := c.(crawler.Resumable); ok && s.Cursor != "" {
+			err := r.Resume(s.Cursor)
+			if err != nil {
+				idx.l.Errorf("Could not resume the %s crawler from %s: %s", c.Name(), s.Cursor, err)
+			} else {
+				idx.l.Infof("Resuming the %s crawler from %s", c.Name(), s.Cursor)
+				idx.crawlers.cursors[c] = s.Cursor
+			}
+		}
+
+		wake, err := time.Parse(esmodels.DateTimeFormat, s.SleepUntil)
+		if err == nil && wake.After(time.Now()) {
+			idx.l.Infof("The %s crawler will stay asleep until %s", c.Name(), wake.Format("2006-01-02 15:04:05"))
+			idx.crawlers.sleeping[c] = wake
+			continue
+		}
+		available = append(available, c)
+	}
+	idx.crawlers.available = available
+
+	return idx.loadCrawlTimes()
+}
+
+// loadCrawlTimes loads the time that each repository was last crawled from
+// the repository documents that recordCrawl saves.
+func (idx *Indexer) loadCrawlTimes() error {
+	scroll := idx.elastic.
+		Scroll(stateIndex).
+		Type(stateType).
+		Query(elastic.NewTermQuery("kind", string(esmodels.RepositoryState))).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("repository", "last_crawled")).
+		Size(1000)
+	defer scroll.Clear(idx.ctx)
+
+	idx.crawled.mutex.Lock()
+	defer idx.crawled.mutex.Unlock()
+	for {
+		result, err := scroll.Do(idx.ctx)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errwrap.Wrapf("Could not load the repository crawl times: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			s := &esmodels.CrawlState{}
+			err := json.Unmarshal(*hit.Source, s)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("Could not unmarshal the crawl state in %s: {{err}}", hit.Id), err)
+			}
+			t, err := time.Parse(esmodels.DateTimeFormat, s.LastCrawled)
+			if err != nil {
+				continue
+			}
+			idx.crawled.times[s.Repository] = t
+		}
+	}
+
+	idx.l.Infof("Loaded the last crawl time of %d repositories", len(idx.crawled.times))
+	return nil
+}
+
+// crawledRecently reports whether the repository was crawled successfully
+// within the crawler's sleep duration. A crawler that is restarted goes
+// through all of its repositories again, and there's no point in indexing the
+// ones we only just indexed before the restart.
+func (idx *Indexer) crawledRecently(c crawler.Crawler, repo repository.Repository) bool {
+	idx.crawled.mutex.Lock()
+	last, ok := idx.crawled.times[repo.ID()]
+	idx.crawled.mutex.Unlock()
+	if !ok || time.Since(last) >= c.SleepDuration() {
+		return false
+	}
+
+	idx.l.Infof("  %s was crawled at %s, skipping it until the %s crawler's next pass", repo.ID(), last.Format("2006-01-02 15:04:05"), c.Name())
+	return true
+}
+
+// saveCrawlerState saves the crawler's last cursor and, if it is asleep, when
+// it will wake up.
+func (idx *Indexer) saveCrawlerState(c crawler.Crawler) {
+	idx.crawlers.mutex.Lock()
+	s := &esmodels.CrawlState{
+		Kind:    esmodels.CrawlerState,
+		Crawler: c.Name(),
+		Cursor:  idx.crawlers.cursors[c],
+	}
+	if wake, ok := idx.crawlers.sleeping[c]; ok {
+		s.SleepUntil = wake.UTC().Format(esmodels.DateTimeFormat)
+	}
+	idx.crawlers.mutex.Unlock()
+
+	idx.saveState(crawlerStateID(c), s)
+}
+
+// recordCrawl saves the time that a repository was successfully crawled.
+func (idx *Indexer) recordCrawl(c crawler.Crawler, repo repository.Repository) {
+	now := time.Now()
+	idx.crawled.mutex.Lock()
+	idx.crawled.times[repo.ID()] = now
+	idx.crawled.mutex.Unlock()
+
+	idx.saveState(repositoryStateID(repo), &esmodels.CrawlState{
+		Kind:        esmodels.RepositoryState,
+		Crawler:     c.Name(),
+		Repository:  repo.ID(),
+		LastCrawled: now.UTC().Format(esmodels.DateTimeFormat),
+	})
+}
+
+// saveState logs errors rather than returning them. Failing to save the state
+// only means that we might redo some work after a restart, which isn't a good
+// reason to stop indexing.
+func (idx *Indexer) saveState(id string, s *esmodels.CrawlState) {
+	_, err := idx.elastic.
+		Index().
+		Index(stateIndex).
+		Type(stateType).
+		Id(id).
+		BodyJson(s).
+		Do(idx.ctx)
+	if err != nil {
+		idx.l.Errorf("Could not save the crawl state for %s: %s", id, err)
+	}
+}
+
+// recordFailure saves a failure to index a repository and returns the error
+// it was given. If the error is a *repository.Error we use its stage and ref
+// instead of the stage we were given.
+func (idx *Indexer) recordFailure(c crawler.Crawler, repo repository.Repository, stage repository.Stage, err error) error {
+	ce := &esmodels.CrawlError{
+		Repository: repo.ID(),
+		Crawler:    c.Name(),
+		Stage:      string(stage),
+		Error:      err.Error(),
+		Timestamp:  time.Now().UTC().Format(esmodels.DateTimeFormat),
+	}
+	if re, ok := err.(*repository.Error); ok {
+		ce.Ref = re.Ref
+		ce.Stage = string(re.Stage)
+	}
+
+	_, saveErr := idx.elastic.
+		Index().
+		Index(errorIndex).
+		Type(errorType).
+		BodyJson(ce).
+		Do(idx.ctx)
+	if saveErr != nil {
+		idx.l.Errorf("Could not save the crawl error for %s: %s", repo.ID(), saveErr)
+	}
+
+	return err
+}
@@ -0,0 +1,80 @@
+package indexer
+
+import (
+	"time"
+
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/indexer/ratelimit"
+)
+
+// Status is a snapshot of what the indexer is doing.
+type Status struct {
+	Crawlers []CrawlerStatus
+	// The number of repositories waiting for a worker.
+	Queued int
+	// The number of repositories that are queued or being indexed.
+	InFlight int
+	// This is nil if there is no GitHub crawler.
+	GitHub *ratelimit.Status
+	// Lookups in the parse cache since the indexer started.
+	ParseCache parsecache.Stats
+}
+
+type CrawlerStatus struct {
+	Name string
+	// One of "available", "running", or "sleeping".
+	State string
+	// This is the zero time unless the crawler is sleeping.
+	WakeAt time.Time
+	Cursor string
+}
+
+func (idx *Indexer) Status() Status {
+	var s Status
+	s.Queued, s.InFlight = idx.queue.queued()
+
+	idx.crawlers.mutex.Lock()
+	available := make(map[string]bool)
+	for _, c := range idx.crawlers.available {
+		available[c.Name()] = true
+	}
+	for _, c := range idx.crawlers.all {
+		cs := CrawlerStatus{
+			Name:   c.Name(),
+			State:  "running",
+			Cursor: idx.crawlers.cursors[c],
+		}
+		if wake, ok := idx.crawlers.sleeping[c]; ok {
+			cs.State = "sleeping"
+			cs.WakeAt = wake
+		} else if available[c.Name()] {
+			cs.State = "available"
+		}
+		s.Crawlers = append(s.Crawlers, cs)
+	}
+	idx.crawlers.mutex.Unlock()
+
+	if idx.githubToken != "" {
+		gh := idx.limiter.Status()
+		s.GitHub = &gh
+	}
+	s.ParseCache = idx.parseCache.Stats()
+
+	return s
+}
+
+func (idx *Indexer) logStatus() {
+	s := idx.Status()
+	for _, c := range s.Crawlers {
+		if c.State == "sleeping" {
+			idx.l.Infof("  %s crawler is sleeping until %s", c.Name, c.WakeAt.Format("2006-01-02 15:04:05"))
+		} else {
+			idx.l.Infof("  %s crawler is %s", c.Name, c.State)
+		}
+	}
+	idx.l.Infof("  %d repositories queued, %d queued or being indexed", s.Queued, s.InFlight)
+	if s.GitHub != nil {
+		idx.l.Infof("  GitHub API budget: %s", s.GitHub)
+	}
+	idx.l.Infof("  parse cache: %s", s.ParseCache)
+}
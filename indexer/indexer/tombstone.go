@@ -0,0 +1,180 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/crawler"
+	"github.com/autarch/metagodoc/indexer/repository"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/olivere/elastic"
+)
+
+// Every repository that has gone away upstream gets a document in this index.
+// See esmodels.Tombstone.
+const (
+	tombstoneIndex = "metagodoc-tombstone"
+	tombstoneType  = "tombstone"
+)
+
+// crawlOne calls the crawler's CrawlOne. If the forge says the repository is
+// gone then we bury it and return nil for both the repository and the error.
+func (idx *Indexer) crawlOne(c crawler.Crawler, u *url.URL) (repository.Repository, error) {
+	repo, err := c.CrawlOne(u)
+	if gone := repository.IsGone(err); gone != nil {
+		return nil, idx.buryCrawled(err, gone)
+	}
+	return repo, err
+}
+
+// buryCrawled buries the repository that a crawler said was gone. The
+// crawler's error must be a *repository.Error so that we know which
+// repository it was.
+func (idx *Indexer) buryCrawled(err error, gone *repository.GoneError) error {
+	re, ok := err.(*repository.Error)
+	if !ok {
+		return err
+	}
+	return idx.buryRepository(re.Repository, idx.isIndexed(re.Repository), gone)
+}
+
+// buryRepository deletes the document and packages for a repository that no
+// longer exists upstream and leaves a tombstone in their place. There's
+// nothing to do if we never indexed the repository.
+func (idx *Indexer) buryRepository(id string, exists bool, gone *repository.GoneError) error {
+	if !exists {
+		idx.l.Infof("  %s is gone and was never indexed: %s", id, gone.Err)
+		return nil
+	}
+
+	err := idx.deleteRepository(id)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not delete %s after it went away: {{err}}", id), err)
+	}
+
+	_, err = idx.elastic.
+		Index().
+		Index(tombstoneIndex).
+		Type(tombstoneType).
+		Id(strings.ToLower(id)).
+		BodyJson(&esmodels.Tombstone{
+			Repository: id,
+			Reason:     gone.Err.Error(),
+			Removed:    time.Now().UTC().Format(esmodels.DateTimeFormat),
+		}).
+		Do(idx.ctx)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Deleted %s after it went away but could not leave a tombstone: {{err}}", id), err)
+	}
+
+	idx.l.Infof("  %s is gone, deleted its document: %s", id, gone.Err)
+	return nil
+}
+
+// removeTombstone removes the tombstone for a repository that has come back.
+func (idx *Indexer) removeTombstone(id string) {
+	_, err := idx.elastic.
+		Delete().
+		Index(tombstoneIndex).
+		Type(tombstoneType).
+		Id(strings.ToLower(id)).
+		Do(idx.ctx)
+	if err == nil {
+		idx.l.Infof("  %s has come back, removed its tombstone", id)
+		return
+	}
+	if !elastic.IsNotFound(err) {
+		idx.l.Errorf("Could not remove the tombstone for %s: %s", id, err)
+	}
+}
+
+// findMovedRepositories returns the documents for the repository that are
+// stored under other IDs. That happens when a repository is renamed or
+// transferred on GitHub, which we can tell because the forge ID stays the
+// same. GitHub also ignores case, so a GitHub repository could have been
+// indexed with different case if someone gave us a URL by hand. The old IDs
+// become aliases of the new one, along with any aliases they had.
+func (idx *Indexer) findMovedRepositories(model *esmodels.Repository, previous *esmodels.Repository) ([]*esmodels.Repository, error) {
+	model.LowerID = strings.ToLower(model.ID)
+	aliases := make(map[string]bool)
+	if previous != nil {
+		for _, a := range previous.Aliases {
+			aliases[a] = true
+		}
+	}
+
+	var same []elastic.Query
+	if model.ForgeID != "" {
+		same = append(same, elastic.NewTermQuery("forge_id", model.ForgeID))
+	}
+	if strings.HasPrefix(model.LowerID, "github.com/") {
+		same = append(same, elastic.NewTermQuery("lower_id", model.LowerID))
+	}
+
+	var moved []*esmodels.Repository
+	if len(same) > 0 {
+		result, err := idx.elastic.
+			Search().
+			Index("metagodoc-repository").
+			Type("repository").
+			Query(elastic.NewBoolQuery().
+				Should(same...).
+				MinimumNumberShouldMatch(1).
+				MustNot(elastic.NewIdsQuery("repository").Ids(model.ID))).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("id", "aliases")).
+			Size(100).
+			Do(idx.ctx)
+		if err != nil {
+			return nil, errwrap.Wrapf("Could not look for old copies of the repository: {{err}}", err)
+		}
+
+		for _, hit := range result.Hits.Hits {
+			old := &esmodels.Repository{}
+			err := json.Unmarshal(*hit.Source, old)
+			if err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("Could not unmarshal the stored document for %s: {{err}}", hit.Id), err)
+			}
+			// Documents stored before we recorded the ID in them only have
+			// it as the document ID.
+			old.ID = hit.Id
+			idx.l.Infof("  %s was previously indexed as %s", model.ID, old.ID)
+			moved = append(moved, old)
+			aliases[strings.ToLower(old.ID)] = true
+			for _, a := range old.Aliases {
+				aliases[a] = true
+			}
+		}
+	}
+
+	// A repository can be renamed back to an old name.
+	delete(aliases, model.LowerID)
+	model.Aliases = nil
+	for a := range aliases {
+		model.Aliases = append(model.Aliases, a)
+	}
+	sort.Strings(model.Aliases)
+
+	return moved, nil
+}
+
+// deleteMovedRepositories deletes the old copies of a repository that
+// findMovedRepositories found. This is done once the new document is stored
+// so that looking up an old ID always finds one or the other.
+func (idx *Indexer) deleteMovedRepositories(model *esmodels.Repository, moved []*esmodels.Repository) {
+	for _, old := range moved {
+		err := idx.deleteRepository(old.ID)
+		if err != nil {
+			// The old document will be found again the next time this
+			// repository is indexed.
+			idx.l.Errorf("Could not delete %s after it moved to %s: %s", old.ID, model.ID, err)
+			continue
+		}
+		idx.l.Infof("  deleted %s, which is now an alias of %s", old.ID, model.ID)
+	}
+}
@@ -0,0 +1,42 @@
+package indexer
+
+import (
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/indexer/webhook"
+)
+
+// Reindex queues the repository that a webhook event is for ahead of
+// anything the crawlers have found. Only the ref that the event is for is
+// rebuilt. Every other ref is copied from the document we stored last time.
+// A deleted ref is gone from the clone once we fetch it, so it is left out of
+// the new document. This returns right away so the webhook handler can
+// respond to GitHub quickly. The repository is crawled by an index worker.
+func (idx *Indexer) Reindex(e *webhook.Event) {
+	if e.Deleted {
+		idx.l.Infof("Queueing %s because %s was deleted", e.Repository, e.Ref)
+	} else {
+		idx.l.Infof("Queueing %s because %s changed", e.Repository, e.Ref)
+	}
+	idx.queue.enqueueUrgent(&job{url: e.Repository, refs: []string{e.Ref}})
+}
+
+// crawlJob crawls the repository for a job that only has a URL. The job's
+// repository is still nil afterwards if the crawler skipped it or it's gone.
+func (idx *Indexer) crawlJob(j *job) error {
+	c, u, err := idx.lookupURL(j.url)
+	if err != nil {
+		return err
+	}
+
+	repo, err := idx.crawlOne(c, u)
+	if err != nil || repo == nil {
+		return err
+	}
+
+	if p, ok := repo.(repository.PartialRebuilder); ok && len(j.refs) > 0 {
+		p.RebuildOnly(j.refs)
+	}
+	j.crawler = c
+	j.repo = repo
+	return nil
+}
@@ -1,28 +1,102 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 
 	"github.com/autarch/metagodoc/env"
 	"github.com/autarch/metagodoc/indexer/indexer"
+	"github.com/autarch/metagodoc/indexer/webhook"
 	"github.com/autarch/metagodoc/logger"
 )
 
 func main() {
+	deadLetters := flag.Bool("dead-letters", false, "list the repositories that failed too many times and exit")
+	requeue := flag.Bool("requeue", false, "index the given dead letter repository IDs, or all of them if none are given, and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-dead-letters] [-requeue] [repository-url ...]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "With no arguments the indexer crawls forever. When given one or more")
+		fmt.Fprintln(os.Stderr, "repository URLs it indexes just those repositories once and exits.")
+		fmt.Fprintln(os.Stderr, "")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	l, err := logger.New(logger.NewParams{IsProd: env.IsProd()})
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer l.Sync()
 
-	err = indexer.New(indexer.NewParams{
-		Logger:       l,
-		GitHubToken:  env.GitHubToken(),
-		CacheRoot:    env.Root(),
-		TraceElastic: env.TraceElastic(),
-	}).IndexAll()
+	idx := indexer.New(indexer.NewParams{
+		Logger:             l,
+		GitHubToken:        env.GitHubToken(),
+		GitHubSearch:       env.GitHubSearch(),
+		GitRemotes:         env.GitRemotes(),
+		GoProxy:            env.GoProxy(),
+		GoProxyIndex:       env.GoProxyIndex(),
+		GoPaths:            env.GoPaths(),
+		CacheRoot:          env.Root(),
+		TraceElastic:       env.TraceElastic(),
+		Workers:            env.IndexWorkers(),
+		ClonesPerHost:      env.ClonesPerHost(),
+		QueueSize:          env.IndexQueueSize(),
+		MaxRetries:         env.IndexRetries(),
+		SkipList:           env.SkipListFile(),
+		TagRetention:       env.TagRetention(),
+		CloneMode:          env.CloneMode(),
+		CloneCacheMaxBytes: env.CloneCacheMaxBytes(),
+		CloneCacheMaxRepos: env.CloneCacheMaxRepos(),
+		GitTimeout:         env.GitTimeout(),
+		ParseCacheMaxBytes: env.ParseCacheMaxBytes(),
+		SeedFile:           env.SeedFile(),
+		SpiderDepth:        env.SpiderDepth(),
+		SpiderAllow:        env.SpiderAllow(),
+	})
+
+	if *deadLetters {
+		dls, err := idx.DeadLetters()
+		if err != nil {
+			l.Fatalf("Error getting dead letters: %s", err)
+		}
+		for _, dl := range dls {
+			fmt.Printf("%s\t%s\t%d attempts\tlast failed %s in %s stage: %s\n",
+				dl.Repository, dl.Crawler, dl.Attempts, dl.LastFailed, dl.Stage, dl.Error)
+		}
+		os.Exit(0)
+	}
+
+	if *requeue {
+		err = idx.Requeue(flag.Args())
+		if err != nil {
+			l.Fatalf("Error requeueing repositories: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	if flag.NArg() > 0 {
+		err = idx.IndexURLs(flag.Args())
+		if err != nil {
+			l.Fatalf("Error indexing repositories: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	if addr := env.WebhookAddr(); addr != "" {
+		h, err := webhook.NewHandler(l, env.WebhookSecret(), idx.Reindex)
+		if err != nil {
+			l.Fatalf("Error creating webhook handler: %s", err)
+		}
+		go func() {
+			l.Infof("Listening for GitHub webhooks on %s", addr)
+			l.Fatalf("Error listening for GitHub webhooks: %s", http.ListenAndServe(addr, h))
+		}()
+	}
 
+	err = idx.IndexAll()
 	if err != nil {
 		l.Fatalf("Error creating indexer: %s", err)
 	}
@@ -0,0 +1,331 @@
+// Package parsecache stores the packages we build from each directory so
+// that a directory we've seen before never has to be parsed again. Entries
+// are keyed on a hash of the directory's contents, like a git tree hash.
+// Consecutive tags of a repository usually share most of their directories,
+// as do forks, so most directories only need to be parsed once.
+//
+// Entries are stored in a directory for the current doc.BuilderVersion and
+// doc.Environment, so changing how packages are built doesn't give us stale
+// entries. Pruning deletes the directories for every other builder, and then
+// deletes the least recently used entries until the cache is within its size
+// limit.
+package parsecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/autarch/metagodoc/doc"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Entry is what we store for each directory.
+type Entry struct {
+	// The import path from the package's import comment, if it has one. If
+	// we find the same directory at some other import path then the caller
+	// has to deal with the mismatch just as if it had parsed the package.
+	ImportComment string            `json:"import_comment"`
+	Package       *esmodels.Package `json:"package"`
+}
+
+// Stats counts lookups. It is safe to use from multiple goroutines.
+type Stats struct {
+	Hits   int64
+	Misses int64
+}
+
+func (s *Stats) hit() {
+	atomic.AddInt64(&s.Hits, 1)
+}
+
+func (s *Stats) miss() {
+	atomic.AddInt64(&s.Misses, 1)
+}
+
+func (s Stats) String() string {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return "no lookups"
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.0f%% hit rate)", s.Hits, s.Misses, 100*float64(s.Hits)/float64(total))
+}
+
+// How often we check whether the cache is over its size limit. Like the
+// clone cache, this means walking every file, so we don't do it after every
+// Put.
+const pruneInterval = 10 * time.Minute
+
+// Cache is safe to use from multiple goroutines.
+type Cache struct {
+	l   *logger.Logger
+	dir string
+	// The directory under dir for the current builder.
+	genDir   string
+	maxBytes int64
+	stats    Stats
+
+	pruning   bool
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// New returns a cache that keeps its entries in <cacheRoot>/parse-cache,
+// creating it if needed. The cache is pruned every so often. If maxBytes is
+// more than zero that includes pruning it to that size.
+func New(l *logger.Logger, cacheRoot string, maxBytes int64) (*Cache, error) {
+	dir := filepath.Join(cacheRoot, "parse-cache")
+	env := fmt.Sprintf("%d %s", doc.BuilderVersion, doc.Environment())
+	sum := sha256.Sum256([]byte(env))
+	genDir := filepath.Join(dir, "builder-"+hex.EncodeToString(sum[:8]))
+
+	err := os.MkdirAll(genDir, 0755)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not create the parse cache at %s: {{err}}", dir), err)
+	}
+
+	return &Cache{
+		l:        l,
+		dir:      dir,
+		genDir:   genDir,
+		maxBytes: maxBytes,
+		// We don't want to walk a big cache as soon as we start up.
+		lastPrune: time.Now(),
+	}, nil
+}
+
+// Get returns the entry for a directory hash, or nil if there isn't one. The
+// lookup is counted in s, if it isn't nil, as well as in the cache's totals.
+func (c *Cache) Get(hash string, s *Stats) (*Entry, error) {
+	content, err := ioutil.ReadFile(c.path(hash))
+	if err != nil {
+		c.record(s, false)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	e := &Entry{}
+	err = json.Unmarshal(content, e)
+	if err != nil || e.Package == nil {
+		// We'll overwrite this when the caller Puts the package it builds.
+		c.record(s, false)
+		return nil, nil
+	}
+
+	// The modification time records when the entry was last used, so that
+	// pruning deletes the entries that have gone unused the longest.
+	now := time.Now()
+	os.Chtimes(c.path(hash), now, now)
+
+	c.record(s, true)
+	return e, nil
+}
+
+func (c *Cache) record(s *Stats, hit bool) {
+	for _, st := range []*Stats{&c.stats, s} {
+		if st == nil {
+			continue
+		}
+		if hit {
+			st.hit()
+		} else {
+			st.miss()
+		}
+	}
+}
+
+// Put stores the entry for a directory hash. The file is written under a
+// temporary name and then renamed so that a concurrent Get never sees part
+// of an entry.
+func (c *Cache) Put(hash string, e *Entry) error {
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	p := c.path(hash)
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		return err
+	}
+
+	go c.maybePrune()
+	return nil
+}
+
+// Stats returns the totals for every lookup since the cache was created.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadInt64(&c.stats.Hits),
+		Misses: atomic.LoadInt64(&c.stats.Misses),
+	}
+}
+
+// The entries are spread across 256 subdirectories so that no one directory
+// gets too big.
+func (c *Cache) path(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.genDir, key[:2], key+".json")
+}
+
+// Pruned says what Prune deleted.
+type Pruned struct {
+	// The number of entries deleted for being over the size limit.
+	Entries int
+	// The number of directories deleted because they were for another
+	// builder.
+	Builders int
+	Bytes    int64
+}
+
+// Prune deletes the entries for every other builder. Then, if the cache has
+// a size limit, it deletes the least recently used entries until the cache
+// is within the limit. An entry that is deleted while someone is reading it
+// is just a miss.
+func (c *Cache) Prune() (*Pruned, error) {
+	pruned := &Pruned{}
+
+	others, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return pruned, errwrap.Wrapf(fmt.Sprintf("Could not read the parse cache at %s: {{err}}", c.dir), err)
+	}
+	for _, fi := range others {
+		p := filepath.Join(c.dir, fi.Name())
+		if p == c.genDir {
+			continue
+		}
+		size, err := dirSize(p)
+		if err != nil {
+			return pruned, err
+		}
+		c.l.Infof("Removing %s from the parse cache, which was made by another builder and takes %d bytes", p, size)
+		err = os.RemoveAll(p)
+		if err != nil {
+			return pruned, errwrap.Wrapf(fmt.Sprintf("Could not remove %s: {{err}}", p), err)
+		}
+		pruned.Builders++
+		pruned.Bytes += size
+	}
+
+	if c.maxBytes <= 0 {
+		return pruned, nil
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var (
+		files []*file
+		total int64
+	)
+	err = filepath.Walk(c.genDir, func(p string, info os.FileInfo, err error) error {
+		// Another process may be pruning at the same time.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, &file{p, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return pruned, errwrap.Wrapf(fmt.Sprintf("Could not list the entries in %s: {{err}}", c.genDir), err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUse.Before(files[j].lastUse) })
+	for _, f := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+		total -= f.size
+		pruned.Entries++
+		pruned.Bytes += f.size
+	}
+
+	return pruned, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// maybePrune prunes the cache if we haven't pruned it recently. Only one
+// prune runs at a time.
+func (c *Cache) maybePrune() {
+	c.mutex.Lock()
+	due := !c.pruning && time.Since(c.lastPrune) >= pruneInterval
+	if due {
+		c.pruning = true
+	}
+	c.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	pruned, err := c.Prune()
+	if err != nil {
+		c.l.Errorf("Error pruning the parse cache: %s", err)
+	} else if pruned.Entries > 0 || pruned.Builders > 0 {
+		c.l.Infof("Pruned %d entries and %d old builders from the parse cache, freeing %d bytes", pruned.Entries, pruned.Builders, pruned.Bytes)
+	}
+
+	c.mutex.Lock()
+	c.pruning = false
+	c.lastPrune = time.Now()
+	c.mutex.Unlock()
+}
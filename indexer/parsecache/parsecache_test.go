@@ -0,0 +1,126 @@
+package parsecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parsecache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(l, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Stats{}
+	e, err := c.Get("abc123", s)
+	assert.Nil(t, err, "no error for a missing entry")
+	assert.Nil(t, e, "no entry before Put")
+
+	err = c.Put("abc123", &Entry{
+		ImportComment: "example.com/foo",
+		Package:       &esmodels.Package{Name: "foo", ImportPath: "example.com/foo"},
+	})
+	assert.Nil(t, err, "no error from Put")
+
+	e, err = c.Get("abc123", s)
+	assert.Nil(t, err, "no error for an entry we Put")
+	if assert.NotNil(t, e, "got the entry back") {
+		assert.Equal(t, "example.com/foo", e.ImportComment, "import comment")
+		assert.Equal(t, "foo", e.Package.Name, "package name")
+	}
+
+	e, err = c.Get("def456", nil)
+	assert.Nil(t, e, "a different hash misses")
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 1}, *s, "stats for our lookups")
+	assert.Equal(t, Stats{Hits: 1, Misses: 2}, c.Stats(), "stats for all lookups")
+	assert.Equal(t, "1 hits, 1 misses (50% hit rate)", s.String(), "stats as a string")
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parsecache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(l, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry left behind by an older builder.
+	old := filepath.Join(dir, "parse-cache", "builder-0000000000000000", "ab", "ab.json")
+	err = os.MkdirAll(filepath.Dir(old), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(old, make([]byte, 10), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := []string{"old", "middle", "new"}
+	var size int64
+	for i, h := range hashes {
+		err := c.Put(h, &Entry{Package: &esmodels.Package{Name: h}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(time.Duration(i-len(hashes)) * time.Hour)
+		err = os.Chtimes(c.path(h), used, used)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(c.path(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size = fi.Size()
+	}
+
+	pruned, err := c.Prune()
+	assert.Nil(t, err, "no error pruning")
+	assert.Equal(t, &Pruned{Builders: 1, Bytes: 10}, pruned, "without a limit only the old builder is removed")
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err), "the old builder's entry is gone")
+
+	// Using the oldest entry makes it the most recently used, so the middle
+	// one goes instead.
+	e, _ := c.Get("old", nil)
+	assert.NotNil(t, e, "the oldest entry is still there")
+	c.maxBytes = 2*size + size/2
+	pruned, err = c.Prune()
+	assert.Nil(t, err, "no error pruning by size")
+	assert.Equal(t, 1, pruned.Entries, "one entry removed")
+	for _, h := range hashes {
+		e, _ := c.Get(h, nil)
+		if h == "middle" {
+			assert.Nil(t, e, "the least recently used entry was removed")
+		} else {
+			assert.NotNil(t, e, "%s is still there", h)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package ratelimit keeps track of how much of our GitHub API quota is left
+// and divides it between the different things we use the API for. GitHub
+// has a separate limit for the search API and for everything else (the
+// "core" limit). It can also impose a secondary rate limit at any time,
+// which comes with a Retry-After header telling us how long to back off.
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/google/go-github/github"
+)
+
+// Category is a kind of API call that gets its own share of the budget.
+type Category string
+
+const (
+	// Searching for repositories. This uses the search limit.
+	Search Category = "search"
+	// Getting a repository's metadata. This uses the core limit.
+	Metadata Category = "metadata"
+	// Listing a repository's issues and pull requests. This uses the core
+	// limit.
+	Issues Category = "issues"
+)
+
+// The share of the core limit that each category may use in each rate limit
+// window. Metadata gets the biggest share since we can't index a repository
+// without it, while issue counts are nice to have. The shares add up to less
+// than 1 so there is always a little left for anything else.
+var coreShares = map[Category]float64{
+	Metadata: 0.5,
+	Issues:   0.4,
+}
+
+// Limiter tracks the rate limits from GitHub's responses. It is safe to use
+// from multiple goroutines.
+type Limiter struct {
+	l *logger.Logger
+
+	core   github.Rate
+	search github.Rate
+
+	// When we hit a secondary rate limit we can't make any calls until
+	// this time.
+	retryAfter time.Time
+
+	// The number of core calls made for each category in the current window.
+	// The window ends at core.Reset.
+	used map[Category]int
+
+	mutex sync.Mutex
+}
+
+func New(l *logger.Logger) *Limiter {
+	return &Limiter{
+		l:    l,
+		used: make(map[Category]int),
+	}
+}
+
+// Update records the rate limit information from a response. The response
+// may be nil, for example if the request failed before we got one.
+func (lim *Limiter) Update(c Category, resp *github.Response) {
+	if resp == nil || resp.Rate.Limit == 0 {
+		return
+	}
+
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+
+	if c == Search {
+		lim.search = resp.Rate
+		return
+	}
+
+	// A new reset time means a new window, so everyone's share starts over.
+	if !resp.Rate.Reset.Equal(lim.core.Reset) {
+		lim.used = make(map[Category]int)
+	}
+	lim.core = resp.Rate
+	lim.used[c]++
+}
+
+// HandleError checks whether an error from the GitHub client was caused by a
+// rate limit. If it was we record when we can try again and return true.
+func (lim *Limiter) HandleError(c Category, err error) bool {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		if c == Search {
+			lim.search = e.Rate
+		} else {
+			lim.core = e.Rate
+		}
+		lim.l.Infof("Hit the GitHub %s rate limit, it resets at %s", limitName(c), e.Rate.Reset.Format(time.RFC3339))
+		return true
+	case *github.AbuseRateLimitError:
+		// GitHub doesn't always tell us how long to wait. Its docs say to
+		// wait at least a minute in that case.
+		wait := time.Minute
+		if e.RetryAfter != nil {
+			wait = *e.RetryAfter
+		}
+		lim.retryAfter = time.Now().Add(wait)
+		lim.l.Infof("Hit a GitHub secondary rate limit, retrying after %s", lim.retryAfter.Format(time.RFC3339))
+		return true
+	}
+
+	return false
+}
+
+// Allow reports whether we can make a call in the category right now without
+// going over its budget.
+func (lim *Limiter) Allow(c Category) bool {
+	return lim.Wait(c) == 0
+}
+
+// Wait returns how long we need to wait before we can make a call in the
+// category. This is zero if we can make a call now.
+func (lim *Limiter) Wait(c Category) time.Duration {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+
+	now := time.Now()
+	var until time.Time
+	if lim.retryAfter.After(now) {
+		until = lim.retryAfter
+	}
+
+	rate := lim.core
+	if c == Search {
+		rate = lim.search
+	}
+
+	// If we haven't seen a response yet or the window has passed then we
+	// don't know of any limit.
+	if rate.Limit > 0 && rate.Reset.After(now) {
+		exhausted := rate.Remaining == 0
+		if share, ok := coreShares[c]; ok && c != Search {
+			exhausted = exhausted || float64(lim.used[c]) >= share*float64(rate.Limit)
+		}
+		if exhausted && rate.Reset.After(until) {
+			until = rate.Reset.Time
+		}
+	}
+
+	if until.IsZero() {
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// Remaining returns how many more calls the category can make in the
+// current window. If we don't know the limit yet this returns -1.
+func (lim *Limiter) Remaining(c Category) int {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+
+	rate := lim.core
+	if c == Search {
+		rate = lim.search
+	}
+	if rate.Limit == 0 || !rate.Reset.After(time.Now()) {
+		return -1
+	}
+
+	remaining := rate.Remaining
+	if share, ok := coreShares[c]; ok && c != Search {
+		left := int(share*float64(rate.Limit)) - lim.used[c]
+		if left < remaining {
+			remaining = left
+		}
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// Status describes the remaining budget.
+type Status struct {
+	CoreLimit       int
+	CoreRemaining   int
+	CoreReset       time.Time
+	SearchLimit     int
+	SearchRemaining int
+	SearchReset     time.Time
+	RetryAfter      time.Time
+	// The number of core calls each category has made in the current
+	// window, and the most it may make.
+	Used   map[Category]int
+	Budget map[Category]int
+}
+
+func (lim *Limiter) Status() Status {
+	lim.mutex.Lock()
+	defer lim.mutex.Unlock()
+
+	s := Status{
+		CoreLimit:       lim.core.Limit,
+		CoreRemaining:   lim.core.Remaining,
+		CoreReset:       lim.core.Reset.Time,
+		SearchLimit:     lim.search.Limit,
+		SearchRemaining: lim.search.Remaining,
+		SearchReset:     lim.search.Reset.Time,
+		RetryAfter:      lim.retryAfter,
+		Used:            make(map[Category]int),
+		Budget:          make(map[Category]int),
+	}
+	for c, share := range coreShares {
+		s.Used[c] = lim.used[c]
+		s.Budget[c] = int(share * float64(lim.core.Limit))
+	}
+	return s
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf(
+		"core %d/%d (metadata %d/%d, issues %d/%d) resets at %s, search %d/%d resets at %s",
+		s.CoreRemaining, s.CoreLimit,
+		s.Used[Metadata], s.Budget[Metadata],
+		s.Used[Issues], s.Budget[Issues],
+		s.CoreReset.Format("15:04:05"),
+		s.SearchRemaining, s.SearchLimit,
+		s.SearchReset.Format("15:04:05"),
+	)
+}
+
+func limitName(c Category) string {
+	if c == Search {
+		return "search"
+	}
+	return "core"
+}
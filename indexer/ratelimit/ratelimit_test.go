@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func response(limit, remaining int, reset time.Time) *github.Response {
+	return &github.Response{
+		Response: &http.Response{},
+		Rate: github.Rate{
+			Limit:     limit,
+			Remaining: remaining,
+			Reset:     github.Timestamp{Time: reset},
+		},
+	}
+}
+
+func newLimiter(t *testing.T) *Limiter {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(l)
+}
+
+func TestLimiter(t *testing.T) {
+	lim := newLimiter(t)
+	assert.True(t, lim.Allow(Search), "calls are allowed before we know the limit")
+
+	reset := time.Now().Add(time.Hour)
+	lim.Update(Search, response(30, 0, reset))
+	assert.False(t, lim.Allow(Search), "search is not allowed once it is exhausted")
+	wait := lim.Wait(Search)
+	assert.True(t, wait > 59*time.Minute && wait <= time.Hour, "wait until the search limit resets")
+	assert.True(t, lim.Allow(Metadata), "search limit does not affect core calls")
+
+	for i := 0; i < 4; i++ {
+		lim.Update(Issues, response(10, 10-i, reset))
+	}
+	assert.False(t, lim.Allow(Issues), "issues are not allowed once they use their share")
+	assert.True(t, lim.Allow(Metadata), "metadata has its own share")
+
+	lim.Update(Metadata, response(10, 9, reset.Add(time.Hour)))
+	assert.True(t, lim.Allow(Issues), "shares start over when the window resets")
+	assert.Equal(t, 1, lim.Status().Used[Metadata], "status includes calls made in this window")
+	assert.Equal(t, 4, lim.Status().Budget[Issues], "status includes each category's budget")
+
+	lim.Update(Metadata, response(10, 5, time.Now().Add(-time.Second)))
+	assert.True(t, lim.Allow(Metadata), "an expired limit does not block calls")
+}
+
+func TestLimiterHandleError(t *testing.T) {
+	lim := newLimiter(t)
+
+	assert.False(t, lim.HandleError(Metadata, &github.ErrorResponse{Response: &http.Response{}}), "other errors are not rate limits")
+
+	reset := time.Now().Add(10 * time.Minute)
+	isLimit := lim.HandleError(Metadata, &github.RateLimitError{
+		Rate: github.Rate{Limit: 5000, Remaining: 0, Reset: github.Timestamp{Time: reset}},
+	})
+	assert.True(t, isLimit, "RateLimitError is a rate limit")
+	assert.False(t, lim.Allow(Issues), "core calls wait for the reset")
+	assert.True(t, lim.Allow(Search), "search calls are not affected by the core limit")
+
+	retry := 30 * time.Second
+	isLimit = lim.HandleError(Search, &github.AbuseRateLimitError{RetryAfter: &retry})
+	assert.True(t, isLimit, "AbuseRateLimitError is a rate limit")
+	wait := lim.Wait(Search)
+	assert.True(t, wait > 25*time.Second && wait <= retry, "search waits for Retry-After")
+	assert.True(t, lim.Wait(Metadata) > 9*time.Minute, "the longer of the two waits wins")
+}
+
+func TestLimiterRemaining(t *testing.T) {
+	lim := newLimiter(t)
+	assert.Equal(t, -1, lim.Remaining(Issues), "remaining is unknown before we see a response")
+
+	reset := time.Now().Add(time.Hour)
+	lim.Update(Metadata, response(100, 90, reset))
+	assert.Equal(t, 40, lim.Remaining(Issues), "issues are limited to their share")
+	assert.Equal(t, 49, lim.Remaining(Metadata), "metadata share less what it has used")
+
+	lim.Update(Metadata, response(100, 10, reset))
+	assert.Equal(t, 10, lim.Remaining(Issues), "share is limited by what is left overall")
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// Stage is the part of indexing a repository where something went wrong.
+type Stage string
+
+const (
+	// Cloning, fetching, or opening the clone.
+	CloneStage Stage = "clone"
+	// Listing the refs or finding the commit a ref points to.
+	RefsStage Stage = "refs"
+	// Reading the commit and files that a ref points to out of the clone.
+	CheckoutStage Stage = "checkout"
+	// Downloading or extracting a module version.
+	DownloadStage Stage = "download"
+	// Reading and parsing the files for a ref.
+	ParseStage Stage = "parse"
+	// Getting everything else about the repository, like its commit history
+	// and README.
+	MetadataStage Stage = "metadata"
+)
+
+// Error is returned by ESModel. It records which repository and ref we were
+// indexing, and what we were doing, when something went wrong. The Ref is
+// empty if the error isn't specific to a ref.
+type Error struct {
+	Repository string
+	Ref        string
+	Stage      Stage
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Ref == "" {
+		return fmt.Sprintf("Could not index %s (%s): %s", e.Repository, e.Stage, e.Err)
+	}
+	return fmt.Sprintf("Could not index %s of %s (%s): %s", e.Ref, e.Repository, e.Stage, e.Err)
+}
+
+// WrappedErrors implements errwrap.Wrapper.
+func (e *Error) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// newError wraps err in an *Error, unless it already is one. In that case we
+// keep the original since it knows more about where the error happened.
+func newError(repo, ref string, stage Stage, err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{
+		Repository: repo,
+		Ref:        ref,
+		Stage:      stage,
+		Err:        err,
+	}
+}
+
+// GoneError means that the repository no longer exists upstream, or that we
+// are no longer allowed to see it. There's no point in retrying a repository
+// like this. It is usually wrapped in an *Error.
+type GoneError struct {
+	Err error
+}
+
+func (e *GoneError) Error() string {
+	return fmt.Sprintf("The repository is gone: %s", e.Err)
+}
+
+// WrappedErrors implements errwrap.Wrapper.
+func (e *GoneError) WrappedErrors() []error {
+	return []error{e.Err}
+}
+
+// IsGone returns the *GoneError inside err, or nil if there isn't one.
+func IsGone(err error) *GoneError {
+	if err == nil {
+		return nil
+	}
+	gone, _ := errwrap.GetType(err, &GoneError{}).(*GoneError)
+	return gone
+}
+
+// This is what git says when the server tells it that a remote doesn't
+// exist. GitHub, GitLab, and Gitea all say this for a repository that we're
+// allowed to ask about but that isn't there. When git has to ask for a
+// username or password, or the credentials it has are rejected, we can't
+// tell whether the repository exists. Neither can we for a path that doesn't
+// look like a repository, since that's also what we get when an ssh server
+// won't let us in. Those are ordinary errors that are retried.
+var missingRemoteRE = regexp.MustCompile(`(?i)repository '[^']*' not found|\brepository not found\b`)
+
+// goneIfMissing turns an error from cloning or fetching into a *GoneError if
+// git says the remote doesn't exist.
+func goneIfMissing(err error) error {
+	if err == nil || !missingRemoteRE.MatchString(err.Error()) {
+		return err
+	}
+	return &GoneError{Err: err}
+}
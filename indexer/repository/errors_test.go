@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoneIfMissing(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		gone   bool
+	}{
+		{
+			"GitHub over https",
+			"remote: Repository not found.\nfatal: repository 'https://github.com/autarch/no-such-repo.git/' not found\n",
+			true,
+		},
+		{
+			"GitHub over ssh",
+			"ERROR: Repository not found.\nfatal: Could not read from remote repository.\n\nPlease make sure you have the correct access rights\nand the repository exists.\n",
+			true,
+		},
+		{
+			"GitLab",
+			"remote: The project you were looking for could not be found or you don't have permission to view it.\nfatal: repository 'https://gitlab.com/autarch/no-such-repo.git/' not found\n",
+			true,
+		},
+		{
+			"no terminal for a username prompt",
+			"fatal: could not read Username for 'https://git.internal': terminal prompts disabled\n",
+			false,
+		},
+		{
+			"no terminal for a password prompt",
+			"fatal: could not read Password for 'https://autarch@git.internal': terminal prompts disabled\n",
+			false,
+		},
+		{
+			"expired token",
+			"remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/autarch/private.git/'\n",
+			false,
+		},
+		{
+			"ssh key not accepted",
+			"git@git.internal: Permission denied (publickey).\nfatal: Could not read from remote repository.\n\nPlease make sure you have the correct access rights\nand the repository exists.\n",
+			false,
+		},
+		{
+			"ssh path that isn't a repository",
+			"fatal: '/srv/git/team/repo.git' does not appear to be a git repository\nfatal: Could not read from remote repository.\n\nPlease make sure you have the correct access rights\nand the repository exists.\n",
+			false,
+		},
+		{
+			"forbidden",
+			"fatal: unable to access 'https://git.internal/team/repo.git/': The requested URL returned error: 403\n",
+			false,
+		},
+		{
+			"unknown host",
+			"fatal: unable to access 'https://git.internal/team/repo.git/': Could not resolve host: git.internal\n",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		// This is how the errors from cloning look by the time we see them.
+		err := errwrap.Wrapf("Could not make a full clone of the repository: {{err}}", errors.New("exit status 128 - "+test.stderr))
+		got := goneIfMissing(err)
+		if test.gone {
+			assert.NotNil(t, IsGone(got), "%s is gone", test.name)
+		} else {
+			assert.Nil(t, IsGone(got), "%s is not gone", test.name)
+			assert.Equal(t, err, got, "%s is returned as is", test.name)
+		}
+	}
+
+	assert.Nil(t, goneIfMissing(nil), "nil is not gone")
+}
@@ -0,0 +1,644 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/clonecache"
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/indexer/tree"
+	"github.com/autarch/metagodoc/indexer/vanity"
+	"github.com/autarch/metagodoc/logger"
+
+	"code.gitea.io/git"
+	"github.com/hashicorp/errwrap"
+)
+
+// gitRepository is a repository that we only know about through its clone
+// URL. Everything we index is derived from the clone itself. It also holds
+// all the clone-based logic shared with more specific repository types like
+// githubRepository.
+type gitRepository struct {
+	l        *logger.Logger
+	clone    *git.Repository
+	ctx      context.Context
+	isGoCore bool
+	cloneURL string
+	clones   *clonecache.Cache
+
+	// The name of the branch that HEAD points to in the remote repository.
+	defaultBranch string
+
+	// Returns the URL at which a directory in the repository can be viewed
+	// on the web. The pathInRepo is either empty or starts with a "/". This
+	// returns an empty string if there is no known way to view the code.
+	browseURL func(refName, pathInRepo string) string
+
+	// A unique ID for the repository based on its URL without the scheme. So
+	// for a GitHub repo like "https://github.com/stretchr/testify" this would
+	// be "github.com/stretchr/testify". This may be turned into import paths
+	// for individual packages.
+	id string
+
+	// Version control system: git, hg, bzr, ...
+	VCS esmodels.VCSType
+
+	// Used to check vanity import paths found in import comments. This may
+	// be nil.
+	resolver *vanity.Resolver
+
+	// Decides which version tags we index.
+	retention Retention
+
+	// Packages we've already built, keyed on git tree hashes. This may be
+	// nil.
+	parseCache *parsecache.Cache
+
+	// If this isn't nil only these refs are rebuilt. See RebuildOnly.
+	onlyRefs map[string]bool
+}
+
+func NewGitRepository(
+	l *logger.Logger,
+	cloneURL string,
+	clones *clonecache.Cache,
+	resolver *vanity.Resolver,
+	retention Retention,
+	parseCache *parsecache.Cache,
+	ctx context.Context,
+) (*gitRepository, error) {
+
+	id, err := gitRepositoryID(cloneURL)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Infof("Indexing %s", id)
+
+	repo := &gitRepository{
+		l:          l,
+		ctx:        ctx,
+		isGoCore:   isGoCore(id),
+		retention:  retention,
+		parseCache: parseCache,
+		cloneURL:   cloneURL,
+		clones:     clones,
+		browseURL:  func(string, string) string { return "" },
+		id:         id,
+		VCS:        esmodels.Git,
+		resolver:   resolver,
+	}
+
+	return repo, nil
+}
+
+// isGoCore reports whether the repository ID is one of the places the go core
+// repo lives.
+func isGoCore(id string) bool {
+	return id == "github.com/golang/go" || id == "go.googlesource.com/go"
+}
+
+var scpLikeURLRE = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// gitRepositoryID turns a clone URL into an ID. The ID is the host and path
+// of the URL without any user, port, or ".git" suffix. This also handles the
+// scp-like "user@host:path" syntax that git accepts for ssh remotes. For a
+// file URL there is no host so the ID is just the path.
+func gitRepositoryID(cloneURL string) (string, error) {
+	var host, p string
+	if !strings.Contains(cloneURL, "://") {
+		m := scpLikeURLRE.FindStringSubmatch(cloneURL)
+		if m == nil {
+			return "", fmt.Errorf("Cannot determine a repository ID for %s", cloneURL)
+		}
+		host, p = m[1], m[2]
+	} else {
+		u, err := url.Parse(cloneURL)
+		if err != nil {
+			return "", fmt.Errorf("Cannot parse %s as a URL: %s", cloneURL, err)
+		}
+		host, p = u.Hostname(), u.Path
+	}
+
+	p = strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+	if p == "" {
+		return "", fmt.Errorf("The URL %s does not contain a repository path", cloneURL)
+	}
+
+	if host == "" {
+		return p, nil
+	}
+	return host + "/" + p, nil
+}
+
+func (repo *gitRepository) ESModel(previous *esmodels.Repository, sink PackageSink) (*esmodels.Repository, error) {
+	release, err := repo.prepare()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	out, err := repo.optedOut()
+	if err != nil {
+		return nil, err
+	}
+	if out {
+		return nil, ErrOptedOut
+	}
+
+	head, err := repo.defaultBranchCommit()
+	if err != nil {
+		return nil, err
+	}
+	first, err := repo.firstCommit()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := repo.getRefs(newRefCache(repo.l, previous), sink)
+	if err != nil {
+		return nil, err
+	}
+	status, err := repo.getStatus()
+	if err != nil {
+		return nil, err
+	}
+	about, err := repo.getReadme()
+	if err != nil {
+		return nil, err
+	}
+
+	return &esmodels.Repository{
+		ID:          repo.id,
+		Name:        path.Base(repo.id),
+		FullName:    repo.id,
+		VCS:         string(repo.VCS),
+		PrimaryURL:  repo.cloneURL,
+		Owner:       path.Base(path.Dir(repo.id)),
+		Created:     first.Author.When.UTC().Format(esmodels.DateTimeFormat),
+		LastUpdated: head.Author.When.UTC().Format(esmodels.DateTimeFormat),
+		LastCrawled: time.Now().UTC().Format(esmodels.DateTimeFormat),
+		Status:      status,
+		About:       about,
+		Refs:        refs,
+
+		CanonicalImportPaths: canonicalImportPaths(refs),
+	}, nil
+}
+
+func (repo *gitRepository) ID() string {
+	return repo.id
+}
+
+func (repo *gitRepository) CrawlURL() string {
+	return repo.cloneURL
+}
+
+// RebuildOnly implements PartialRebuilder.
+func (repo *gitRepository) RebuildOnly(refs []string) {
+	repo.onlyRefs = make(map[string]bool)
+	for _, r := range refs {
+		repo.onlyRefs[r] = true
+	}
+}
+
+// prepare clones or fetches the repository. We do this when we build the
+// model rather than when the repository is created so that crawlers never
+// clone anything. That way the indexer controls how many clones run at once.
+// The clone is marked as in use so it won't be pruned from the cache. Call
+// the returned func when you're done with it.
+func (repo *gitRepository) prepare() (func(), error) {
+	release := repo.clones.Acquire(repo.id)
+
+	c, err := repo.getGitRepo()
+	if err != nil {
+		release()
+		return nil, newError(repo.id, "", CloneStage, err)
+	}
+
+	repo.clone = c
+	if repo.defaultBranch == "" {
+		repo.defaultBranch = repo.getDefaultBranch()
+	}
+	return release, nil
+}
+
+func (repo *gitRepository) getGitRepo() (*git.Repository, error) {
+	dir := repo.clones.Dir(repo.id)
+	exists, err := pathExists(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		repo.l.Infof("  %s does not exist at %s - cloning", repo.id, dir)
+		err := repo.clones.Clone(repo.cloneURL, repo.id)
+		if err != nil {
+			return nil, goneIfMissing(err)
+		}
+	}
+
+	c, err := git.OpenRepository(dir)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not open the clone at %s: {{err}}", dir), err)
+	}
+
+	if exists {
+		repo.l.Infof("  %s exists at %s - fetching", repo.id, dir)
+		// Pruning removes the branches and tags that were deleted upstream
+		// so that we stop indexing them.
+		err = repo.fetch(c.Path, "--prune", "--prune-tags", "--tags")
+		if err != nil {
+			return nil, goneIfMissing(errwrap.Wrapf("Could not fetch tags: {{err}}", err))
+		}
+	}
+
+	return c, nil
+}
+
+// fetch runs "git fetch" in the clone. If the clone is shallow we keep it
+// that way, so we only get the commits that refs point to.
+func (repo *gitRepository) fetch(dir string, args ...string) error {
+	shallow, err := pathExists(filepath.Join(dir, ".git", "shallow"))
+	if err != nil {
+		return err
+	}
+
+	cmd := git.NewCommand("fetch")
+	if shallow {
+		cmd.AddArguments("--depth", "1")
+	}
+	cmd.AddArguments(args...)
+	_, err = cmd.RunInDirTimeout(repo.clones.Timeout(), dir)
+	return err
+}
+
+// getDefaultBranch asks the clone which branch the remote's HEAD points
+// to. If the remote's HEAD is unknown we fall back to "master".
+func (repo *gitRepository) getDefaultBranch() string {
+	ref, err := git.NewCommand("symbolic-ref", "--short", "refs/remotes/origin/HEAD").RunInDir(repo.clone.Path)
+	if err != nil {
+		repo.l.Infof("  could not determine the default branch, using master: %s", err)
+		return "master"
+	}
+	return strings.TrimPrefix(strings.TrimSpace(ref), "origin/")
+}
+
+func (repo *gitRepository) defaultBranchCommit() (*git.Commit, error) {
+	head, err := repo.clone.GetCommit("origin/" + repo.defaultBranch)
+	if err != nil {
+		return nil, newError(repo.id, repo.defaultBranch, RefsStage, err)
+	}
+	return head, nil
+}
+
+func (repo *gitRepository) firstCommit() (*git.Commit, error) {
+	// A repository can have more than one root commit. We just take the
+	// first one that rev-list gives us.
+	stdout, err := git.NewCommand("rev-list", "--max-parents=0", "origin/"+repo.defaultBranch).RunInDir(repo.clone.Path)
+	if err != nil {
+		return nil, newError(repo.id, repo.defaultBranch, MetadataStage, err)
+	}
+
+	c, err := repo.clone.GetCommit(strings.SplitN(stdout, "\n", 2)[0])
+	if err != nil {
+		return nil, newError(repo.id, repo.defaultBranch, MetadataStage, err)
+	}
+	return c, nil
+}
+
+// A repository with no commits within the last 2 years will be considered
+// inactive. But if another active repo imports this one then we will consider
+// this one active.
+const twoYears = 2 * 365 * 24 * time.Hour
+
+func (repo *gitRepository) getStatus() (esmodels.ActivityStatus, error) {
+	head, err := repo.defaultBranchCommit()
+	if err != nil {
+		return "", err
+	}
+	if time.Now().Sub(head.Author.When) > twoYears {
+		return esmodels.NoRecentCommits, nil
+	}
+
+	return esmodels.Active, nil
+}
+
+// getReadme reads the README from the default branch. We never check
+// anything out, so we can't look in the worktree for it.
+func (repo *gitRepository) getReadme() (*esmodels.About, error) {
+	t, err := tree.NewGit(repo.clone.Path, "origin/"+repo.defaultBranch, repo.ctx)
+	if err != nil {
+		return nil, newError(repo.id, repo.defaultBranch, MetadataStage, err)
+	}
+	defer t.Close()
+
+	about, err := readmeIn(t)
+	if err != nil {
+		return nil, newError(repo.id, repo.defaultBranch, MetadataStage, err)
+	}
+	return about, nil
+}
+
+// readmeIn returns the first README file found in the root of the tree, if
+// there is one.
+func readmeIn(t tree.Tree) (*esmodels.About, error) {
+	files, err := t.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir {
+			continue
+		}
+		m := regexp.MustCompile(`(?i)^readme(?:\.(.+))`).FindStringSubmatch(f.Name)
+		if m == nil {
+			continue
+		}
+
+		contentType := "text/plain"
+		if m[1] == "md" {
+			contentType = "text/markdown"
+		}
+
+		c, err := t.ReadFile(f.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &esmodels.About{Content: string(c), ContentType: contentType}, nil
+	}
+
+	return nil, nil
+}
+
+func (repo *gitRepository) getRefs(cache *refCache, sink PackageSink) ([]*esmodels.Ref, error) {
+	refs := []*gitRef{{name: repo.defaultBranch, isBranch: true}}
+
+	tags, err := repo.clone.GetTags()
+	if err != nil {
+		return nil, newError(repo.id, "", RefsStage, err)
+	}
+
+	// A module that has moved on to a new major version sometimes keeps
+	// working on the old one in a branch named for it, like "v1".
+	branches, err := repo.allBranches()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range branches {
+		if b == repo.defaultBranch || !IsIndexedBranch(b, repo.defaultBranch) {
+			continue
+		}
+		refs = append(refs, &gitRef{name: b, isBranch: true})
+	}
+
+	versions := versionTags(tags, repo.isGoCore)
+	kept := repo.retention.apply(versions)
+	if len(kept) < len(versions) {
+		repo.l.Infof("  keeping %d of %d version tags with the %s retention policy", len(kept), len(versions), repo.retention)
+	}
+	for _, tv := range kept {
+		refs = append(refs, &gitRef{name: tv.tag, moduleDir: tv.dir})
+	}
+
+	stats := &parsecache.Stats{}
+	models, err := repo.indexRefs(refs, cache, sink, stats)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.report()
+	if repo.parseCache != nil {
+		repo.l.Infof("  parse cache: %s", stats)
+	}
+
+	return models, nil
+}
+
+// gitRef is a branch or tag that we're going to index.
+type gitRef struct {
+	name     string
+	isBranch bool
+	// A version tag is a version of the module in this directory, like
+	// "sub/module" for the tag "sub/module/v1.0.0". This is empty for the
+	// repository root and for branches.
+	moduleDir string
+	// The commit the ref points to. This is set by resolveRef.
+	commit string
+}
+
+// The number of refs from one repository that we parse at once.
+const refWorkers = 4
+
+// indexRefs resolves every ref to a commit and reuses the previous model for
+// any ref that hasn't moved. The rest are parsed concurrently and their
+// packages are given to the sink. Each one is read straight from the object
+// database, so we never touch the worktree. The models are returned in the
+// same order as the refs.
+func (repo *gitRepository) indexRefs(refs []*gitRef, cache *refCache, sink PackageSink, stats *parsecache.Stats) ([]*esmodels.Ref, error) {
+	models := make([]*esmodels.Ref, len(refs))
+	var todo []int
+	for i, r := range refs {
+		// We don't even need to look at a ref that we were told hasn't
+		// changed, unless it's new to us.
+		if repo.onlyRefs != nil && !repo.onlyRefs[r.name] {
+			if ref := cache.keep(r.name); ref != nil {
+				ref.IsDefaultBranch = r.name == repo.defaultBranch
+				models[i] = ref
+				continue
+			}
+		}
+
+		err := repo.resolveRef(r)
+		if err != nil {
+			return nil, err
+		}
+
+		// If the ref hasn't moved since we last indexed it then there's no
+		// need to parse everything again.
+		if ref := cache.reuse(r.name, r.commit); ref != nil {
+			ref.IsDefaultBranch = r.name == repo.defaultBranch
+			models[i] = ref
+			continue
+		}
+		todo = append(todo, i)
+	}
+
+	errs := make([]error, len(refs))
+	sem := make(chan struct{}, refWorkers)
+	var wg sync.WaitGroup
+	for _, i := range todo {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				// The indexer recovers from a panic in ESModel, but it
+				// can't see one in this goroutine.
+				if p := recover(); p != nil {
+					errs[i] = newError(repo.id, refs[i].name, ParseStage, fmt.Errorf("Panic while parsing: %v", p))
+				}
+				<-sem
+				wg.Done()
+			}()
+			models[i], errs[i] = repo.newRef(refs[i], sink, stats)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return models, nil
+}
+
+var majorVersionBranchRE = regexp.MustCompile(`^v[0-9]+$`)
+
+// IsIndexedBranch reports whether we index a branch of a git repository. We
+// index the default branch and any branch named for a major version, like
+// "v1". Every other branch is ignored.
+func IsIndexedBranch(name, defaultBranch string) bool {
+	return name == defaultBranch || majorVersionBranchRE.MatchString(name)
+}
+
+// Mostly copied from git.Repository.GetBranches, but altered to get remote
+// branches rather than local.
+func (repo *gitRepository) allBranches() ([]string, error) {
+	prefix := "refs/remotes/origin/"
+	stdout, err := git.NewCommand("for-each-ref", "--format=%(refname)", prefix).RunInDir(repo.clone.Path)
+	if err != nil {
+		return nil, newError(repo.id, "", RefsStage, err)
+	}
+
+	refs := strings.Split(stdout, "\n")
+
+	var branches []string
+	// The last item will be an empty string.
+	for _, ref := range refs[:len(refs)-1] {
+		b := strings.TrimPrefix(ref, prefix)
+		if b == "HEAD" {
+			continue
+		}
+		branches = append(branches, b)
+	}
+
+	return branches, nil
+}
+
+// resolveRef finds the commit a ref points to. For a branch we fetch it
+// first, so we have its latest commit.
+func (repo *gitRepository) resolveRef(r *gitRef) error {
+	repo.l.Infof("   ref = %s", r.name)
+
+	name := r.name
+	if r.isBranch {
+		err := repo.fetch(repo.clone.Path, "origin", r.name)
+		if err != nil {
+			return newError(repo.id, r.name, CloneStage, err)
+		}
+		name = "origin/" + r.name
+	}
+
+	commit, err := repo.commitFor(name)
+	if err != nil {
+		return newError(repo.id, r.name, RefsStage, err)
+	}
+	r.commit = commit
+	return nil
+}
+
+func (repo *gitRepository) newRef(r *gitRef, sink PackageSink, stats *parsecache.Stats) (*esmodels.Ref, error) {
+	c, err := repo.clone.GetCommit(r.commit)
+	if err != nil {
+		return nil, newError(repo.id, r.name, CheckoutStage, err)
+	}
+
+	t, err := tree.NewGit(repo.clone.Path, r.commit, repo.ctx)
+	if err != nil {
+		return nil, newError(repo.id, r.name, CheckoutStage, err)
+	}
+	defer t.Close()
+
+	refType := "tag"
+	if r.isBranch {
+		refType = "branch"
+	}
+
+	// A branch can contain any number of modules, but a version tag is a
+	// version of exactly one of them.
+	w := repo.packageWalker(r.name, t, sink, stats)
+	if !r.isBranch {
+		w.root = r.moduleDir
+		w.moduleOnly = true
+	}
+	err = w.packages()
+	if err != nil {
+		return nil, newError(repo.id, r.name, ParseStage, err)
+	}
+
+	return &esmodels.Ref{
+		Name:                r.name,
+		IsDefaultBranch:     r.name == repo.defaultBranch,
+		RefType:             refType,
+		LastSeenCommit:      c.ID.String(),
+		LastUpdated:         c.Author.When.Format(esmodels.DateTimeFormat),
+		CanonicalImportPath: w.canonicalRoot,
+		Modules:             w.modules,
+		PackageCount:        w.count,
+	}, nil
+}
+
+// commitFor returns the ID of the commit that a ref name points to. For an
+// annotated tag this is the tagged commit, not the tag object.
+func (repo *gitRepository) commitFor(name string) (string, error) {
+	stdout, err := git.NewCommand("rev-parse", name+"^{commit}").RunInDir(repo.clone.Path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// packageWalker returns a walker for the tree of the named ref.
+func (repo *gitRepository) packageWalker(name string, t tree.Tree, sink PackageSink, stats *parsecache.Stats) *packageWalker {
+	return &packageWalker{
+		l:          repo.l,
+		tree:       t,
+		cache:      repo.parseCache,
+		cacheStats: stats,
+		importRoot: repo.id,
+		isGoCore:   repo.isGoCore,
+		browseURL: func(pathInRepo string) string {
+			return repo.browseURL(name, pathInRepo)
+		},
+		resolver: repo.resolver,
+		hostID:   repo.id,
+		put: func(dir string, p *esmodels.Package) error {
+			return sink.Put(name, dir, p)
+		},
+	}
+}
+
+// canonicalImportPaths returns every distinct canonical import path used by
+// the refs. Different refs can have different paths, for example when a
+// repository adds an import comment or moves to a new vanity host.
+func canonicalImportPaths(refs []*esmodels.Ref) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, r := range refs {
+		if r.CanonicalImportPath == "" || seen[r.CanonicalImportPath] {
+			continue
+		}
+		seen[r.CanonicalImportPath] = true
+		paths = append(paths, r.CanonicalImportPath)
+	}
+	return paths
+}
@@ -0,0 +1,262 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/goproxy"
+	"github.com/autarch/metagodoc/indexer/tree"
+	"github.com/autarch/metagodoc/logger"
+
+	"code.gitea.io/git"
+)
+
+// moduleCacheSource gets module versions from a module cache like
+// $GOPATH/pkg/mod. Every version is already extracted in the cache so there
+// is nothing to download.
+type moduleCacheSource struct {
+	root string
+
+	// The cache/download directory inside the module cache is laid out
+	// like a file:// proxy so we can use a proxy client to read the version
+	// info files it contains.
+	download *goproxy.Client
+}
+
+// NewModuleCacheRepository returns a repository for a module found in a
+// local module cache. The versions are those which have a module@version
+// directory in the cache.
+func NewModuleCacheRepository(
+	l *logger.Logger,
+	modCache string,
+	module string,
+	versions []string,
+	ctx context.Context,
+) (*moduleRepository, error) {
+
+	l.Infof("Indexing %s from the module cache at %s", module, modCache)
+
+	sorted := sortVersionsDescending(l, versions)
+	if len(sorted) == 0 {
+		return nil, fmt.Errorf("The module cache at %s has no valid versions of %s", modCache, module)
+	}
+
+	download, err := goproxy.New("file://"+filepath.ToSlash(filepath.Join(modCache, "cache", "download")), "", ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &moduleCacheSource{
+		root:     modCache,
+		download: download,
+	}
+	newest, err := source.versionDir(module, sorted[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &moduleRepository{
+		l:        l,
+		source:   source,
+		versions: sorted,
+		ctx:      ctx,
+		module:   module,
+		id:       module,
+		crawlURL: "file://" + filepath.ToSlash(newest),
+	}, nil
+}
+
+func (mc *moduleCacheSource) versionDir(module, v string) (string, error) {
+	m, err := goproxy.EscapePath(module)
+	if err != nil {
+		return "", err
+	}
+	ev, err := goproxy.EscapePath(v)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mc.root, filepath.FromSlash(m)+"@"+ev), nil
+}
+
+// versionInfo uses the .info file that the go command saves in the download
+// cache. If that's been cleaned out we fall back to the modification time of
+// the version's directory.
+func (mc *moduleCacheSource) versionInfo(module, v string) (time.Time, string, error) {
+	info, err := mc.download.Info(module, v)
+	if err == nil {
+		var commit string
+		if info.Origin != nil {
+			commit = info.Origin.Hash
+		}
+		return info.Time, commit, nil
+	}
+	if err != goproxy.ErrNotFound {
+		return time.Time{}, "", err
+	}
+
+	dir, err := mc.versionDir(module, v)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return fi.ModTime(), "", nil
+}
+
+// directoryRepository is a directory of Go code on local disk, for example
+// a repository checked out under $GOPATH/src. There is only ever one ref,
+// which is whatever is currently in the directory.
+type directoryRepository struct {
+	l   *logger.Logger
+	dir string
+	ctx context.Context
+
+	// The import path of the directory. This is also the ID.
+	id string
+}
+
+func NewDirectoryRepository(
+	l *logger.Logger,
+	dir string,
+	importPath string,
+	ctx context.Context,
+) (*directoryRepository, error) {
+
+	l.Infof("Indexing %s from %s", importPath, dir)
+
+	return &directoryRepository{
+		l:   l,
+		dir: dir,
+		ctx: ctx,
+		id:  importPath,
+	}, nil
+}
+
+// ESModel always rebuilds the ref. The files in a local directory can change
+// without any new commit so there's nothing we can use to tell whether the
+// previous document is still accurate.
+func (repo *directoryRepository) ESModel(previous *esmodels.Repository, sink PackageSink) (*esmodels.Repository, error) {
+	out, err := optedOutIn(repo.l, repo.dir)
+	if err != nil {
+		return nil, newError(repo.id, "", MetadataStage, err)
+	}
+	if out {
+		return nil, ErrOptedOut
+	}
+
+	fi, err := os.Stat(repo.dir)
+	if err != nil {
+		return nil, newError(repo.id, "", MetadataStage, err)
+	}
+	modified := fi.ModTime().UTC().Format(esmodels.DateTimeFormat)
+
+	vcs, err := repo.vcs()
+	if err != nil {
+		return nil, newError(repo.id, "", MetadataStage, err)
+	}
+	ref, err := repo.getRef(vcs, sink)
+	if err != nil {
+		return nil, err
+	}
+	about, err := readmeIn(tree.Dir(repo.dir))
+	if err != nil {
+		return nil, newError(repo.id, ref.Name, MetadataStage, err)
+	}
+
+	return &esmodels.Repository{
+		ID:          repo.id,
+		Name:        path.Base(repo.id),
+		FullName:    repo.id,
+		VCS:         vcs,
+		PrimaryURL:  "https://" + repo.id,
+		Owner:       path.Base(path.Dir(repo.id)),
+		Created:     modified,
+		LastUpdated: ref.LastUpdated,
+		LastCrawled: time.Now().UTC().Format(esmodels.DateTimeFormat),
+		Status:      esmodels.Active,
+		About:       about,
+		Refs:        []*esmodels.Ref{ref},
+	}, nil
+}
+
+func (repo *directoryRepository) ID() string {
+	return repo.id
+}
+
+func (repo *directoryRepository) CrawlURL() string {
+	return "file://" + filepath.ToSlash(repo.dir)
+}
+
+func (repo *directoryRepository) vcs() (string, error) {
+	isGit, err := pathExists(filepath.Join(repo.dir, ".git"))
+	if err != nil || !isGit {
+		return "", err
+	}
+	return string(esmodels.Git), nil
+}
+
+// getRef makes a ref from whatever is in the directory. If the directory is a
+// git checkout we use its current branch and commit. Otherwise the ref is
+// named "local".
+func (repo *directoryRepository) getRef(vcs string, sink PackageSink) (*esmodels.Ref, error) {
+	ref := &esmodels.Ref{
+		Name:            "local",
+		IsDefaultBranch: true,
+		RefType:         "directory",
+	}
+
+	fi, err := os.Stat(repo.dir)
+	if err != nil {
+		return nil, newError(repo.id, ref.Name, MetadataStage, err)
+	}
+	ref.LastUpdated = fi.ModTime().UTC().Format(esmodels.DateTimeFormat)
+
+	if vcs == string(esmodels.Git) {
+		c, err := git.OpenRepository(repo.dir)
+		if err != nil {
+			return nil, newError(repo.id, ref.Name, RefsStage, err)
+		}
+		head, err := c.GetCommit("HEAD")
+		if err != nil {
+			return nil, newError(repo.id, ref.Name, RefsStage, err)
+		}
+		branch, err := git.NewCommand("rev-parse", "--abbrev-ref", "HEAD").RunInDir(repo.dir)
+		if err != nil {
+			return nil, newError(repo.id, ref.Name, RefsStage, err)
+		}
+
+		ref.Name = strings.TrimSpace(branch)
+		ref.RefType = "branch"
+		ref.LastSeenCommit = head.ID.String()
+		ref.LastUpdated = head.Author.When.UTC().Format(esmodels.DateTimeFormat)
+	}
+
+	repo.l.Infof("   ref = %s", ref.Name)
+
+	w := &packageWalker{
+		l:          repo.l,
+		tree:       tree.Dir(repo.dir),
+		importRoot: repo.id,
+		browseURL:  func(string) string { return "" },
+		put: func(dir string, p *esmodels.Package) error {
+			return sink.Put(ref.Name, dir, p)
+		},
+	}
+	err = w.packages()
+	if err != nil {
+		return nil, newError(repo.id, ref.Name, ParseStage, err)
+	}
+	ref.PackageCount = w.count
+	ref.Modules = w.modules
+	ref.CanonicalImportPath = w.canonicalRoot
+
+	return ref, nil
+}
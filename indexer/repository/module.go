@@ -0,0 +1,384 @@
+package repository
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/goproxy"
+	"github.com/autarch/metagodoc/indexer/tree"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+	version "github.com/hashicorp/go-version"
+)
+
+// moduleRepository is a Go module where each version of the module becomes a
+// ref. We never clone anything for these. Instead we get a directory
+// containing the files for each version from a moduleSource and index that.
+type moduleRepository struct {
+	l        *logger.Logger
+	source   moduleSource
+	versions []string
+	ctx      context.Context
+
+	// The module path, like "golang.org/x/text".
+	module string
+	// For a module from a module cache this is the module path. For a module
+	// from a proxy it is the module path under the proxy's namespace, like
+	// "proxy.golang.org/golang.org/x/text". The module path on its own is
+	// the ID the GitHub and git crawlers give the repository the module
+	// comes from, and we don't want to overwrite that document with one
+	// whose refs are versions.
+	id string
+	// The URL of the module under the proxy, or of the newest version's
+	// directory in the module cache.
+	crawlURL string
+}
+
+// moduleSource provides the files and metadata for each version of a
+// module.
+type moduleSource interface {
+	// Returns the directory containing the files for the version.
+	versionDir(module, version string) (string, error)
+	// Returns the time the version was created and the commit it was
+	// created from. The commit may be empty if it is not known.
+	versionInfo(module, version string) (time.Time, string, error)
+}
+
+// proxySource gets module versions from a module proxy. The zip file for each
+// version is extracted under the cache root.
+type proxySource struct {
+	l           *logger.Logger
+	proxy       *goproxy.Client
+	extractRoot string
+}
+
+func NewModuleRepository(
+	l *logger.Logger,
+	proxy *goproxy.Client,
+	module string,
+	cacheRoot string,
+	retention Retention,
+	ctx context.Context,
+) (*moduleRepository, error) {
+
+	l.Infof("Indexing %s from %s", module, proxy.URL())
+
+	versions, err := proxy.List(module)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not list the versions of %s: {{err}}", module), err)
+	}
+
+	// A module without any tags only has pseudo-versions, which are never
+	// included in the list. In that case we index whatever the proxy
+	// considers the latest version.
+	if len(versions) == 0 {
+		info, err := proxy.Latest(module)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Could not get the latest version of %s: {{err}}", module), err)
+		}
+		versions = []string{info.Version}
+	}
+
+	sorted := retention.keep(sortVersionsDescending(l, versions))
+	if len(sorted) == 0 {
+		return nil, fmt.Errorf("The proxy at %s has no valid versions of %s", proxy.URL(), module)
+	}
+
+	return &moduleRepository{
+		l: l,
+		source: &proxySource{
+			l:           l,
+			proxy:       proxy,
+			extractRoot: filepath.Join(cacheRoot, "modules"),
+		},
+		versions: sorted,
+		ctx:      ctx,
+		module:   module,
+		id:       proxy.Namespace() + "/" + module,
+		crawlURL: strings.TrimSuffix(proxy.URL(), "/") + "/" + module,
+	}, nil
+}
+
+// sortVersionsDescending returns the versions from newest to oldest,
+// dropping anything that isn't a valid version.
+func sortVersionsDescending(l *logger.Logger, versions []string) []string {
+	var coll version.Collection
+	orig := make(map[*version.Version]string)
+	for _, v := range versions {
+		parsed, err := version.NewVersion(v)
+		if err != nil {
+			l.Infof("  ignoring invalid version %s: %s", v, err)
+			continue
+		}
+		coll = append(coll, parsed)
+		orig[parsed] = v
+	}
+
+	sort.Sort(sort.Reverse(coll))
+
+	var sorted []string
+	for _, v := range coll {
+		sorted = append(sorted, orig[v])
+	}
+	return sorted
+}
+
+func (repo *moduleRepository) ESModel(previous *esmodels.Repository, sink PackageSink) (*esmodels.Repository, error) {
+	// The newest version is what we check for an opt out and where we get
+	// the README from.
+	dir, err := repo.source.versionDir(repo.module, repo.versions[0])
+	if err != nil {
+		return nil, newError(repo.id, repo.versions[0], DownloadStage, err)
+	}
+	out, err := optedOutIn(repo.l, dir)
+	if err != nil {
+		return nil, newError(repo.id, repo.versions[0], MetadataStage, err)
+	}
+	if out {
+		return nil, ErrOptedOut
+	}
+
+	cache := newRefCache(repo.l, previous)
+	def := repo.defaultVersion()
+	var refs []*esmodels.Ref
+	var oldest, newest time.Time
+	for i, v := range repo.versions {
+		ref, t, err := repo.newRef(v, cache, sink)
+		if err != nil {
+			return nil, err
+		}
+		ref.IsDefaultBranch = v == def
+		refs = append(refs, ref)
+
+		if i == 0 {
+			newest = t
+		}
+		oldest = t
+	}
+	cache.report()
+
+	status := esmodels.Active
+	if time.Now().Sub(newest) > twoYears {
+		status = esmodels.NoRecentCommits
+	}
+
+	about, err := readmeIn(tree.Dir(dir))
+	if err != nil {
+		return nil, newError(repo.id, repo.versions[0], MetadataStage, err)
+	}
+
+	return &esmodels.Repository{
+		ID:          repo.id,
+		Name:        path.Base(repo.module),
+		FullName:    repo.module,
+		PrimaryURL:  "https://" + repo.module,
+		Owner:       path.Base(path.Dir(repo.module)),
+		Created:     oldest.UTC().Format(esmodels.DateTimeFormat),
+		LastUpdated: newest.UTC().Format(esmodels.DateTimeFormat),
+		LastCrawled: time.Now().UTC().Format(esmodels.DateTimeFormat),
+		Status:      status,
+		About:       about,
+		Refs:        refs,
+	}, nil
+}
+
+// defaultVersion is the version we want people to see by default. This is
+// the newest version that isn't a prerelease, if there is one.
+func (repo *moduleRepository) defaultVersion() string {
+	for _, v := range repo.versions {
+		parsed, err := version.NewVersion(v)
+		if err == nil && parsed.Prerelease() == "" {
+			return v
+		}
+	}
+	return repo.versions[0]
+}
+
+func (repo *moduleRepository) ID() string {
+	return repo.id
+}
+
+func (repo *moduleRepository) CrawlURL() string {
+	return repo.crawlURL
+}
+
+func (repo *moduleRepository) newRef(v string, cache *refCache, sink PackageSink) (*esmodels.Ref, time.Time, error) {
+	repo.l.Infof("   version = %s", v)
+
+	t, commit, err := repo.source.versionInfo(repo.module, v)
+	if err != nil {
+		return nil, time.Time{}, newError(repo.id, v, RefsStage, err)
+	}
+
+	// Module versions are immutable, so a version we've already indexed can
+	// always be reused unless the source now knows a different commit for
+	// it. This also means we don't have to download it again.
+	if ref := cache.reuse(v, commit); ref != nil {
+		return ref, t, nil
+	}
+
+	dir, err := repo.source.versionDir(repo.module, v)
+	if err != nil {
+		return nil, time.Time{}, newError(repo.id, v, DownloadStage, err)
+	}
+
+	w := &packageWalker{
+		l:                    repo.l,
+		tree:                 tree.Dir(dir),
+		importRoot:           repo.module,
+		browseURL:            func(string) string { return "" },
+		ignoreImportComments: true,
+		moduleOnly:           true,
+		put: func(dir string, p *esmodels.Package) error {
+			return sink.Put(v, dir, p)
+		},
+	}
+
+	err = w.packages()
+	if err != nil {
+		return nil, time.Time{}, newError(repo.id, v, ParseStage, err)
+	}
+
+	return &esmodels.Ref{
+		Name:           v,
+		RefType:        "version",
+		LastSeenCommit: commit,
+		LastUpdated:    t.UTC().Format(esmodels.DateTimeFormat),
+		Modules:        w.modules,
+		PackageCount:   w.count,
+	}, t, nil
+}
+
+func (ps *proxySource) versionInfo(module, v string) (time.Time, string, error) {
+	info, err := ps.proxy.Info(module, v)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	// Newer proxies tell us which commit a version came from.
+	var commit string
+	if info.Origin != nil {
+		commit = info.Origin.Hash
+	}
+
+	return info.Time, commit, nil
+}
+
+func (ps *proxySource) extractDir(module, v string) (string, error) {
+	m, err := goproxy.EscapePath(module)
+	if err != nil {
+		return "", err
+	}
+	ev, err := goproxy.EscapePath(v)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(ps.extractRoot, filepath.FromSlash(m)+"@"+ev), nil
+}
+
+// versionDir downloads the zip file for a version of the module and extracts
+// it under the cache root. Module versions are immutable so if we already
+// have an extracted copy we just use that.
+func (ps *proxySource) versionDir(module, v string) (string, error) {
+	dir, err := ps.extractDir(module, v)
+	if err != nil {
+		return "", err
+	}
+	exists, err := pathExists(dir)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return dir, nil
+	}
+
+	ps.l.Infof("    downloading and extracting to %s", dir)
+	z, err := ps.proxy.Zip(module, v)
+	if err != nil {
+		return "", err
+	}
+
+	// We extract to a temporary directory and then rename it so that a
+	// crash in the middle of extraction doesn't leave a partial tree behind
+	// that we'd later mistake for a complete one.
+	tmp := dir + ".tmp"
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	err = extractModuleZip(z, module+"@"+v+"/", tmp)
+	if err != nil {
+		return "", err
+	}
+
+	return dir, os.Rename(tmp, dir)
+}
+
+// extractModuleZip extracts a module zip file into dir. Every file in a
+// module zip is under a "module@version/" prefix which we strip.
+func extractModuleZip(z []byte, prefix, dir string) error {
+	r, err := zip.NewReader(bytes.NewReader(z), int64(len(z)))
+	if err != nil {
+		return errwrap.Wrapf("Could not read the module zip file: {{err}}", err)
+	}
+
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return fmt.Errorf("The module zip file contains a file outside of %s: %s", prefix, f.Name)
+		}
+
+		name := strings.TrimPrefix(f.Name, prefix)
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		clean := path.Clean(name)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("The module zip file contains an invalid path: %s", f.Name)
+		}
+
+		err := extractZipFile(f, filepath.Join(dir, filepath.FromSlash(clean)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractZipFile(f *zip.File, to string) error {
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, rc)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
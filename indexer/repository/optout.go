@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"code.gitea.io/git"
+)
+
+// ErrOptedOut is returned by ESModel when the owners of a repository have
+// asked us not to index it. They do this by committing a metagodoc.json file
+// to the root of the default branch containing {"noindex": true}.
+var ErrOptedOut = errors.New("The owners of this repository have opted out of indexing")
+
+const projectConfigFile = "metagodoc.json"
+
+// projectConfig is the contents of a metagodoc.json file.
+type projectConfig struct {
+	NoIndex bool `json:"noindex"`
+}
+
+// optedOut parses the contents of a metagodoc.json file. If the file is not
+// valid JSON we log that and carry on as if it wasn't there.
+func optedOut(l *logger.Logger, content []byte) bool {
+	c := &projectConfig{}
+	err := json.Unmarshal(content, c)
+	if err != nil {
+		l.Infof("  ignoring the invalid %s file: %s", projectConfigFile, err)
+		return false
+	}
+	if c.NoIndex {
+		l.Infof("  %s says not to index this repository", projectConfigFile)
+	}
+	return c.NoIndex
+}
+
+// optedOutIn checks for a metagodoc.json file in a directory.
+func optedOutIn(l *logger.Logger, dir string) (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, projectConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return optedOut(l, content), nil
+}
+
+// optedOut reads the metagodoc.json file from the default branch without
+// checking it out.
+func (repo *gitRepository) optedOut() (bool, error) {
+	branch := "origin/" + repo.defaultBranch
+	stdout, err := git.NewCommand("ls-tree", "--name-only", branch, projectConfigFile).RunInDir(repo.clone.Path)
+	if err != nil {
+		return false, newError(repo.id, repo.defaultBranch, RefsStage, err)
+	}
+	if strings.TrimSpace(stdout) == "" {
+		return false, nil
+	}
+
+	content, err := git.NewCommand("cat-file", "blob", branch+":"+projectConfigFile).RunInDir(repo.clone.Path)
+	if err != nil {
+		return false, newError(repo.id, repo.defaultBranch, MetadataStage, err)
+	}
+	return optedOut(repo.l, []byte(content)), nil
+}
@@ -0,0 +1,581 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/autarch/metagodoc/doc"
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/indexer/directory"
+	"github.com/autarch/metagodoc/indexer/gomod"
+	"github.com/autarch/metagodoc/indexer/parsecache"
+	"github.com/autarch/metagodoc/indexer/tree"
+	"github.com/autarch/metagodoc/indexer/vanity"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/golang/gddo/gosrc"
+	"github.com/hashicorp/errwrap"
+)
+
+// packageWalker finds all the packages in a directory tree. The tree can be
+// a commit in a git clone, an extracted module zip file, or anything else
+// that contains Go code laid out the usual way. Every directory the walker
+// deals with is a slash-separated path relative to the root of the tree.
+type packageWalker struct {
+	l *logger.Logger
+
+	// The tree we're walking.
+	tree tree.Tree
+
+	// The directory to start walking from. An empty string means the root
+	// of the tree. This is set when a ref is a version of a module in a
+	// subdirectory.
+	root string
+
+	// If this is true we only walk the module at the root, like the go tool
+	// does for a pattern like "./...", and skip any directory with its own
+	// go.mod file. Otherwise each of those is indexed as a separate module.
+	moduleOnly bool
+
+	// The import path that corresponds to the root directory.
+	importRoot string
+
+	// The go core repo is laid out differently from everything else. The
+	// standard library's import paths come from where each directory is
+	// under one of the stdlibRoots, and stdlib holds the flags for every
+	// import path in the tree we're walking.
+	isGoCore    bool
+	stdlibRoots []stdlibRoot
+	stdlib      map[string]int
+
+	// Returns the URL at which a directory in the tree can be viewed on the
+	// web. The pathInRepo is either empty or starts with a "/".
+	browseURL func(pathInRepo string) string
+
+	// If the tree has a hash for each directory then we look for packages
+	// in this cache before parsing them, and count the lookups in
+	// cacheStats. The cache may be nil.
+	cache      *parsecache.Cache
+	cacheStats *parsecache.Stats
+
+	// This is used to check that an import comment pointing at another
+	// import path really refers to this repository. If this is nil then
+	// packages with such a comment are skipped.
+	resolver *vanity.Resolver
+
+	// The ID of the repository we are walking. A vanity import path is only
+	// accepted if its go-import or go-source meta tag points back here.
+	hostID string
+
+	// Module mode ignores import comments, since the module path is always
+	// canonical. If this is true we never look for a vanity import path.
+	// This is implied for any package inside a directory with a go.mod
+	// file.
+	ignoreImportComments bool
+
+	// The canonical import path for the root, if we found one via an import
+	// comment or the root's go.mod file.
+	canonicalRoot string
+
+	// Every module in the tree, in the order we found them.
+	modules []*esmodels.Module
+
+	// The module that the directory being walked belongs to, and the
+	// directory containing its go.mod file. The module is nil if we're not
+	// in a module.
+	module    *esmodels.Module
+	moduleDir string
+
+	// Every package we find is given to put as soon as it's built, along
+	// with its directory, and counted.
+	put   func(dir string, p *esmodels.Package) error
+	count int
+
+	// The directories of packages outside of any module that we put before
+	// we knew the canonical import path for the root. These are the only
+	// packages that get their import paths from importRoot.
+	early []string
+}
+
+// packages walks the whole tree and puts every package it finds. Every
+// directory containing a go.mod file is the root of a module and the packages
+// inside it get their import paths from the module path. For packages outside
+// of any module, if any of them has an import comment that resolves to a
+// vanity import path for this repository then the packages we put before we
+// found that comment are built and put again with the vanity path. The parse
+// cache usually makes that cheap.
+func (w *packageWalker) packages() error {
+	if w.isGoCore {
+		return w.stdlibPackages()
+	}
+
+	if w.root == "" {
+		w.root = "."
+	}
+	exists, err := tree.IsDir(w.tree, w.root)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		w.l.Infof("      %s does not exist", w.root)
+		return nil
+	}
+
+	err = w.walk(w.root)
+	if err != nil {
+		return err
+	}
+
+	if w.canonicalRoot == "" && len(w.modules) > 0 && w.modules[0].Dir == "" && w.modules[0].Path != w.importRoot {
+		w.canonicalRoot = w.modules[0].Path
+	}
+
+	if w.canonicalRoot == "" {
+		return nil
+	}
+
+	for _, d := range w.early {
+		p, err := w.packageForDir(d)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		w.l.Infof("      package = %s (was under %s)", p.ImportPath, w.importRoot)
+		err = w.put(d, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stdlibPackages walks each of the directories that contain the standard
+// library in the go core repo.
+func (w *packageWalker) stdlibPackages() error {
+	roots, err := stdlibRoots(w.tree)
+	if err != nil {
+		return err
+	}
+	flags, err := stdlibPathFlags(w.tree, roots)
+	if err != nil {
+		return err
+	}
+	w.stdlibRoots, w.stdlib = roots, flags
+
+	for _, r := range roots {
+		err := w.walk(r.dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stdlibImportPath returns the import path of a directory in the go core
+// repo, or an empty string if it isn't in the standard library.
+func (w *packageWalker) stdlibImportPath(dir string) string {
+	for _, r := range w.stdlibRoots {
+		if ip := r.importPath(dir); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+func (w *packageWalker) walk(dir string) error {
+	files, err := w.tree.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// A go.mod file in a subdirectory makes that directory a separate
+	// module rather than part of the module we're already in.
+	m, found, err := w.readModule(dir)
+	if err != nil {
+		return err
+	}
+	if found && dir != w.root && (m == nil || w.moduleOnly) {
+		if m == nil {
+			w.l.Infof("      skipping %s, which has a go.mod file we can't parse", dir)
+		}
+		return nil
+	}
+	if m != nil {
+		w.l.Infof("      module = %s", m.Path)
+		w.modules = append(w.modules, m)
+
+		outerModule, outerDir := w.module, w.moduleDir
+		w.module, w.moduleDir = m, dir
+		defer func() {
+			w.module, w.moduleDir = outerModule, outerDir
+		}()
+	}
+
+	hasGoFiles := false
+	for _, f := range files {
+		if !f.IsDir {
+			hasGoFiles = hasGoFiles || directory.IsGoFile(f.Name)
+			continue
+		}
+
+		subDir := path.Join(dir, f.Name)
+		// This skips testdata directories in the go core repo, which
+		// contain go code that should be ignored.
+		if w.isGoCore && w.stdlib[w.stdlibImportPath(subDir)]&goRepoPath == 0 {
+			continue
+		}
+		if !walkable(f.Name) {
+			continue
+		}
+		err := w.walk(subDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hasGoFiles {
+		return nil
+	}
+	if w.isGoCore && w.stdlib[w.stdlibImportPath(dir)]&packagePath == 0 {
+		return nil
+	}
+
+	p, err := w.packageForDir(dir)
+	if err != nil || p == nil {
+		return err
+	}
+
+	w.l.Infof("      package = %s", p.ImportPath)
+	if w.module == nil && w.canonicalRoot == "" && !w.isGoCore {
+		w.early = append(w.early, dir)
+	}
+	w.count++
+	return w.put(dir, p)
+}
+
+// walkable reports whether the go tool would look for packages in a
+// directory with this name when matching a pattern like "./...". Vendored
+// code belongs to some other repository, so we skip that as well.
+func walkable(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+		return false
+	}
+	return name != "testdata" && name != "vendor"
+}
+
+// isInternal reports whether an import path has an "internal" element. The
+// go tool only lets code in the tree rooted at the parent of that element
+// import such a package.
+func isInternal(importPath string) bool {
+	for _, elem := range strings.Split(importPath, "/") {
+		if elem == "internal" {
+			return true
+		}
+	}
+	return false
+}
+
+// readModule parses the go.mod file in a directory, if there is one. This
+// returns whether the file was found, since even a file we can't parse marks
+// the boundary of a module. If the file cannot be parsed we log the error and
+// return a nil module.
+func (w *packageWalker) readModule(dir string) (*esmodels.Module, bool, error) {
+	// The go core repo has go.mod files for the "std" and "cmd" modules,
+	// but those aren't import paths.
+	if w.isGoCore {
+		return nil, false, nil
+	}
+
+	content, err := w.tree.ReadFile(path.Join(dir, "go.mod"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+
+	f, err := gomod.Parse(content)
+	if err != nil {
+		w.l.Infof("      ignoring the go.mod file in %s: %s", dir, err)
+		return nil, true, nil
+	}
+
+	rel := dir
+	if rel == "." {
+		rel = ""
+	}
+
+	return newModule(f, rel), true, nil
+}
+
+func newModule(f *gomod.File, dir string) *esmodels.Module {
+	m := &esmodels.Module{
+		Path:       f.Module,
+		Dir:        dir,
+		GoVersion:  f.Go,
+		Deprecated: f.Deprecated,
+	}
+	for _, r := range f.Require {
+		m.Requires = append(m.Requires, &esmodels.ModuleRequire{
+			Path:     r.Path,
+			Version:  r.Version,
+			Indirect: r.Indirect,
+		})
+	}
+	for _, r := range f.Replace {
+		m.Replaces = append(m.Replaces, &esmodels.ModuleReplace{
+			OldPath:    r.OldPath,
+			OldVersion: r.OldVersion,
+			NewPath:    r.NewPath,
+			NewVersion: r.NewVersion,
+		})
+	}
+	for _, e := range f.Exclude {
+		m.Excludes = append(m.Excludes, &esmodels.ModuleVersion{
+			Path:    e.Path,
+			Version: e.Version,
+		})
+	}
+	for _, r := range f.Retract {
+		m.Retracts = append(m.Retracts, &esmodels.ModuleRetract{
+			Low:       r.Low,
+			High:      r.High,
+			Rationale: r.Rationale,
+		})
+	}
+	return m
+}
+
+func (w *packageWalker) packageForDir(d string) (*esmodels.Package, error) {
+	var pathInRepo string
+	if d != "." {
+		pathInRepo = "/" + d
+	}
+
+	importPath := w.importRoot + pathInRepo
+	if w.isGoCore {
+		importPath = w.stdlibImportPath(d)
+	}
+
+	if w.module != nil {
+		importPath = w.module.Path
+		if inModule := relPath(w.moduleDir, d); inModule != "." {
+			importPath += "/" + inModule
+		}
+	} else if w.canonicalRoot != "" {
+		importPath = w.canonicalRoot + pathInRepo
+	}
+
+	pkg, err := w.newPackage(d, importPath, pathInRepo)
+	if err != nil {
+		// If this is true it means that this package has an import comment
+		// saying that it lives at a different canonical import path. This
+		// can happen when a package has a GitHub repo but you should import
+		// it via gopkg.in or some other host.
+		nf, ok := err.(gosrc.NotFoundError)
+		if !ok {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse %s: {{err}}", importPath), err)
+		}
+
+		canonical, ok := w.canonicalPath(nf.Redirect, pathInRepo)
+		if !ok {
+			w.l.Infof("      skipping %s, which should be imported as %s", importPath, nf.Redirect)
+			return nil, nil
+		}
+
+		pkg, err = w.newPackage(d, canonical, pathInRepo)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse %s: {{err}}", canonical), err)
+		}
+		if !w.inModuleMode() {
+			importPath = canonical
+		}
+	}
+	if pkg == nil {
+		return nil, nil
+	}
+
+	pkg.ImportPath = importPath
+	pkg.IsInternal = isInternal(importPath)
+	return pkg, nil
+}
+
+// newPackage builds the package in a directory. If we've already built the
+// package for a directory with exactly the same contents then we use that
+// instead of parsing everything again.
+func (w *packageWalker) newPackage(d, importPath, pathInRepo string) (*esmodels.Package, error) {
+	rootURL := w.browseURL(pathInRepo)
+
+	hash := w.dirHash(d, importPath)
+	if hash != "" {
+		e, err := w.cache.Get(hash, w.cacheStats)
+		if err != nil {
+			w.l.Infof("      could not read %s from the parse cache: %s", importPath, err)
+		}
+		if e != nil {
+			if e.ImportComment != "" && e.ImportComment != importPath {
+				return nil, gosrc.NotFoundError{
+					Message:  "not at canonical import path",
+					Redirect: e.ImportComment,
+				}
+			}
+			e.Package.ImportPath = importPath
+			setFileURLs(e.Package.Files, rootURL)
+			setFileURLs(e.Package.TestFiles, rootURL)
+			return e.Package, nil
+		}
+	}
+
+	dir, err := directory.New(w.tree, d, importPath, rootURL)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := doc.NewPackage(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The go tool doesn't consider a directory to be a package if none of
+	// its files can be built, for example because they're all marked with
+	// "//go:build ignore".
+	if len(pkg.Files) == 0 && len(pkg.TestFiles) == 0 && len(pkg.Errors) == 0 {
+		return nil, nil
+	}
+
+	p := &esmodels.Package{
+		Name:         pkg.Name,
+		ImportPath:   importPath,
+		Doc:          pkg.Doc,
+		Synopsis:     pkg.Synopsis,
+		Errors:       pkg.Errors,
+		IsCommand:    pkg.IsCmd,
+		Files:        pkg.Files,
+		TestFiles:    pkg.TestFiles,
+		Imports:      pkg.Imports,
+		TestImports:  pkg.TestImports,
+		XTestImports: pkg.XTestImports,
+		Consts:       pkg.Consts,
+		Funcs:        pkg.Funcs,
+		Types:        pkg.Types,
+		Vars:         pkg.Vars,
+		Examples:     pkg.Examples,
+		Notes:        pkg.Notes,
+	}
+
+	if hash != "" {
+		err := w.cache.Put(hash, &parsecache.Entry{ImportComment: pkg.ImportComment, Package: p})
+		if err != nil {
+			w.l.Infof("      could not add %s to the parse cache: %s", importPath, err)
+		}
+	}
+	return p, nil
+}
+
+// dirHash returns the hash of a directory's contents, or an empty string if
+// we shouldn't use the parse cache for it.
+func (w *packageWalker) dirHash(d, importPath string) string {
+	if w.cache == nil || doc.ImportPathMatters(importPath) {
+		return ""
+	}
+	h, ok := w.tree.(tree.Hasher)
+	if !ok {
+		return ""
+	}
+	hash, _ := h.DirHash(d)
+	return hash
+}
+
+// setFileURLs points the files of a cached package at the ref we're walking,
+// the same way directory.New does.
+func setFileURLs(files []*doc.File, rootURL string) {
+	for _, f := range files {
+		f.URL = ""
+		if rootURL != "" {
+			f.URL = rootURL + "/" + f.Name
+		}
+	}
+}
+
+// inModuleMode is true when import comments should be ignored because the
+// package is in a module, whose path is always canonical.
+func (w *packageWalker) inModuleMode() bool {
+	return w.ignoreImportComments || w.module != nil
+}
+
+// canonicalPath decides whether we can use the import path from an import
+// comment. In module mode we always can. Otherwise the comment must point to
+// the same directory under a vanity import path that resolves back to this
+// repository. It returns the import path to use when building the package.
+func (w *packageWalker) canonicalPath(redirect, pathInRepo string) (string, bool) {
+	if w.inModuleMode() {
+		return redirect, true
+	}
+	if w.resolver == nil || w.isGoCore || redirect == "" || !strings.HasSuffix(redirect, pathInRepo) {
+		return "", false
+	}
+
+	root := strings.TrimSuffix(redirect, pathInRepo)
+	if w.canonicalRoot != "" {
+		return redirect, root == w.canonicalRoot
+	}
+
+	m, err := w.resolver.Resolve(root)
+	if err != nil {
+		w.l.Infof("      could not resolve the vanity import path %s: %s", root, err)
+		return "", false
+	}
+	if m.Prefix != root || !w.isHostedHere(m) {
+		return "", false
+	}
+
+	w.l.Infof("      %s is the canonical import path for %s", root, w.hostID)
+	w.canonicalRoot = root
+	return redirect, true
+}
+
+// isHostedHere checks whether the meta tags for a vanity import path point to
+// the repository we are walking. The go-import URL is often not the URL we
+// cloned from. For example, gopkg.in serves clones itself and golang.org/x
+// points at go.googlesource.com. But in those cases the go-source home page
+// is the repository we know about. Some hosts, like gopkg.in, leave the home
+// page out ("_"), so we also look at the directory URL template.
+func (w *packageWalker) isHostedHere(m *vanity.Meta) bool {
+	id, err := gitRepositoryID(m.RepoURL)
+	if err == nil && strings.EqualFold(id, w.hostID) {
+		return true
+	}
+
+	if m.Source == nil {
+		return false
+	}
+	hostID := strings.ToLower(w.hostID)
+	for _, u := range []string{m.Source.Home, m.Source.Directory} {
+		if i := strings.Index(u, "{"); i != -1 {
+			u = u[:i]
+		}
+		id, err := gitRepositoryID(u)
+		if err == nil && hasPathPrefix(strings.ToLower(id), hostID) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPathPrefix(s, prefix string) bool {
+	return s == prefix || strings.HasPrefix(s, prefix+"/")
+}
+
+// relPath returns p relative to base, where both are slash-separated paths
+// in a tree and p is base or somewhere under it.
+func relPath(base, p string) string {
+	if p == base {
+		return "."
+	}
+	if base == "." {
+		return p
+	}
+	return strings.TrimPrefix(p, base+"/")
+}
@@ -1,8 +1,110 @@
 package repository
 
-import "github.com/autarch/metagodoc/esmodels"
+import (
+	"github.com/autarch/metagodoc/esmodels"
+	"github.com/autarch/metagodoc/logger"
+)
 
 type Repository interface {
-	ESModel() *esmodels.Repository
+	// ESModel builds the document for the repository. The previous document
+	// is what we stored the last time we indexed the repository, or nil if
+	// this is the first time. Any ref that still points at the commit we
+	// saw last time is copied from the previous document rather than being
+	// checked out and parsed again. The packages in every other ref are
+	// given to the sink as they are built, so the returned document never
+	// contains any packages. This returns ErrOptedOut if the repository's
+	// owners don't want it indexed. Any other error is an *Error saying
+	// what went wrong and where.
+	ESModel(previous *esmodels.Repository, sink PackageSink) (*esmodels.Repository, error)
 	ID() string
+	// CrawlURL returns a URL that the crawler which found the repository
+	// can pass to CrawlOne to find it again. The ID isn't always enough
+	// for that. For example, the ID of a repository cloned from a file://
+	// URL is just its path.
+	CrawlURL() string
+}
+
+// PartialRebuilder is implemented by repositories that can rebuild just some
+// of their refs. Any other ref that is in the previous document is copied
+// from it as is, without checking whether it has moved. A ref that is no
+// longer in the repository is still left out of the new document.
+type PartialRebuilder interface {
+	// RebuildOnly must be called before ESModel.
+	RebuildOnly(refs []string)
+}
+
+// PackageSink receives each package as soon as it is built so that we never
+// hold all of a repository's packages in memory. The dir is the package's
+// directory relative to the repository root. Put may be called from more than
+// one goroutine at once. It may also be called more than once for the same
+// directory of a ref, in which case the last package wins.
+type PackageSink interface {
+	Put(ref, dir string, p *esmodels.Package) error
+}
+
+// refCache holds the refs from a previously stored document so that
+// unchanged refs can be reused. It also counts how many refs were reused
+// versus rebuilt so we can report that in the crawl log.
+type refCache struct {
+	l       *logger.Logger
+	refs    map[string]*esmodels.Ref
+	reused  int
+	rebuilt int
+}
+
+func newRefCache(l *logger.Logger, previous *esmodels.Repository) *refCache {
+	c := &refCache{l: l, refs: make(map[string]*esmodels.Ref)}
+	if previous == nil {
+		return c
+	}
+	for _, r := range previous.Refs {
+		c.refs[r.Name] = r
+	}
+	return c
+}
+
+// reuse returns a copy of the previous ref with the given name if it was at
+// the same commit. Otherwise it returns nil and the caller must build the ref
+// from scratch. An empty commit only matches an empty commit, which is what
+// we want for immutable refs like module versions where the commit may not
+// be known.
+func (c *refCache) reuse(name, commit string) *esmodels.Ref {
+	prev := c.refs[name]
+	if prev == nil || prev.LastSeenCommit != commit {
+		c.rebuilt++
+		return nil
+	}
+
+	c.l.Infof("      %s is unchanged at %s, reusing its packages", name, shortCommit(commit))
+	c.reused++
+	ref := *prev
+	return &ref
+}
+
+// keep returns a copy of the previous ref with the given name no matter what
+// commit it was at, or nil if there wasn't one.
+func (c *refCache) keep(name string) *esmodels.Ref {
+	prev := c.refs[name]
+	if prev == nil {
+		return nil
+	}
+
+	c.l.Infof("      %s did not change, reusing its packages", name)
+	c.reused++
+	ref := *prev
+	return &ref
+}
+
+func (c *refCache) report() {
+	c.l.Infof("  reused %d unchanged refs and rebuilt %d refs", c.reused, c.rebuilt)
+}
+
+func shortCommit(commit string) string {
+	if commit == "" {
+		return "an unknown commit"
+	}
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
 }
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"path"
+	"strings"
+
+	"github.com/autarch/metagodoc/indexer/tree"
+)
+
+// The flags we keep for each import path in the go core repo. These are the
+// same flags that gddo's gosrc package uses, but rather than a static table
+// of the paths from one Go release we compute them from the tree at each tag.
+const (
+	// The path is a directory under the standard library's source root.
+	goRepoPath = 1
+	// The directory contains Go files, so it is a package.
+	packagePath = 2
+)
+
+// stdlibRoot is a directory in the go core repo that contains standard
+// library packages, along with the import path prefix for the directories
+// inside it.
+type stdlibRoot struct {
+	dir    string
+	prefix string
+}
+
+// stdlibRoots finds the directories containing the standard library in a
+// tree of the go core repo. Up to Go 1.3 the library lived under src/pkg,
+// while the commands were under src/cmd with import paths starting with
+// "cmd/". Since Go 1.4 everything is directly under src.
+func stdlibRoots(t tree.Tree) ([]stdlibRoot, error) {
+	old, err := tree.IsDir(t, "src/pkg")
+	if err != nil {
+		return nil, err
+	}
+
+	if !old {
+		return []stdlibRoot{{dir: "src"}}, nil
+	}
+
+	roots := []stdlibRoot{{dir: "src/pkg"}}
+	hasCmd, err := tree.IsDir(t, "src/cmd")
+	if err != nil {
+		return nil, err
+	}
+	if hasCmd {
+		roots = append(roots, stdlibRoot{dir: "src/cmd", prefix: "cmd"})
+	}
+	return roots, nil
+}
+
+// stdlibPathFlags walks the roots and returns the flags for every import
+// path in them. Like the go tool, we ignore testdata directories and any
+// directory whose name starts with "." or "_".
+func stdlibPathFlags(t tree.Tree, roots []stdlibRoot) (map[string]int, error) {
+	flags := make(map[string]int)
+	for _, r := range roots {
+		err := r.walk(t, r.dir, flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return flags, nil
+}
+
+func (r stdlibRoot) walk(t tree.Tree, dir string, flags map[string]int) error {
+	entries, err := t.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	ip := r.importPath(dir)
+	if ip != "" {
+		flags[ip] |= goRepoPath
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name, ".") || strings.HasPrefix(e.Name, "_") {
+			continue
+		}
+		if e.IsDir {
+			if e.Name == "testdata" {
+				continue
+			}
+			err := r.walk(t, path.Join(dir, e.Name), flags)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ip != "" && strings.HasSuffix(e.Name, ".go") {
+			flags[ip] |= packagePath
+		}
+	}
+	return nil
+}
+
+// importPath returns the import path for a directory in the tree. This is
+// empty for the root itself, unless the root has a prefix, and for anything
+// outside the root.
+func (r stdlibRoot) importPath(dir string) string {
+	if !hasPathPrefix(dir, r.dir) {
+		return ""
+	}
+	rel := relPath(r.dir, dir)
+	if rel == "." {
+		return r.prefix
+	}
+	return path.Join(r.prefix, rel)
+}
@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// Retention decides which version tags of a repository are indexed. Huge
+// repositories can have hundreds of tags, and most people only care about
+// the newest release in each line.
+type Retention string
+
+const (
+	// Index every version tag.
+	RetainAll Retention = "all"
+	// Index the latest patch release of each minor version, like v1.2.9 but
+	// not v1.2.8.
+	RetainLatestPatch Retention = "latest-patch"
+	// Index the latest release of each major version.
+	RetainLatestMinor Retention = "latest-minor"
+)
+
+// ParseRetention turns a string like "latest-patch" into a Retention. An
+// empty string means RetainAll.
+func ParseRetention(s string) (Retention, error) {
+	switch r := Retention(s); r {
+	case "":
+		return RetainAll, nil
+	case RetainAll, RetainLatestPatch, RetainLatestMinor:
+		return r, nil
+	}
+	return "", fmt.Errorf("Unknown tag retention policy %q, expected one of %s, %s, or %s", s, RetainAll, RetainLatestPatch, RetainLatestMinor)
+}
+
+// tagVersion is a tag that names a version of a module in the repository.
+type tagVersion struct {
+	tag string
+	// The directory of the module the tag is for, like "sub/module" for the
+	// tag "sub/module/v1.0.0". This is empty for the repository root.
+	dir string
+	v   *version.Version
+}
+
+// Tags in the go core repo look like "go1.4", "go1.10.3", or "go1.12beta1".
+var goCoreTagRE = regexp.MustCompile(`^go([0-9]+(?:\.[0-9]+)*)((?:beta|rc)[0-9]+)?$`)
+
+// Everything else uses semver, optionally with a leading "v", prerelease,
+// and build metadata. A module in a subdirectory is tagged with the
+// directory as a prefix.
+var versionTagRE = regexp.MustCompile(`^(?:(.+)/)?(v?[0-9]+(?:\.[0-9]+)*(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?)$`)
+
+// parseTag returns nil if the tag isn't a version.
+func parseTag(tag string, isGoCore bool) *tagVersion {
+	var dir, name string
+	if isGoCore {
+		m := goCoreTagRE.FindStringSubmatch(tag)
+		if m == nil {
+			return nil
+		}
+		// The version package doesn't like the go core repo's tag names,
+		// so "go1.12beta1" becomes "1.12-beta1".
+		name = m[1]
+		if m[2] != "" {
+			name += "-" + m[2]
+		}
+	} else {
+		m := versionTagRE.FindStringSubmatch(tag)
+		if m == nil {
+			return nil
+		}
+		dir, name = m[1], m[2]
+	}
+
+	v, err := version.NewVersion(name)
+	if err != nil {
+		return nil
+	}
+	return &tagVersion{tag: tag, dir: dir, v: v}
+}
+
+// versionTags returns the tags that are versions, sorted by module
+// directory and then from newest to oldest.
+func versionTags(tags []string, isGoCore bool) []*tagVersion {
+	var versions []*tagVersion
+	for _, t := range tags {
+		if tv := parseTag(t, isGoCore); tv != nil {
+			versions = append(versions, tv)
+		}
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].dir != versions[j].dir {
+			return versions[i].dir < versions[j].dir
+		}
+		return versions[i].v.GreaterThan(versions[j].v)
+	})
+	return versions
+}
+
+// apply returns the tags we should keep. The tags must be sorted the way
+// versionTags sorts them. Within each version line we keep the newest
+// release, plus the newest prerelease if it is newer than every release.
+func (r Retention) apply(tags []*tagVersion) []*tagVersion {
+	if r == RetainAll || r == "" {
+		return tags
+	}
+
+	type seen struct {
+		release    bool
+		prerelease bool
+	}
+	lines := make(map[string]*seen)
+
+	var kept []*tagVersion
+	for _, tv := range tags {
+		key := r.line(tv)
+		s := lines[key]
+		if s == nil {
+			s = &seen{}
+			lines[key] = s
+		}
+
+		// Since we go from newest to oldest, any prerelease we see before
+		// a release is newer than all the releases in the line.
+		if s.release {
+			continue
+		}
+		if tv.v.Prerelease() != "" {
+			if s.prerelease {
+				continue
+			}
+			s.prerelease = true
+		} else {
+			s.release = true
+		}
+		kept = append(kept, tv)
+	}
+	return kept
+}
+
+// line returns the version line that a tag belongs to under this policy.
+func (r Retention) line(tv *tagVersion) string {
+	segments := tv.v.Segments()
+	parts := []string{tv.dir, fmt.Sprintf("%d", segments[0])}
+	if r == RetainLatestPatch {
+		parts = append(parts, fmt.Sprintf("%d", segments[1]))
+	}
+	return strings.Join(parts, "/")
+}
+
+// keep applies the policy to a list of module versions, like "v1.2.3",
+// without changing their order.
+func (r Retention) keep(versions []string) []string {
+	keep := make(map[string]bool)
+	for _, tv := range r.apply(versionTags(versions, false)) {
+		keep[tv.tag] = true
+	}
+
+	var kept []string
+	for _, v := range versions {
+		if keep[v] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
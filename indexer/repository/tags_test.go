@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		tag      string
+		isGoCore bool
+		dir      string
+		version  string
+	}{
+		{"v1.2.3", false, "", "1.2.3"},
+		{"1.2.3", false, "", "1.2.3"},
+		{"v1.2", false, "", "1.2.0"},
+		{"v1.2.3-rc.1", false, "", "1.2.3-rc.1"},
+		{"v1.2.3+incompatible", false, "", "1.2.3+incompatible"},
+		{"sub/module/v1.0.0", false, "sub/module", "1.0.0"},
+		{"release", false, "", ""},
+		{"sub/module/latest", false, "", ""},
+		{"go1.12beta1", false, "", ""},
+		{"go1.12beta1", true, "", "1.12.0-beta1"},
+		{"go1.12rc2", true, "", "1.12.0-rc2"},
+		{"go1.10.3", true, "", "1.10.3"},
+		{"go1.4", true, "", "1.4.0"},
+		{"v1.2.3", true, "", ""},
+		{"release-branch.go1.12", true, "", ""},
+	}
+
+	for _, test := range tests {
+		tv := parseTag(test.tag, test.isGoCore)
+		if test.version == "" {
+			assert.Nil(t, tv, "%s is not a version (go core = %v)", test.tag, test.isGoCore)
+			continue
+		}
+		if assert.NotNil(t, tv, "%s is a version (go core = %v)", test.tag, test.isGoCore) {
+			assert.Equal(t, test.tag, tv.tag, "tag for %s", test.tag)
+			assert.Equal(t, test.dir, tv.dir, "dir for %s", test.tag)
+			assert.Equal(t, test.version, tv.v.String(), "version for %s", test.tag)
+		}
+	}
+}
+
+func TestRetentionLine(t *testing.T) {
+	tests := []struct {
+		tag      string
+		isGoCore bool
+		r        Retention
+		expected string
+	}{
+		{"v1.2.3", false, RetainLatestPatch, "/1/2"},
+		{"v1.2.3", false, RetainLatestMinor, "/1"},
+		{"v1.2.3-rc.1", false, RetainLatestPatch, "/1/2"},
+		{"v2", false, RetainLatestPatch, "/2/0"},
+		{"sub/module/v1.0.0", false, RetainLatestPatch, "sub/module/1/0"},
+		{"sub/module/v1.0.0", false, RetainLatestMinor, "sub/module/1"},
+		{"go1.12beta1", true, RetainLatestPatch, "/1/12"},
+		{"go1.12beta1", true, RetainLatestMinor, "/1"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.r.line(parseTag(test.tag, test.isGoCore)), "%s line for %s", test.r, test.tag)
+	}
+}
+
+func TestRetentionApply(t *testing.T) {
+	tags := []string{
+		"v1.0.0",
+		"v1.1.0",
+		"v1.1.1",
+		"v1.2.0-rc.1",
+		"v1.2.0-rc.2",
+		"v2.0.0-beta.1",
+		"v2.0.0",
+		"v2.0.1-beta.1",
+		"sub/module/v1.0.0",
+		"sub/module/v1.0.1",
+		"not-a-version",
+	}
+	goCoreTags := []string{
+		"go1.11.4",
+		"go1.11.5",
+		"go1.12beta1",
+		"go1.12rc1",
+		"go1.12",
+		"go1.13beta1",
+	}
+
+	tests := []struct {
+		name     string
+		tags     []string
+		isGoCore bool
+		r        Retention
+		expected []string
+	}{
+		{
+			"all",
+			tags,
+			false,
+			RetainAll,
+			[]string{
+				"v2.0.1-beta.1",
+				"v2.0.0",
+				"v2.0.0-beta.1",
+				"v1.2.0-rc.2",
+				"v1.2.0-rc.1",
+				"v1.1.1",
+				"v1.1.0",
+				"v1.0.0",
+				"sub/module/v1.0.1",
+				"sub/module/v1.0.0",
+			},
+		},
+		{
+			"latest patch",
+			tags,
+			false,
+			RetainLatestPatch,
+			[]string{
+				// A prerelease that is newer than every release in its
+				// line is kept along with the newest release.
+				"v2.0.1-beta.1",
+				"v2.0.0",
+				// A line with only prereleases keeps the newest one.
+				"v1.2.0-rc.2",
+				"v1.1.1",
+				"v1.0.0",
+				"sub/module/v1.0.1",
+			},
+		},
+		{
+			"latest minor",
+			tags,
+			false,
+			RetainLatestMinor,
+			[]string{
+				"v2.0.1-beta.1",
+				"v2.0.0",
+				"v1.2.0-rc.2",
+				"v1.1.1",
+				"sub/module/v1.0.1",
+			},
+		},
+		{
+			"latest patch for the go core repo",
+			goCoreTags,
+			true,
+			RetainLatestPatch,
+			[]string{
+				"go1.13beta1",
+				"go1.12",
+				"go1.11.5",
+			},
+		},
+		{
+			"latest minor for the go core repo",
+			goCoreTags,
+			true,
+			RetainLatestMinor,
+			[]string{
+				"go1.13beta1",
+				"go1.12",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, tv := range test.r.apply(versionTags(test.tags, test.isGoCore)) {
+			got = append(got, tv.tag)
+		}
+		assert.Equal(t, test.expected, got, test.name)
+	}
+}
@@ -1,15 +1,14 @@
 package repository
 
 import (
-	"log"
 	"os"
 )
 
-func pathExists(path string) bool {
+func pathExists(path string) (bool, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return false
+		return false, nil
 	} else if err != nil {
-		log.Panic(err)
+		return false, err
 	}
-	return true
+	return true, nil
 }
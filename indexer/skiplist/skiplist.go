@@ -0,0 +1,204 @@
+// Package skiplist decides which repositories the indexer should never index.
+// The list is a JSON file like this:
+//
+//	{
+//	    "skip": [
+//	        { "glob": "github.com/example/huge-monorepo", "reason": "Not Go code" },
+//	        { "glob": "github.com/someone/*", "reason": "Asked us not to index their code" },
+//	        { "regex": "^github\\.com/[^/]+/gobook$", "reason": "Books, not libraries" }
+//	    ]
+//	}
+//
+// Each entry is matched against the repository ID, for example
+// "github.com/stretchr/testify". A glob is matched with path.Match, so "*"
+// does not match a "/". A regex is matched anywhere in the ID unless it is
+// anchored. Every entry needs a reason so that we know why it is there.
+//
+// The file is checked for changes every so often, so entries can be added or
+// removed without restarting the indexer.
+package skiplist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+)
+
+type Entry struct {
+	Glob   string `json:"glob,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Reason string `json:"reason"`
+
+	re *regexp.Regexp
+}
+
+type file struct {
+	Skip []*Entry `json:"skip"`
+}
+
+// Default is used when no file is given. Big repositories like
+// github.com/aws/aws-sdk-go used to be on this list. They don't need to be
+// now that packages are streamed into their own index and clones and fetches
+// run under METAGODOC_GIT_TIMEOUT, which defaults to an hour, instead of the
+// git package's 60 second limit. TestCloneTimeout in the clonecache package
+// checks that a clone slower than the git package's limit succeeds.
+var Default = []*Entry{
+	{Glob: "github.com/GoesToEleven/GolangTraining", Reason: "A slide deck"},
+	{Glob: "github.com/qiniu/gobook", Reason: "Contains an invalid .go file with no package"},
+	{Glob: "github.com/adonovan/gopl.io", Reason: "A book"},
+}
+
+// How often we check whether the file has changed.
+const reloadInterval = 10 * time.Second
+
+// List is safe to use from multiple goroutines.
+type List struct {
+	l    *logger.Logger
+	path string
+
+	entries []*Entry
+	modTime time.Time
+	checked time.Time
+
+	mutex sync.Mutex
+}
+
+// New loads the skip list from the file at path. If path is empty the list
+// contains the Default entries and is never reloaded.
+func New(l *logger.Logger, path string) (*List, error) {
+	sl := &List{l: l, path: path}
+	if path == "" {
+		sl.entries = Default
+		return sl, nil
+	}
+
+	err := sl.load()
+	if err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+// Parse parses the contents of a skip list file.
+func Parse(data []byte) ([]*Entry, error) {
+	f := &file{}
+	err := json.Unmarshal(data, f)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range f.Skip {
+		if (e.Glob == "") == (e.Regex == "") {
+			return nil, fmt.Errorf("Entry %d must have exactly one of glob or regex", i+1)
+		}
+		if e.Reason == "" {
+			return nil, fmt.Errorf("Entry %d (%s%s) does not have a reason", i+1, e.Glob, e.Regex)
+		}
+
+		if e.Glob != "" {
+			_, err := path.Match(e.Glob, "")
+			if err != nil {
+				return nil, fmt.Errorf("Entry %d has an invalid glob, %s: %s", i+1, e.Glob, err)
+			}
+			continue
+		}
+
+		e.re, err = regexp.Compile(e.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Entry %d has an invalid regex, %s: %s", i+1, e.Regex, err)
+		}
+	}
+
+	return f.Skip, nil
+}
+
+// Match returns the reason the repository should be skipped, and true, if
+// it matches an entry in the list.
+func (sl *List) Match(id string) (string, bool) {
+	sl.maybeReload()
+
+	sl.mutex.Lock()
+	entries := sl.entries
+	sl.mutex.Unlock()
+
+	for _, e := range entries {
+		if e.matches(id) {
+			return e.Reason, true
+		}
+	}
+	return "", false
+}
+
+func (e *Entry) matches(id string) bool {
+	if e.Glob != "" {
+		ok, _ := path.Match(e.Glob, id)
+		return ok
+	}
+	// Parse compiles the regex, so an entry that didn't come from Parse can
+	// only use a glob.
+	return e.re != nil && e.re.MatchString(id)
+}
+
+// maybeReload reloads the file if it has changed since we last loaded it. If
+// the new file can't be loaded we keep using the entries we already have.
+func (sl *List) maybeReload() {
+	if sl.path == "" {
+		return
+	}
+
+	sl.mutex.Lock()
+	due := time.Since(sl.checked) >= reloadInterval
+	if due {
+		sl.checked = time.Now()
+	}
+	sl.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	err := sl.load()
+	if err != nil {
+		sl.l.Errorf("Could not reload the skip list, still using the old one: %s", err)
+	}
+}
+
+func (sl *List) load() error {
+	fi, err := os.Stat(sl.path)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not stat the skip list at %s: {{err}}", sl.path), err)
+	}
+
+	sl.mutex.Lock()
+	unchanged := fi.ModTime().Equal(sl.modTime)
+	sl.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(sl.path)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not read the skip list at %s: {{err}}", sl.path), err)
+	}
+	entries, err := Parse(data)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("Could not parse the skip list at %s: {{err}}", sl.path), err)
+	}
+
+	sl.mutex.Lock()
+	sl.entries = entries
+	sl.modTime = fi.ModTime()
+	sl.checked = time.Now()
+	sl.mutex.Unlock()
+
+	sl.l.Infof("Loaded %d entries from the skip list at %s", len(entries), sl.path)
+	return nil
+}
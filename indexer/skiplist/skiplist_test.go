@@ -0,0 +1,107 @@
+package skiplist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const skipFile = `{
+    "skip": [
+        { "glob": "github.com/golang/go", "reason": "core" },
+        { "glob": "github.com/spammer/*", "reason": "spam" },
+        { "regex": "^gopkg\\.in/.+\\.v0$", "reason": "unstable" }
+    ]
+}`
+
+func TestParse(t *testing.T) {
+	entries, err := Parse([]byte(skipFile))
+	assert.Nil(t, err, "no error parsing the skip list")
+	assert.Len(t, entries, 3, "three entries")
+
+	bad := map[string]string{
+		"both":      `{"skip":[{"glob":"a","regex":"b","reason":"r"}]}`,
+		"neither":   `{"skip":[{"reason":"r"}]}`,
+		"no reason": `{"skip":[{"glob":"a"}]}`,
+		"bad glob":  `{"skip":[{"glob":"[","reason":"r"}]}`,
+		"bad regex": `{"skip":[{"regex":"(","reason":"r"}]}`,
+		"not json":  `skip`,
+	}
+	for name, content := range bad {
+		_, err := Parse([]byte(content))
+		assert.NotNil(t, err, "error for %s", name)
+	}
+}
+
+func TestList(t *testing.T) {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "skiplist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "skiplist.json")
+	err = ioutil.WriteFile(file, []byte(skipFile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sl, err := New(l, file)
+	assert.Nil(t, err, "no error loading the skip list")
+
+	for id, reason := range map[string]string{
+		"github.com/golang/go":        "core",
+		"github.com/spammer/foo":      "spam",
+		"gopkg.in/yaml.v0":            "unstable",
+		"github.com/stretchr/testify": "",
+		"github.com/spammer/foo/bar":  "",
+	} {
+		got, ok := sl.Match(id)
+		assert.Equal(t, reason != "", ok, "%s matches", id)
+		assert.Equal(t, reason, got, "reason for %s", id)
+	}
+
+	err = ioutil.WriteFile(file, []byte(`{"skip":[{"glob":"github.com/stretchr/*","reason":"new"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes and the reload is due.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(file, later, later)
+	sl.checked = time.Time{}
+
+	reason, ok := sl.Match("github.com/stretchr/testify")
+	assert.True(t, ok, "matches an entry in the reloaded file")
+	assert.Equal(t, "new", reason, "reason from the reloaded file")
+	_, ok = sl.Match("github.com/golang/go")
+	assert.False(t, ok, "entries removed from the file no longer match")
+
+	err = ioutil.WriteFile(file, []byte(`not json`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(file, later, later)
+	sl.checked = time.Time{}
+
+	_, ok = sl.Match("github.com/stretchr/testify")
+	assert.True(t, ok, "an invalid file leaves the old entries in place")
+}
+
+func TestDefault(t *testing.T) {
+	sl, err := New(nil, "")
+	assert.Nil(t, err, "no error without a file")
+	_, ok := sl.Match("github.com/adonovan/gopl.io")
+	assert.True(t, ok, "default entries are used without a file")
+}
@@ -0,0 +1,221 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.gitea.io/git"
+	"github.com/hashicorp/errwrap"
+)
+
+// Git is the tree for a commit in a git repository. We list every file in
+// the commit up front with "git ls-tree". File contents are read when they
+// are asked for through a single "git cat-file --batch" process, which is
+// started the first time ReadFile is called. Call Close to stop it.
+//
+// A Git tree is safe to use from multiple goroutines, and any number of
+// trees can be open on the same repository at once.
+type Git struct {
+	repoDir string
+	commit  string
+	ctx     context.Context
+
+	dirs  map[string][]Entry
+	blobs map[string]string
+	trees map[string]string
+
+	batch  *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	mutex  sync.Mutex
+}
+
+// The modes that ls-tree gives symlinks and submodules. We skip both since
+// neither is something we can parse.
+const (
+	symlinkMode   = "120000"
+	submoduleMode = "160000"
+)
+
+// NewGit returns the tree for a commit, which can be anything that git can
+// resolve to a commit, in the repository at repoDir.
+func NewGit(repoDir, commit string, ctx context.Context) (*Git, error) {
+	stdout, err := git.NewCommand("ls-tree", "-r", "-t", "-z", "--full-tree", commit).RunInDirBytes(repoDir)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not list the files in %s: {{err}}", commit), err)
+	}
+
+	root, err := git.NewCommand("rev-parse", commit+"^{tree}").RunInDir(repoDir)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not find the tree for %s: {{err}}", commit), err)
+	}
+
+	g := &Git{
+		repoDir: repoDir,
+		commit:  commit,
+		ctx:     ctx,
+		dirs:    map[string][]Entry{".": nil},
+		blobs:   make(map[string]string),
+		trees:   map[string]string{".": strings.TrimSpace(root)},
+	}
+	err = g.parseLsTree(stdout)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse the files in %s: {{err}}", commit), err)
+	}
+	return g, nil
+}
+
+// Each record is "<mode> SP <type> SP <object> TAB <path>" and ends with a
+// NUL.
+func (g *Git) parseLsTree(out []byte) error {
+	for _, rec := range bytes.Split(out, []byte{0}) {
+		if len(rec) == 0 {
+			continue
+		}
+
+		tab := bytes.IndexByte(rec, '\t')
+		if tab == -1 {
+			return fmt.Errorf("Invalid ls-tree output: %q", rec)
+		}
+		meta := strings.Fields(string(rec[:tab]))
+		if len(meta) != 3 {
+			return fmt.Errorf("Invalid ls-tree output: %q", rec)
+		}
+		mode, typ, obj, p := meta[0], meta[1], meta[2], string(rec[tab+1:])
+
+		if mode == symlinkMode || mode == submoduleMode {
+			continue
+		}
+
+		isDir := typ == "tree"
+		if isDir {
+			if _, ok := g.dirs[p]; !ok {
+				g.dirs[p] = nil
+			}
+			g.trees[p] = obj
+		} else {
+			g.blobs[p] = obj
+		}
+
+		parent := path.Dir(p)
+		g.dirs[parent] = append(g.dirs[parent], Entry{Name: path.Base(p), IsDir: isDir})
+	}
+
+	// Git sorts a directory as if its name ended with a "/", but we want the
+	// same order as ioutil.ReadDir.
+	for _, entries := range g.dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	return nil
+}
+
+func (g *Git) ReadDir(dir string) ([]Entry, error) {
+	entries, ok := g.dirs[path.Clean(dir)]
+	if !ok {
+		return nil, notExist("readdir", dir)
+	}
+	return entries, nil
+}
+
+// DirHash returns the git tree hash for a directory.
+func (g *Git) DirHash(dir string) (string, bool) {
+	h, ok := g.trees[path.Clean(dir)]
+	return h, ok
+}
+
+func (g *Git) ReadFile(name string) ([]byte, error) {
+	obj, ok := g.blobs[path.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.batch == nil {
+		err := g.startBatch()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := g.readObject(obj)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not read %s from %s: {{err}}", name, g.commit), err)
+	}
+	return content, nil
+}
+
+func (g *Git) startBatch() error {
+	cmd := exec.CommandContext(g.ctx, "git", "cat-file", "--batch")
+	cmd.Dir = g.repoDir
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return errwrap.Wrapf("Could not start git cat-file: {{err}}", err)
+	}
+
+	g.batch, g.stdin, g.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// readObject asks cat-file for an object. The reply is a line like
+// "<object> <type> <size>", then the contents, then a newline.
+func (g *Git) readObject(obj string) ([]byte, error) {
+	_, err := io.WriteString(g.stdin, obj+"\n")
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := g.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Unexpected reply from git cat-file: %q", header)
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected reply from git cat-file: %q", header)
+	}
+
+	content := make([]byte, size+1)
+	_, err = io.ReadFull(g.stdout, content)
+	if err != nil {
+		return nil, err
+	}
+	return content[:size], nil
+}
+
+// Close stops the cat-file process, if we started one.
+func (g *Git) Close() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.batch == nil {
+		return nil
+	}
+
+	g.stdin.Close()
+	err := g.batch.Wait()
+	g.batch = nil
+	return err
+}
@@ -0,0 +1,82 @@
+// Package tree gives the indexer a read-only view of a directory tree. The
+// tree can be a directory on disk or a commit in a git repository. Reading a
+// commit straight from the git object database means that we never have to
+// check it out, so many commits from the same clone can be read at once.
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Entry is a file or directory in a tree.
+type Entry struct {
+	Name  string
+	IsDir bool
+}
+
+// Tree is implemented by anything we can read Go code from. Every path is
+// slash-separated and relative to the root of the tree, which is ".".
+type Tree interface {
+	// ReadDir returns the entries in a directory, sorted by name.
+	ReadDir(dir string) ([]Entry, error)
+	// ReadFile returns the contents of a file.
+	ReadFile(name string) ([]byte, error)
+}
+
+// Hasher is implemented by trees that have a hash of each directory's
+// contents, like a git tree hash. Two directories with the same hash contain
+// exactly the same files.
+type Hasher interface {
+	// DirHash returns false if the directory isn't in the tree.
+	DirHash(dir string) (string, bool)
+}
+
+// Both methods return an error that satisfies os.IsNotExist when the path
+// is not in the tree.
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// IsDir reports whether the directory exists in the tree.
+func IsDir(t Tree, dir string) (bool, error) {
+	_, err := t.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+type dirTree struct {
+	root string
+}
+
+// Dir returns a tree for a directory on disk.
+func Dir(root string) Tree {
+	return dirTree{root: root}
+}
+
+func (d dirTree) ReadDir(dir string) ([]Entry, error) {
+	files, err := ioutil.ReadDir(d.path(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(files))
+	for i, f := range files {
+		entries[i] = Entry{Name: f.Name(), IsDir: f.IsDir()}
+	}
+	return entries, nil
+}
+
+func (d dirTree) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(name))
+}
+
+func (d dirTree) path(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
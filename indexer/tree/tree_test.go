@@ -0,0 +1,105 @@
+package tree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var files = map[string]string{
+	"README.md":         "# Hello\n",
+	"foo.go":            "package foo\n",
+	"sub/bar.go":        "package bar\n",
+	"sub/deeper/baz.go": "package baz\n",
+}
+
+func TestTrees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tree-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "first"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+
+	// Once it's committed, the git tree shouldn't care what's on disk.
+	err = ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package changed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGit(dir, "HEAD", context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	entries, err := g.ReadDir(".")
+	assert.Nil(t, err, "no error reading the root of the git tree")
+	assert.Equal(t, []Entry{
+		{Name: "README.md"},
+		{Name: "foo.go"},
+		{Name: "sub", IsDir: true},
+	}, entries, "root entries")
+
+	entries, err = g.ReadDir("sub")
+	assert.Nil(t, err, "no error reading sub")
+	assert.Equal(t, []Entry{
+		{Name: "bar.go"},
+		{Name: "deeper", IsDir: true},
+	}, entries, "sub entries")
+
+	for name, content := range files {
+		c, err := g.ReadFile(name)
+		assert.Nil(t, err, "no error reading %s", name)
+		assert.Equal(t, content, string(c), "contents of %s", name)
+	}
+
+	_, err = g.ReadDir("nope")
+	assert.True(t, os.IsNotExist(err), "missing directory")
+	_, err = g.ReadFile("sub/nope.go")
+	assert.True(t, os.IsNotExist(err), "missing file")
+
+	root, ok := g.DirHash(".")
+	assert.True(t, ok, "root has a hash")
+	sub, ok := g.DirHash("sub")
+	assert.True(t, ok, "sub has a hash")
+	assert.NotEqual(t, root, sub, "root and sub have different hashes")
+
+	isDir, err := IsDir(g, "sub/deeper")
+	assert.Nil(t, err, "no error from IsDir")
+	assert.True(t, isDir, "sub/deeper is a directory")
+
+	d := Dir(dir)
+	c, err := d.ReadFile("foo.go")
+	assert.Nil(t, err, "no error reading foo.go from disk")
+	assert.Equal(t, "package changed\n", string(c), "the disk tree sees the change")
+}
@@ -0,0 +1,277 @@
+// Package vanity resolves vanity import paths like "gopkg.in/yaml.v2" or
+// "golang.org/x/text" to the repository that hosts them. It does this the
+// same way the go command does, by fetching the import path with
+// "?go-get=1" and looking for go-import and go-source meta tags. See
+// https://golang.org/cmd/go/#hdr-Remote_import_paths for details.
+package vanity
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// ErrNoMeta is returned when the page for an import path does not contain a
+// go-import meta tag that matches the import path.
+var ErrNoMeta = errors.New("No go-import meta tag was found")
+
+// Meta is the information found in the meta tags for an import path.
+type Meta struct {
+	// The import path prefix that corresponds to the root of the
+	// repository. This is the canonical import path for the root.
+	Prefix string
+	VCS    string
+	// The URL of the repository, which can be cloned with the VCS.
+	RepoURL string
+	// This is nil if there was no go-source meta tag.
+	Source *Source
+}
+
+// Source is the content of a go-source meta tag. These are URL templates for
+// browsing the code. See https://github.com/golang/gddo/wiki/Source-Code-Links
+// for details.
+type Source struct {
+	Home      string
+	Directory string
+	File      string
+}
+
+// How long we cache what we find for an import path. A page without a
+// go-import meta tag counts as something we found. Any other error, like a
+// timeout or a 5xx from the host, is only cached briefly, since the host may
+// be back soon.
+const (
+	cacheTTL      = 6 * time.Hour
+	cacheErrorTTL = 5 * time.Minute
+)
+
+// The most import paths we cache. The indexer runs for a long time and the
+// spider can see a lot of import paths.
+const cacheMaxSize = 10000
+
+type Resolver struct {
+	http *http.Client
+	ctx  context.Context
+
+	// If this is true we fall back to plain http when https fails. This is
+	// the same as "go get -insecure".
+	insecure bool
+
+	// Many packages in the same repository will resolve to the same prefix
+	// so we cache everything we fetch.
+	cache    map[string]*cached
+	ttl      time.Duration
+	errorTTL time.Duration
+	maxSize  int
+	mutex    sync.Mutex
+}
+
+type cached struct {
+	meta    *Meta
+	err     error
+	expires time.Time
+}
+
+func NewResolver(insecure bool, ctx context.Context) *Resolver {
+	return &Resolver{
+		http:     &http.Client{Timeout: time.Duration(30) * time.Second},
+		ctx:      ctx,
+		insecure: insecure,
+		cache:    make(map[string]*cached),
+		ttl:      cacheTTL,
+		errorTTL: cacheErrorTTL,
+		maxSize:  cacheMaxSize,
+	}
+}
+
+// Resolve finds the repository for an import path. If the meta tag's prefix
+// is shorter than the import path then we also fetch the prefix and make
+// sure it has the same meta tag, just like the go command does.
+func (r *Resolver) Resolve(importPath string) (*Meta, error) {
+	r.mutex.Lock()
+	c, ok := r.cache[importPath]
+	r.mutex.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.meta, c.err
+	}
+
+	m, err := r.resolve(importPath)
+
+	ttl := r.ttl
+	if err != nil && err != ErrNoMeta {
+		ttl = r.errorTTL
+	}
+	r.mutex.Lock()
+	r.makeRoom()
+	r.cache[importPath] = &cached{m, err, time.Now().Add(ttl)}
+	r.mutex.Unlock()
+
+	return m, err
+}
+
+// makeRoom makes sure there is room for one more entry in the cache. We
+// drop the expired entries first. If that isn't enough we drop entries at
+// random until there's room, which is good enough for a cache that only
+// fills up when the spider is very busy. The mutex must be held.
+func (r *Resolver) makeRoom() {
+	if len(r.cache) < r.maxSize {
+		return
+	}
+
+	now := time.Now()
+	for p, c := range r.cache {
+		if !now.Before(c.expires) {
+			delete(r.cache, p)
+		}
+	}
+	for p := range r.cache {
+		if len(r.cache) < r.maxSize {
+			break
+		}
+		delete(r.cache, p)
+	}
+}
+
+func (r *Resolver) resolve(importPath string) (*Meta, error) {
+	m, err := r.fetchMeta(importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Prefix == importPath {
+		return m, nil
+	}
+
+	root, err := r.fetchMeta(m.Prefix)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not verify the go-import prefix %s: {{err}}", m.Prefix), err)
+	}
+	if root.Prefix != m.Prefix || root.VCS != m.VCS || root.RepoURL != m.RepoURL {
+		return nil, fmt.Errorf("The go-import meta tag for %s does not match the one for %s", m.Prefix, importPath)
+	}
+
+	return m, nil
+}
+
+func (r *Resolver) fetchMeta(importPath string) (*Meta, error) {
+	body, err := r.fetch("https", importPath)
+	if err != nil && r.insecure {
+		body, err = r.fetch("http", importPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ParseMeta(importPath, body)
+}
+
+func (r *Resolver) fetch(scheme, importPath string) (io.ReadCloser, error) {
+	u := fmt.Sprintf("%s://%s?go-get=1", scheme, importPath)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.http.Do(req.WithContext(r.ctx))
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Error fetching %s: {{err}}", u), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Fetching %s returned an unexpected status: %s", u, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// ParseMeta looks for go-import and go-source meta tags in an HTML document
+// and returns the ones which apply to the import path. Like the go command,
+// this stops looking once it sees the body of the document.
+func ParseMeta(importPath string, r io.Reader) (*Meta, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	// We don't care about the charset since everything we want is ASCII.
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var m *Meta
+	var sources []*Source
+	var sourcePrefixes []string
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err != io.EOF && m == nil {
+				return nil, errwrap.Wrapf("Could not parse the HTML: {{err}}", err)
+			}
+			break
+		}
+
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			break
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			break
+		}
+
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") {
+			continue
+		}
+
+		name := attrValue(e.Attr, "name")
+		fields := strings.Fields(attrValue(e.Attr, "content"))
+		switch {
+		case name == "go-import" && len(fields) == 3:
+			// The "mod" VCS points at a module proxy rather than a
+			// repository, so it's no use to us.
+			if !hasPathPrefix(importPath, fields[0]) || fields[1] == "mod" {
+				continue
+			}
+			if m != nil {
+				return nil, fmt.Errorf("Found more than one go-import meta tag for %s", importPath)
+			}
+			m = &Meta{Prefix: fields[0], VCS: fields[1], RepoURL: fields[2]}
+		case name == "go-source" && len(fields) == 4:
+			sourcePrefixes = append(sourcePrefixes, fields[0])
+			sources = append(sources, &Source{Home: fields[1], Directory: fields[2], File: fields[3]})
+		}
+	}
+
+	if m == nil {
+		return nil, ErrNoMeta
+	}
+
+	for i, p := range sourcePrefixes {
+		if p == m.Prefix {
+			m.Source = sources[i]
+			break
+		}
+	}
+
+	return m, nil
+}
+
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func hasPathPrefix(s, prefix string) bool {
+	return s == prefix || strings.HasPrefix(s, prefix+"/")
+}
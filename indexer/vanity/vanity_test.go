@@ -0,0 +1,110 @@
+package vanity
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlPage = `<html>
+<head>
+<meta name="go-import" content="gopkg.in/yaml.v2 git https://gopkg.in/yaml.v2">
+<meta name="go-import" content="gopkg.in/yaml.v2 mod https://proxy.example.com">
+<meta name="go-source" content="gopkg.in/yaml.v2 _ https://github.com/go-yaml/yaml/tree/v2{/dir} https://github.com/go-yaml/yaml/blob/v2{/dir}/{file}#L{line}">
+</head>
+<body>
+<meta name="go-import" content="gopkg.in/yaml.v2 git https://example.com/ignored">
+</body>
+</html>`
+
+func TestParseMeta(t *testing.T) {
+	m, err := ParseMeta("gopkg.in/yaml.v2", strings.NewReader(yamlPage))
+	assert.Nil(t, err, "no error parsing the page")
+	assert.Equal(t, "gopkg.in/yaml.v2", m.Prefix, "Prefix")
+	assert.Equal(t, "git", m.VCS, "VCS")
+	assert.Equal(t, "https://gopkg.in/yaml.v2", m.RepoURL, "RepoURL")
+	assert.Equal(t, "_", m.Source.Home, "Source.Home")
+	assert.Equal(t, "https://github.com/go-yaml/yaml/tree/v2{/dir}", m.Source.Directory, "Source.Directory")
+
+	m, err = ParseMeta("gopkg.in/yaml.v2/internal", strings.NewReader(yamlPage))
+	assert.Nil(t, err, "no error parsing the page for a subdirectory")
+	assert.Equal(t, "gopkg.in/yaml.v2", m.Prefix, "Prefix for a subdirectory")
+
+	_, err = ParseMeta("gopkg.in/yaml.v3", strings.NewReader(yamlPage))
+	assert.Equal(t, ErrNoMeta, err, "no meta tag for an import path that does not match")
+
+	_, err = ParseMeta("gopkg.in/yaml.v2.x", strings.NewReader(yamlPage))
+	assert.Equal(t, ErrNoMeta, err, "the prefix must match on a path boundary")
+
+	two := `<meta name="go-import" content="example.com/a git https://example.com/a">
+<meta name="go-import" content="example.com/a git https://example.com/b">`
+	_, err = ParseMeta("example.com/a", strings.NewReader(two))
+	assert.NotNil(t, err, "more than one matching go-import tag is an error")
+}
+
+func TestResolver(t *testing.T) {
+	var host string
+	requests := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		assert.Equal(t, "1", r.URL.Query().Get("go-get"), "go-get=1 is passed")
+
+		switch r.URL.Path {
+		case "/text", "/text/encoding":
+			fmt.Fprintf(w, `<meta name="go-import" content="%s/text git https://go.example.com/text">`, host)
+		case "/liar":
+			fmt.Fprintf(w, `<meta name="go-import" content="%s/text git https://evil.example.com/text">`, host)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+	host = strings.TrimPrefix(s.URL, "http://")
+
+	r := NewResolver(true, context.Background())
+
+	m, err := r.Resolve(host + "/text/encoding")
+	assert.Nil(t, err, "no error resolving a package in a vanity repo")
+	assert.Equal(t, host+"/text", m.Prefix, "Prefix")
+	assert.Equal(t, "https://go.example.com/text", m.RepoURL, "RepoURL")
+	assert.Equal(t, 1, requests["/text"], "the prefix was fetched to verify it")
+
+	_, err = r.Resolve(host + "/text/encoding")
+	assert.Nil(t, err, "no error resolving again")
+	assert.Equal(t, 1, requests["/text/encoding"], "the second resolve was cached")
+
+	_, err = r.Resolve(host + "/liar")
+	assert.NotNil(t, err, "a meta tag for a different import path is ignored")
+
+	_, err = r.Resolve(host + "/missing")
+	assert.NotNil(t, err, "an error for a 404")
+
+	// An error is only cached briefly, so a host that was down is asked
+	// again once it has had time to come back.
+	r.Resolve(host + "/missing")
+	assert.Equal(t, 1, requests["/missing"], "an error is cached")
+	c := r.cache[host+"/missing"]
+	assert.True(t, c.expires.Before(time.Now().Add(time.Hour)), "an error expires sooner than a result")
+	c.expires = time.Now()
+	r.Resolve(host + "/missing")
+	assert.Equal(t, 2, requests["/missing"], "an expired error is fetched again")
+
+	r.cache[host+"/text/encoding"].expires = time.Now()
+	r.Resolve(host + "/text/encoding")
+	assert.Equal(t, 2, requests["/text/encoding"], "an expired result is fetched again")
+
+	r.maxSize = 2
+	r.Resolve(host + "/text")
+	r.Resolve(host + "/text/encoding")
+	assert.True(t, len(r.cache) <= 2, "the cache never grows past its maximum size")
+
+	secure := NewResolver(false, context.Background())
+	_, err = secure.Resolve(host + "/text")
+	assert.NotNil(t, err, "no fallback to http unless insecure is set")
+}
@@ -0,0 +1,239 @@
+// Package webhook receives GitHub webhooks so that repositories are indexed
+// again as soon as they change, rather than whenever a crawler happens to
+// reach them. We handle push, create, and release events. Every delivery
+// must be signed with the webhook's secret. See
+// https://developer.github.com/webhooks/ for details.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/autarch/metagodoc/indexer/repository"
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// GitHub never sends a payload bigger than this.
+const maxPayloadBytes = 25 * 1024 * 1024
+
+// Event is a change to one ref of a repository that means the repository
+// should be indexed again.
+type Event struct {
+	// The event name from the X-GitHub-Event header, like "push".
+	Name string
+	// The unique ID GitHub gives each delivery.
+	Delivery string
+	// The URL of the repository on GitHub, like
+	// "https://github.com/owner/name".
+	Repository string
+	// The branch or tag that changed, like "master" or "v1.2.0".
+	Ref string
+	// This is true if the ref was deleted.
+	Deleted bool
+}
+
+// Handler is an http.Handler for GitHub webhooks. Each event that changes a
+// ref we index is passed to the reindex func, which must not block for
+// long, since GitHub gives up on a delivery after 10 seconds.
+type Handler struct {
+	l       *logger.Logger
+	secret  []byte
+	reindex func(*Event)
+}
+
+func NewHandler(l *logger.Logger, secret string, reindex func(*Event)) (*Handler, error) {
+	if secret == "" {
+		return nil, errors.New("Cannot receive GitHub webhooks without a secret to check their signatures")
+	}
+
+	return &Handler{
+		l:       l,
+		secret:  []byte(secret),
+		reindex: reindex,
+	}, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadBytes+1))
+	if err != nil {
+		http.Error(w, "Could not read the request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxPayloadBytes {
+		http.Error(w, "The payload is too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !h.validSignature(r.Header.Get("X-Hub-Signature-256"), body) {
+		h.l.Infof("Rejected a webhook delivery with a bad signature from %s", r.RemoteAddr)
+		http.Error(w, "The X-Hub-Signature-256 header is missing or does not match the payload", http.StatusUnauthorized)
+		return
+	}
+
+	payload, err := payloadJSON(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.Header.Get("X-GitHub-Event")
+	e, err := ParseEvent(name, payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e == nil {
+		h.l.Infof("Ignoring a GitHub %s event", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	e.Delivery = r.Header.Get("X-GitHub-Delivery")
+	h.l.Infof("Got a GitHub %s event for %s of %s", e.Name, e.Ref, e.Repository)
+	h.reindex(e)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature checks a signature like "sha256=<hex digest>", which is
+// the HMAC of the body using the webhook's secret.
+func (h *Handler) validSignature(sig string, body []byte) bool {
+	if !strings.HasPrefix(sig, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// payloadJSON returns the JSON payload. A webhook can be set up to send it
+// as the "payload" field of a form instead of as the body.
+func payloadJSON(contentType string, body []byte) ([]byte, error) {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt != "application/x-www-form-urlencoded" {
+		return body, nil
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, errwrap.Wrapf("Could not parse the form: {{err}}", err)
+	}
+	return []byte(form.Get("payload")), nil
+}
+
+type ghRepository struct {
+	HTMLURL       string `json:"html_url"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+type pushPayload struct {
+	Ref        string       `json:"ref"`
+	Deleted    bool         `json:"deleted"`
+	Repository ghRepository `json:"repository"`
+}
+
+type createPayload struct {
+	Ref        string       `json:"ref"`
+	RefType    string       `json:"ref_type"`
+	Repository ghRepository `json:"repository"`
+}
+
+type releasePayload struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName string `json:"tag_name"`
+	} `json:"release"`
+	Repository ghRepository `json:"repository"`
+}
+
+// The release actions we reindex for, and whether the action removes the
+// release. Editing a release only changes its notes, which we don't index.
+// Removing a release may or may not delete its tag, so we treat it like a
+// deleted tag and let the fetch tell us whether the tag is still there.
+var releaseActions = map[string]bool{
+	"published":   false,
+	"unpublished": true,
+	"created":     false,
+	"released":    false,
+	"prereleased": false,
+	"deleted":     true,
+}
+
+// ParseEvent turns the payload of a GitHub event into an Event. It returns
+// nil if the event doesn't change anything we index, for example a push to
+// a feature branch or a ping.
+func ParseEvent(name string, payload []byte) (*Event, error) {
+	var (
+		e    *Event
+		repo ghRepository
+		err  error
+	)
+
+	switch name {
+	case "push":
+		var p pushPayload
+		err = json.Unmarshal(payload, &p)
+		repo = p.Repository
+		switch {
+		case strings.HasPrefix(p.Ref, "refs/tags/"):
+			e = &Event{Ref: strings.TrimPrefix(p.Ref, "refs/tags/"), Deleted: p.Deleted}
+		case strings.HasPrefix(p.Ref, "refs/heads/"):
+			branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+			if repository.IsIndexedBranch(branch, repo.DefaultBranch) {
+				e = &Event{Ref: branch, Deleted: p.Deleted}
+			}
+		}
+	case "create":
+		var p createPayload
+		err = json.Unmarshal(payload, &p)
+		repo = p.Repository
+		if p.RefType == "tag" || (p.RefType == "branch" && repository.IsIndexedBranch(p.Ref, repo.DefaultBranch)) {
+			e = &Event{Ref: p.Ref}
+		}
+	case "release":
+		var p releasePayload
+		err = json.Unmarshal(payload, &p)
+		repo = p.Repository
+		if deleted, ok := releaseActions[p.Action]; ok {
+			e = &Event{Ref: p.Release.TagName, Deleted: deleted}
+		}
+	default:
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Could not parse the %s event: {{err}}", name), err)
+	}
+	if e == nil {
+		return nil, nil
+	}
+	if repo.HTMLURL == "" {
+		return nil, fmt.Errorf("The %s event does not say which repository it is for", name)
+	}
+
+	e.Name = name
+	e.Repository = repo.HTMLURL
+	return e, nil
+}
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/autarch/metagodoc/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const secret = "It's a Secret to Everybody"
+
+func sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandler(t *testing.T) {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*Event
+	h, err := NewHandler(l, secret, func(e *Event) { got = append(got, e) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		event    string
+		file     string
+		status   int
+		expected *Event
+	}{
+		{"push", "push.json", http.StatusAccepted, &Event{Ref: "master"}},
+		{"push", "push-feature-branch.json", http.StatusNoContent, nil},
+		{"push", "push-delete-tag.json", http.StatusAccepted, &Event{Ref: "v1.2.0", Deleted: true}},
+		{"create", "create.json", http.StatusAccepted, &Event{Ref: "v1.2.0"}},
+		{"release", "release.json", http.StatusAccepted, &Event{Ref: "v1.2.0"}},
+		{"release", "release-deleted.json", http.StatusAccepted, &Event{Ref: "v1.2.0", Deleted: true}},
+		{"ping", "ping.json", http.StatusNoContent, nil},
+	}
+
+	for _, test := range tests {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = nil
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", test.event)
+		req.Header.Set("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		req.Header.Set("X-Hub-Signature-256", sign(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, test.status, w.Code, "status for %s", test.file)
+		if test.expected == nil {
+			assert.Empty(t, got, "no reindex for %s", test.file)
+			continue
+		}
+		test.expected.Name = test.event
+		test.expected.Delivery = "72d3162e-cc78-11e3-81ab-4c9367dc0958"
+		test.expected.Repository = "https://github.com/Codertocat/Hello-World"
+		assert.Equal(t, []*Event{test.expected}, got, "reindex for %s", test.file)
+	}
+}
+
+func TestHandlerSignature(t *testing.T) {
+	l, err := logger.New(logger.NewParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	h, err := NewHandler(l, secret, func(*Event) { called = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "push.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sig := range []string{"", "sha256=", "sha256=not-hex", sign([]byte("something else")), "sha1=" + sign(body)[len("sha256="):]} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		if sig != "" {
+			req.Header.Set("X-Hub-Signature-256", sig)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "status for signature %q", sig)
+	}
+	assert.False(t, called, "nothing is reindexed without a valid signature")
+
+	// The signature is for the form, not the payload in it.
+	form := []byte("payload=" + url.QueryEscape(string(body)))
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", sign(form))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code, "status for a form")
+	assert.True(t, called, "a form payload is reindexed")
+
+	_, err = NewHandler(l, "", func(*Event) {})
+	assert.NotNil(t, err, "a secret is required")
+}